@@ -0,0 +1,196 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	ackModeBroadcast = "broadcast"
+	ackFailureReject = "reject"
+)
+
+// manualAcks reports whether RabbitMQ deliveries are consumed without
+// auto-ack and settled once their broadcast outcome is known.
+func manualAcks() bool {
+	return conf().GetString("rabbitmq.ack.mode") == ackModeBroadcast
+}
+
+// deliveryAck settles one delivery after it has been written to enough
+// clients: rabbitmq.ack.min_clients for RabbitMQ deliveries in broadcast ack
+// mode, one otherwise. Once every queued frame is written or lost without
+// reaching that many, the delivery is dead-lettered if dead_letter is on, and
+// a RabbitMQ delivery is nacked if it isn't. A nil deliveryAck is a no-op,
+// which is what deliveries get when there is nothing to settle.
+type deliveryAck struct {
+	msg    amqp.Delivery
+	source string
+	need   int
+	// manual is set when msg must be acked or nacked with RabbitMQ.
+	manual     bool
+	deadLetter bool
+
+	mu      sync.Mutex
+	pending int
+	queued  int
+	written int
+	dropped string
+	settled bool
+	// exhausted is set once the delivery was redelivered
+	// rabbitmq.ack.max_redeliveries times.
+	exhausted bool
+}
+
+// newDeliveryAck starts tracking msg with one pending reference held by the
+// caller, who must release it once every frame has been queued.
+func newDeliveryAck(source string, msg amqp.Delivery) *deliveryAck {
+	manual := manualAcks() && msg.Acknowledger != nil
+	deadLetter := deadLettering(source)
+	if !manual && !deadLetter {
+		return nil
+	}
+	need := 1
+	if manual {
+		need = max(conf().GetInt("rabbitmq.ack.min_clients"), 1)
+	}
+	return &deliveryAck{msg: msg, source: source, need: need, manual: manual, deadLetter: deadLetter, pending: 1}
+}
+
+// track adds a pending frame queued for a client that must later be resolved.
+func (a *deliveryAck) track() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.pending++
+	a.queued++
+	a.mu.Unlock()
+}
+
+// resolve records the outcome of one pending frame, or of the caller's own
+// reference with written false.
+func (a *deliveryAck) resolve(written bool) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending--
+	if written {
+		a.written++
+	}
+	if a.settled {
+		return
+	}
+	switch {
+	case a.written >= a.need:
+		a.settled = true
+		if a.manual {
+			_ = a.msg.Ack(false)
+			forgetRequeues(a.msg)
+		}
+	case a.pending == 0:
+		a.settled = true
+		a.fail()
+	}
+}
+
+// drop releases the caller's reference to a delivery the relay dropped
+// before broadcasting it, for reason.
+func (a *deliveryAck) drop(reason dropReason) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	a.dropped = string(reason)
+	a.mu.Unlock()
+	a.resolve(false)
+}
+
+// accept acks a delivery the relay chose not to broadcast, such as a muted
+// topic or a repeat, so it isn't redelivered or dead-lettered.
+func (a *deliveryAck) accept() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.settled {
+		a.settled = true
+		if a.manual {
+			_ = a.msg.Ack(false)
+			forgetRequeues(a.msg)
+		}
+	}
+}
+
+// fail hands an undelivered delivery to the dead-letter publisher, which
+// settles it, or nacks it. Must be called with a.mu held.
+func (a *deliveryAck) fail() {
+	if a.deadLetter && queueDeadLetter(a) {
+		return
+	}
+	if a.manual {
+		a.nack()
+	}
+}
+
+// failure says why a settled delivery wasn't delivered.
+// Must be called with a.mu held, or once a is settled.
+func (a *deliveryAck) failure() string {
+	switch {
+	case a.exhausted:
+		return "max_redeliveries"
+	case a.dropped != "":
+		return a.dropped
+	case a.queued == 0:
+		return "no_clients"
+	}
+	return "not_written"
+}
+
+// nack returns the delivery to RabbitMQ: requeued after requeue_delay, or
+// rejected so the queue's dead-letter exchange, if any, receives it. One
+// already redelivered rabbitmq.ack.max_redeliveries times goes to the relay's
+// dead-letter exchange instead, or is rejected without dead_letter.
+// Must be called with a.mu held.
+func (a *deliveryAck) nack() {
+	fields := logrus.Fields{
+		"event":   "delivery_ack",
+		"status":  "nacked",
+		"topic":   a.msg.RoutingKey,
+		"written": a.written,
+		"needed":  a.need,
+	}
+	limit := conf().GetInt("rabbitmq.ack.max_redeliveries")
+	if n := redeliveries(a.msg); a.exhausted || (limit > 0 && n >= limit) {
+		fields["requeue"] = false
+		fields["redeliveries"] = n
+		forgetRequeues(a.msg)
+		if !a.exhausted {
+			a.exhausted = true
+			if a.deadLetter && queueDeadLetter(a) {
+				log.WithFields(fields).Warn("Delivery redelivered too often, dead-lettering")
+				return
+			}
+		}
+		log.WithFields(fields).Warn("Delivery redelivered too often, rejecting")
+		_ = a.msg.Nack(false, false)
+		return
+	}
+	if conf().GetString("rabbitmq.ack.on_failure") == ackFailureReject {
+		fields["requeue"] = false
+		log.WithFields(fields).Warn("Delivery not written to enough clients, rejecting")
+		forgetRequeues(a.msg)
+		_ = a.msg.Nack(false, false)
+		return
+	}
+	fields["requeue"] = true
+	log.WithFields(fields).Debug("Delivery not written to enough clients, requeueing")
+	msg := a.msg
+	noteRequeue(msg)
+	time.AfterFunc(conf().GetDuration("rabbitmq.ack.requeue_delay"), func() { _ = msg.Nack(false, true) })
+}
@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func registerAdminRoutes() {
+	handle(endpointsAdmin, "GET /admin/clients", requireAdmin(handleAdminClients))
+	handle(endpointsAdmin, "DELETE /admin/clients/{client}", requireAdmin(handleAdminKick))
+	handle(endpointsAdmin, "POST /admin/pause", requireAdmin(handlePause))
+	handle(endpointsAdmin, "POST /admin/resume", requireAdmin(handleResume))
+	handle(endpointsAdmin, "GET /admin/annotations", requireAdmin(handleListAnnotations))
+	handle(endpointsAdmin, "POST /admin/annotations", requireAdmin(handleCreateAnnotation))
+	handle(endpointsAdmin, "DELETE /admin/annotations/{id}", requireAdmin(handleDeleteAnnotation))
+	handle(endpointsAdmin, "GET /admin/usage", requireAdmin(handleUsage))
+	handle(endpointsAdmin, "GET /admin/bulkheads", requireAdmin(handleBulkheads))
+	handle(endpointsAdmin, "GET /admin/disconnects", requireAdmin(handleDisconnects))
+	handle(endpointsAdmin, "GET /admin/reconnects", requireAdmin(handleReconnects))
+	handle(endpointsAdmin, "GET /admin/retries", requireAdmin(handleRetries))
+	handle(endpointsAdmin, "GET /admin/mutes", requireAdmin(handleMutes))
+	handle(endpointsAdmin, "GET /admin/drops", requireAdmin(handleDrops))
+	handle(endpointsAdmin, "GET /admin/runtime", requireAdmin(handleRuntime))
+	handle(endpointsAdmin, "GET /admin/goroutines", requireAdmin(handleGoroutines))
+	handle(endpointsAdmin, "GET /admin/compression", requireAdmin(handleCompression))
+	handle(endpointsAdmin, "POST /admin/dump", requireAdmin(handleDump))
+	handle(endpointsAdmin, "POST /admin/promote", requireAdmin(handlePromote))
+
+	log.WithFields(logrus.Fields{
+		"event":  "admin_api",
+		"status": "enabled",
+	}).Info("Admin API enabled")
+}
+
+// requireAdmin lets through requests bearing admin.token. A token blanked by
+// a reload locks the routes rather than matching an empty bearer token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		want := conf().GetString("admin.token")
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+			writeError(w, http.StatusUnauthorized, "invalid admin token")
+			return
+		}
+		if authorizeAdmin(w, r, "admin", "") {
+			next(w, r)
+		}
+	}
+}
+
+func handleAdminClients(w http.ResponseWriter, _ *http.Request) {
+	clientsMu.Lock()
+	views := make([]ClientInfo, 0, len(clients))
+	for c := range clients {
+		views = append(views, c.view())
+	}
+	clientsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleAdminKick disconnects every client whose client ID or remote address
+// is {client}.
+func handleAdminKick(w http.ResponseWriter, r *http.Request) {
+	target := r.PathValue("client")
+	clientsMu.Lock()
+	kicked := 0
+	for c := range clients {
+		if c.id == target || c.remoteAddr == target {
+			closeClient(c, reasonKicked, "disconnected by admin")
+			delete(clients, c)
+			kicked++
+		}
+	}
+	clientsMu.Unlock()
+
+	if kicked == 0 {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":   "admin_kick",
+		"status":  "kicked",
+		"client":  target,
+		"clients": kicked,
+	}).Info("Admin disconnected clients")
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": kicked})
+}
+
+// handlePause stops sources taking new deliveries, so nothing more is
+// broadcast and the backlog waits in the broker. Clients stay connected,
+// frames already queued are still written, and synthetic topics keep ticking
+// so dashboards can tell a pause from an outage.
+func handlePause(w http.ResponseWriter, _ *http.Request) {
+	if pauseBroadcasting() {
+		log.WithFields(logrus.Fields{
+			"event":  "admin_pause",
+			"status": "paused",
+		}).Warn("Broadcasting paused by admin")
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"paused": true, "since": pausedSince()})
+}
+
+func handleResume(w http.ResponseWriter, _ *http.Request) {
+	since := pausedSince()
+	if resumeBroadcasting() {
+		log.WithFields(logrus.Fields{
+			"event":        "admin_pause",
+			"status":       "resumed",
+			"paused_for_s": time.Since(since).Seconds(),
+		}).Info("Broadcasting resumed by admin")
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func adminStatus(handler http.HandlerFunc, authorization string) int {
+	r := httptest.NewRequest(http.MethodGet, "/admin/clients", http.NoBody)
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w.Code
+}
+
+func TestRequireAdminRejectsEmptyToken(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) }
+	tests := []struct {
+		config, authorization string
+		status                int
+	}{
+		{"admin:\n  token: secret\n", "Bearer secret", http.StatusOK},
+		{"admin:\n  token: secret\n", "Bearer wrong", http.StatusUnauthorized},
+		{"admin:\n  token: secret\n", "", http.StatusUnauthorized},
+		{"admin:\n  token: \"\"\n", "Bearer ", http.StatusUnauthorized},
+		{"log:\n  level: info\n", "Bearer ", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		useConfig(t, tt.config)
+		if got := adminStatus(requireAdmin(ok), tt.authorization); got != tt.status {
+			t.Errorf("%q with %q: status %d, want %d", tt.config, tt.authorization, got, tt.status)
+		}
+	}
+}
+
+func TestRequireTenantAdminRejectsEmptyToken(t *testing.T) {
+	previous := tenantAdminTokens
+	tenantAdminTokens = []tenantAdminToken{{Tenant: "acme", Token: ""}, {Tenant: "globex", Token: "globex-secret"}}
+	t.Cleanup(func() { tenantAdminTokens = previous })
+
+	var got string
+	handler := requireTenantAdmin(func(w http.ResponseWriter, _ *http.Request, tenant string) {
+		got = tenant
+		w.WriteHeader(http.StatusOK)
+	})
+	tests := []struct {
+		authorization string
+		status        int
+		tenant        string
+	}{
+		{"Bearer globex-secret", http.StatusOK, "globex"},
+		{"Bearer ", http.StatusUnauthorized, ""},
+		{"", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		got = ""
+		if status := adminStatus(handler, tt.authorization); status != tt.status || got != tt.tenant {
+			t.Errorf("%q: status %d as tenant %q, want %d as %q", tt.authorization, status, got, tt.status, tt.tenant)
+		}
+	}
+}
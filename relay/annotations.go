@@ -0,0 +1,235 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxAnnotationBody = 16 << 10
+
+	annotationSet     = "annotation"
+	annotationCleared = "annotation_cleared"
+)
+
+var annotationLevels = []string{"info", "warning", "critical"}
+
+// annotation is an operator note on a topic, such as degraded data quality
+// until a fix lands, that clients of the topic get as a control message so
+// UIs can show a banner. Annotations live in memory on the instance they were
+// set on until they expire or are deleted.
+type annotation struct {
+	ID        string    `json:"id"`
+	Topic     string    `json:"topic"`
+	Message   string    `json:"message"`
+	Level     string    `json:"level"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+
+	expiry *time.Timer
+}
+
+// createAnnotationRequest sets an annotation until Until, or for TTL from
+// now, or for annotations.default_ttl.
+type createAnnotationRequest struct {
+	Topic   string    `json:"topic"`
+	Message string    `json:"message"`
+	Level   string    `json:"level"`
+	TTL     string    `json:"ttl"`
+	Until   time.Time `json:"until"`
+}
+
+// annotationFrame is the control message for an annotation: type
+// "annotation" when it is set, or "annotation_cleared" with reason "deleted"
+// or "expired".
+type annotationFrame struct {
+	Type string `json:"type"`
+	annotation
+	Reason     string    `json:"reason,omitempty"`
+	ServerTime time.Time `json:"server_time"`
+}
+
+var (
+	// annotations are keyed by ID. Lock clientsMu first when holding both.
+	annotations   = make(map[string]*annotation)
+	annotationsMu sync.Mutex
+)
+
+func (req createAnnotationRequest) annotation() (*annotation, error) {
+	if req.Topic == "" || strings.ContainsAny(req.Topic, "*#") {
+		return nil, errors.New("an annotation needs a topic, without wildcards")
+	}
+	if req.Message == "" {
+		return nil, errors.New("an annotation needs a message")
+	}
+	if req.Level == "" {
+		req.Level = annotationLevels[0]
+	}
+	if !slices.Contains(annotationLevels, req.Level) {
+		return nil, fmt.Errorf("unknown level %q, want one of %v", req.Level, annotationLevels)
+	}
+
+	now := time.Now().UTC()
+	expires := req.Until.UTC()
+	if req.Until.IsZero() {
+		ttl := conf().GetDuration("annotations.default_ttl")
+		if req.TTL == "" && ttl <= 0 {
+			return nil, errors.New("an annotation needs a ttl or until")
+		}
+		if req.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(req.TTL); err != nil {
+				return nil, fmt.Errorf("invalid ttl %q", req.TTL)
+			}
+		}
+		expires = now.Add(ttl)
+	}
+	if !expires.After(now) {
+		return nil, errors.New("the annotation would already have expired")
+	}
+	return &annotation{
+		ID:        newID(),
+		Topic:     req.Topic,
+		Message:   req.Message,
+		Level:     req.Level,
+		CreatedAt: now,
+		ExpiresAt: expires,
+	}, nil
+}
+
+func handleCreateAnnotation(w http.ResponseWriter, r *http.Request) {
+	var req createAnnotationRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAnnotationBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	a, err := req.annotation()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	clientsMu.Lock()
+	annotationsMu.Lock()
+	annotations[a.ID] = a
+	a.expiry = time.AfterFunc(time.Until(a.ExpiresAt), func() { clearAnnotation(a.ID, "expired") })
+	view := *a
+	annotationsMu.Unlock()
+	notified := announceAnnotation(annotationFrame{Type: annotationSet, annotation: view})
+	clientsMu.Unlock()
+
+	log.WithFields(logrus.Fields{
+		"event":      "annotation",
+		"status":     "created",
+		"annotation": a.ID,
+		"topic":      a.Topic,
+		"severity":   a.Level,
+		"expires_at": a.ExpiresAt,
+		"clients":    notified,
+	}).Info("Topic annotation set")
+	writeJSON(w, http.StatusCreated, view)
+}
+
+func handleListAnnotations(w http.ResponseWriter, _ *http.Request) {
+	annotationsMu.Lock()
+	views := make([]annotation, 0, len(annotations))
+	for _, a := range annotations {
+		views = append(views, *a)
+	}
+	annotationsMu.Unlock()
+
+	slices.SortFunc(views, func(a, b annotation) int { return a.CreatedAt.Compare(b.CreatedAt) })
+	writeJSON(w, http.StatusOK, views)
+}
+
+func handleDeleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	if !clearAnnotation(r.PathValue("id"), "deleted") {
+		writeError(w, http.StatusNotFound, "annotation not found")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// clearAnnotation removes an annotation and tells its clients, reporting
+// whether it was still set.
+func clearAnnotation(id, reason string) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	annotationsMu.Lock()
+	a, ok := annotations[id]
+	if ok {
+		a.expiry.Stop()
+		delete(annotations, id)
+	}
+	annotationsMu.Unlock()
+	if !ok {
+		return false
+	}
+
+	notified := announceAnnotation(annotationFrame{Type: annotationCleared, annotation: *a, Reason: reason})
+	log.WithFields(logrus.Fields{
+		"event":      "annotation",
+		"status":     reason,
+		"annotation": id,
+		"topic":      a.Topic,
+		"clients":    notified,
+	}).Info("Topic annotation cleared")
+	return true
+}
+
+// announceAnnotation queues f for every client of its topic and returns how
+// many. Must be called with clientsMu held.
+func announceAnnotation(f annotationFrame) int {
+	n := 0
+	for c := range clients {
+		if c.annotated(f.Topic) && c.sendAnnotation(f) {
+			n++
+		}
+	}
+	return n
+}
+
+// annotated reports whether annotations on topic concern c.
+// Must be called with clientsMu held.
+func (c *client) annotated(topic string) bool {
+	return tenantAllows(c.tenant, topic) && c.subscribed(topic)
+}
+
+// sendAnnotations queues the annotations on topics c gets, for a newly
+// registered client. Must be called with clientsMu held.
+func sendAnnotations(c *client) {
+	sendAnnotationsMatching(c, c.annotated)
+}
+
+// sendAnnotationsFor queues the annotations on topics matching newly
+// subscribed patterns. Must be called with clientsMu held.
+func sendAnnotationsFor(c *client, patterns []string) {
+	sendAnnotationsMatching(c, func(topic string) bool {
+		return tenantAllows(c.tenant, topic) && matchesAny(patterns, topic)
+	})
+}
+
+func sendAnnotationsMatching(c *client, match func(topic string) bool) {
+	annotationsMu.Lock()
+	defer annotationsMu.Unlock()
+	for _, a := range annotations {
+		if match(a.Topic) && !c.sendAnnotation(annotationFrame{Type: annotationSet, annotation: *a}) {
+			return
+		}
+	}
+}
+
+// sendAnnotation queues f for c. Must be called with clientsMu held.
+func (c *client) sendAnnotation(f annotationFrame) bool {
+	f.ServerTime = time.Now().UTC()
+	frame, _ := json.Marshal(f)
+	return c.enqueue(queuedFrame{topic: f.Topic, out: outbound{frame: frame}, control: true}, true)
+}
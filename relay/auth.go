@@ -0,0 +1,238 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Identity is who an upgrade request authenticated as. Tenant, when set by the
+// provider, must agree with the tenant resolved from the request. Profiles
+// restricts which subscription profiles the identity may use; the first is
+// its default. A client is disconnected at ExpiresAt, when its credentials
+// expire; zero means they don't.
+type Identity struct {
+	Subject   string
+	Tenant    string
+	Profiles  []string
+	Claims    map[string]any
+	ExpiresAt time.Time
+}
+
+// Authenticator validates a WebSocket upgrade request before it is accepted.
+type Authenticator interface {
+	ValidateUpgrade(r *http.Request) (Identity, error)
+}
+
+// AuthenticatorFactory builds a provider from its auth.<name> config section.
+type AuthenticatorFactory func() (Authenticator, error)
+
+var (
+	authenticators = make(map[string]AuthenticatorFactory)
+	authenticator  Authenticator
+
+	errUnauthenticated = errors.New("missing or invalid credentials")
+)
+
+// RegisterAuthenticator makes a provider selectable through auth.provider.
+// Bespoke providers (signed cookies, internal SSO) register themselves from an
+// init function, in this package or the embedding program, before New.
+// Registering a name twice panics.
+func RegisterAuthenticator(name string, factory AuthenticatorFactory) {
+	if _, dup := authenticators[name]; dup {
+		panic("authenticator registered twice: " + name)
+	}
+	authenticators[name] = factory
+}
+
+func init() {
+	RegisterAuthenticator("none", func() (Authenticator, error) { return noAuth{}, nil })
+	RegisterAuthenticator("api_key", newAPIKeyAuth)
+	RegisterAuthenticator("mtls", newMTLSAuth)
+}
+
+func initAuthenticator() {
+	name := conf().GetString("auth.provider")
+	if name == "" {
+		name = "none"
+	}
+	factory, ok := authenticators[name]
+	var err error
+	if !ok {
+		err = fmt.Errorf("unknown provider %q, registered: %v", name, registeredAuthenticators())
+	} else {
+		authenticator, err = factory()
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":    "auth_config",
+			"status":   "failed",
+			"provider": name,
+			"error":    err.Error(),
+		}).Fatal("Failed to configure authentication")
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":    "auth_config",
+		"status":   "loaded",
+		"provider": name,
+	}).Info("Authentication provider configured")
+}
+
+func registeredAuthenticators() []string {
+	names := make([]string, 0, len(authenticators))
+	for name := range authenticators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type noAuth struct{}
+
+func (noAuth) ValidateUpgrade(*http.Request) (Identity, error) {
+	return Identity{}, nil
+}
+
+type apiKeyCredential struct {
+	Key      string   `mapstructure:"key"`
+	Subject  string   `mapstructure:"subject"`
+	Tenant   string   `mapstructure:"tenant"`
+	Profiles []string `mapstructure:"profiles"`
+}
+
+// apiKeyAuth accepts a static key from a header or the api_key query parameter.
+type apiKeyAuth struct {
+	header string
+	keys   []apiKeyCredential
+}
+
+func newAPIKeyAuth() (Authenticator, error) {
+	a := &apiKeyAuth{header: conf().GetString("auth.api_key.header")}
+	if a.header == "" {
+		a.header = apiKeyHeader
+	}
+	if err := unmarshalConfig("auth.api_key.keys", &a.keys); err != nil {
+		return nil, err
+	}
+	if len(a.keys) == 0 {
+		return nil, errors.New("auth.api_key.keys is empty")
+	}
+	return a, nil
+}
+
+func (a *apiKeyAuth) ValidateUpgrade(r *http.Request) (Identity, error) {
+	key := r.Header.Get(a.header)
+	if key == "" {
+		key = r.URL.Query().Get("api_key")
+	}
+	if key == "" {
+		return Identity{}, errUnauthenticated
+	}
+	for _, k := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return Identity{Subject: k.Subject, Tenant: k.Tenant, Profiles: k.Profiles}, nil
+		}
+	}
+	return Identity{}, errUnauthenticated
+}
+
+// mtlsAuth trusts the client certificate verified by the TLS listener and
+// takes the subject from its common name.
+type mtlsAuth struct {
+	allowed []string
+}
+
+func newMTLSAuth() (Authenticator, error) {
+	return &mtlsAuth{allowed: conf().GetStringSlice("auth.mtls.allowed_subjects")}, nil
+}
+
+func (a *mtlsAuth) ValidateUpgrade(r *http.Request) (Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Identity{}, errUnauthenticated
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if len(a.allowed) > 0 && !slices.Contains(a.allowed, subject) {
+		return Identity{}, fmt.Errorf("certificate subject %q is not allowed", subject)
+	}
+	return Identity{Subject: subject}, nil
+}
+
+// authenticateUpgrade runs the configured provider and checks the identity
+// against the resolved tenant. On failure it responds and returns false.
+func authenticateUpgrade(w http.ResponseWriter, r *http.Request, tenant string) (Identity, bool) {
+	identity, err := authenticator.ValidateUpgrade(r)
+	if err == nil && identity.Tenant != "" && tenant != "" && identity.Tenant != tenant {
+		err = fmt.Errorf("identity belongs to tenant %q", identity.Tenant)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "websocket_auth",
+			"status": "rejected",
+			"client": r.RemoteAddr,
+			"error":  err.Error(),
+		}).Warn("Rejected unauthenticated connection")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return Identity{}, false
+	}
+	return identity, true
+}
+
+// authenticateRequest authenticates an API request with the credentials and
+// tenant a client would connect with. It returns the caller as an unregistered
+// client, for tenant and policy checks. On failure it responds and returns
+// false.
+func authenticateRequest(w http.ResponseWriter, r *http.Request) (*client, bool) {
+	tenant, ok := resolveTenant(r)
+	if !ok {
+		writeError(w, http.StatusForbidden, "unknown tenant")
+		return nil, false
+	}
+	identity, ok := authenticateUpgrade(w, r, tenant)
+	if !ok {
+		return nil, false
+	}
+	if tenant == "" {
+		tenant = identity.Tenant
+	}
+	return &client{tenant: tenant, subject: identity.Subject, claims: identity.Claims, remoteAddr: r.RemoteAddr}, true
+}
+
+// expireAuth starts closing c when its credentials expire. Must be called
+// with clientsMu held, once c is registered.
+func (c *client) expireAuth() {
+	if c.expiresAt.IsZero() {
+		return
+	}
+	c.expiry = time.AfterFunc(time.Until(c.expiresAt), func() {
+		clientsMu.Lock()
+		defer clientsMu.Unlock()
+		if _, ok := clients[c]; !ok {
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"event":      "client_auth",
+			"status":     "expired",
+			"client":     c.remoteAddr,
+			"client_id":  c.id,
+			"subject":    c.subject,
+			"expires_at": c.expiresAt,
+		}).Info("Disconnecting client whose credentials expired")
+		closeClient(c, reasonAuthExpired, "credentials expired")
+		delete(clients, c)
+	})
+}
+
+// stopAuthExpiry stops closing c on expiry once it disconnected. Must be
+// called with clientsMu held.
+func (c *client) stopAuthExpiry() {
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
+}
@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+// registerSSEClient registers a bare SSE client that expires at expiresAt.
+func registerSSEClient(t *testing.T, expiresAt time.Time) *client {
+	t.Helper()
+	c := &client{sse: &sseStream{done: make(chan struct{})}, expiresAt: expiresAt}
+	clientsMu.Lock()
+	clients[c] = struct{}{}
+	c.expireAuth()
+	clientsMu.Unlock()
+	t.Cleanup(func() {
+		clientsMu.Lock()
+		delete(clients, c)
+		c.stopAuthExpiry()
+		clientsMu.Unlock()
+	})
+	return c
+}
+
+func TestExpireAuthClosesClient(t *testing.T) {
+	c := registerSSEClient(t, time.Now().Add(20*time.Millisecond))
+
+	select {
+	case <-c.sse.done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("client wasn't closed when its credentials expired")
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if _, ok := clients[c]; ok {
+		t.Error("expired client is still registered")
+	}
+	if c.stats.closeReason != reasonAuthExpired {
+		t.Errorf("close reason = %q, want %q", c.stats.closeReason, reasonAuthExpired)
+	}
+}
+
+func TestStopAuthExpiryKeepsClient(t *testing.T) {
+	c := registerSSEClient(t, time.Now().Add(20*time.Millisecond))
+	clientsMu.Lock()
+	c.stopAuthExpiry()
+	clientsMu.Unlock()
+
+	select {
+	case <-c.sse.done:
+		t.Fatal("client closed after its expiry was stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestExpireAuthWithoutExpiry(t *testing.T) {
+	c := registerSSEClient(t, time.Time{})
+	if c.expiry != nil {
+		t.Error("started an expiry timer for credentials that don't expire")
+	}
+}
@@ -0,0 +1,267 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/open-policy-agent/opa/v1/bundle"
+	"github.com/open-policy-agent/opa/v1/rego"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	authzEngineOPA = "opa"
+
+	authzConnect   = "connect"
+	authzSubscribe = "subscribe"
+	authzPublish   = "publish"
+	authzAdmin     = "admin"
+)
+
+var errPolicyDenied = errors.New("not allowed by policy")
+
+// authzInput is the document a policy decides on as input. Topic is the
+// pattern or topic for subscribe and publish, Method and Path the request for
+// admin.
+type authzInput struct {
+	Action   string        `json:"action"`
+	Topic    string        `json:"topic,omitempty"`
+	Method   string        `json:"method,omitempty"`
+	Path     string        `json:"path,omitempty"`
+	Identity authzIdentity `json:"identity"`
+	Client   *authzClient  `json:"client,omitempty"`
+}
+
+type authzIdentity struct {
+	Subject string         `json:"subject"`
+	Tenant  string         `json:"tenant"`
+	Claims  map[string]any `json:"claims,omitempty"`
+}
+
+type authzClient struct {
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remote_addr"`
+}
+
+// opaPolicy evaluates authz.opa.query against Rego from authz.opa.files and
+// the bundle at authz.opa.bundle_url. The prepared query is swapped whole
+// when the bundle is refetched.
+type opaPolicy struct {
+	mu    sync.RWMutex
+	query rego.PreparedEvalQuery
+}
+
+// policy is nil unless authz.engine is opa, and every action is then allowed.
+var policy *opaPolicy
+
+// initAuthz loads the policy, exiting if it doesn't compile or its bundle
+// can't be fetched. A bundle is then refetched every authz.opa.bundle_refresh,
+// keeping the last good policy when that fails.
+func initAuthz() {
+	engine := conf().GetString("authz.engine")
+	if engine == "" || engine == "none" {
+		return
+	}
+	var err error
+	if engine != authzEngineOPA {
+		err = fmt.Errorf("unknown authz engine %q", engine)
+	} else {
+		policy = &opaPolicy{}
+		err = policy.load(context.Background())
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "authz_config",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Fatal("Failed to load authorization policy")
+	}
+
+	refresh := conf().GetDuration("authz.opa.bundle_refresh")
+	if refresh > 0 && conf().GetString("authz.opa.bundle_url") != "" {
+		go policy.refresh(refresh)
+	}
+	log.WithFields(logrus.Fields{
+		"event":  "authz_config",
+		"status": "loaded",
+		"engine": engine,
+		"query":  conf().GetString("authz.opa.query"),
+	}).Info("Authorization policy loaded")
+}
+
+func (p *opaPolicy) load(ctx context.Context) error {
+	opts := []func(*rego.Rego){rego.Query(conf().GetString("authz.opa.query"))}
+	files := conf().GetStringSlice("authz.opa.files")
+	if len(files) > 0 {
+		opts = append(opts, rego.Load(files, nil))
+	}
+	if url := conf().GetString("authz.opa.bundle_url"); url != "" {
+		b, err := fetchBundle(ctx, url)
+		if err != nil {
+			return fmt.Errorf("bundle %s: %w", url, err)
+		}
+		opts = append(opts, rego.ParsedBundle("bundle", b))
+	}
+	if len(opts) == 1 {
+		return errors.New("authz.opa needs files or a bundle_url")
+	}
+
+	query, err := rego.New(opts...).PrepareForEval(ctx)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.query = query
+	p.mu.Unlock()
+	return nil
+}
+
+func fetchBundle(ctx context.Context, url string) (*bundle.Bundle, error) {
+	ctx, cancel := context.WithTimeout(ctx, conf().GetDuration("authz.opa.timeout"))
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bundle server returned %s", resp.Status)
+	}
+	b, err := bundle.NewReader(resp.Body).Read()
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (p *opaPolicy) refresh(every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.load(context.Background()); err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "authz_bundle",
+				"status": "failed",
+				"url":    conf().GetString("authz.opa.bundle_url"),
+				"error":  err.Error(),
+			}).Error("Failed to refresh policy bundle, keeping the previous one")
+		}
+	}
+}
+
+// authorize asks the policy whether in is allowed. An undefined or non-true
+// decision denies, and so does a failed evaluation.
+func authorize(ctx context.Context, in authzInput) error {
+	if policy == nil {
+		return nil
+	}
+	policy.mu.RLock()
+	query := policy.query
+	policy.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, conf().GetDuration("authz.opa.timeout"))
+	defer cancel()
+	results, err := query.Eval(ctx, rego.EvalInput(in))
+	status := "allowed"
+	switch {
+	case err != nil:
+		status = "failed"
+		log.WithFields(logrus.Fields{
+			"event":  "authz",
+			"status": status,
+			"action": in.Action,
+			"error":  err.Error(),
+		}).Error("Policy evaluation failed, denying")
+	case !results.Allowed():
+		status = "denied"
+	}
+	authzDecisions.WithLabelValues(in.Action, status).Inc()
+	if status != "allowed" {
+		return errPolicyDenied
+	}
+	return nil
+}
+
+// authzFor is the policy input for an action by c. c's identity never
+// changes after the upgrade, so clientsMu need not be held.
+func (c *client) authzFor(action, topic string) authzInput {
+	return authzInput{
+		Action:   action,
+		Topic:    topic,
+		Identity: authzIdentity{Subject: c.subject, Tenant: c.tenant, Claims: c.claims},
+		Client:   &authzClient{ID: c.id, RemoteAddr: c.remoteAddr},
+	}
+}
+
+// authorizeClient checks that c may connect and subscribe to the topics it
+// connects with, from ?topics= or its profile. With none yet and every topic
+// by default, it checks "#" instead; without that the client gets nothing
+// until it subscribes to topics it is allowed. On denial it responds and
+// returns false.
+func authorizeClient(w http.ResponseWriter, r *http.Request, c *client) bool {
+	if err := authorize(r.Context(), c.authzFor(authzConnect, "")); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":   "websocket_authz",
+			"status":  "rejected",
+			"client":  r.RemoteAddr,
+			"subject": c.subject,
+		}).Warn("Rejected connection denied by policy")
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	if c.subscriptions != nil {
+		if err := c.authorizeTopics(r.Context(), c.subscriptions); err != nil {
+			log.WithFields(logrus.Fields{
+				"event":   "websocket_authz",
+				"status":  "rejected",
+				"client":  r.RemoteAddr,
+				"subject": c.subject,
+				"profile": c.profile,
+				"error":   err.Error(),
+			}).Warn("Rejected connection subscribing to topics denied by policy")
+			http.Error(w, "forbidden: "+err.Error(), http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if conf().GetString("subscriptions.default") != "none" &&
+		authorize(r.Context(), c.authzFor(authzSubscribe, "#")) != nil {
+		c.subscriptions = []string{}
+	}
+	return true
+}
+
+// authorizeTopics checks each pattern of a subscribe request from c.
+func (c *client) authorizeTopics(ctx context.Context, topics []string) error {
+	for _, topic := range topics {
+		if err := authorize(ctx, c.authzFor(authzSubscribe, topic)); err != nil {
+			return fmt.Errorf("subscribing to %q is %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// authorizeAdmin checks an admin request made with subject's credentials
+// ("admin", or "tenant-admin" scoped to tenant). On denial it responds and
+// returns false.
+func authorizeAdmin(w http.ResponseWriter, r *http.Request, subject, tenant string) bool {
+	err := authorize(r.Context(), authzInput{
+		Action:   authzAdmin,
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Identity: authzIdentity{Subject: subject, Tenant: tenant},
+	})
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return false
+	}
+	return true
+}
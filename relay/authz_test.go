@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// usePolicy makes rego the authorization policy, under package event_relay.
+func usePolicy(t *testing.T, rego string) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "policy.rego")
+	if err := os.WriteFile(file, []byte("package event_relay\n\n"+rego), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	useConfig(t, `authz:
+  engine: opa
+  opa:
+    query: data.event_relay.allow
+    files: [`+file+`]
+    timeout: 1s
+`)
+	policy = &opaPolicy{}
+	if err := policy.load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { policy = nil })
+}
+
+const weatherOnlyPolicy = `
+allow if input.action == "connect"
+
+allow if {
+	input.action == "subscribe"
+	startswith(input.topic, "weather.")
+}
+`
+
+func TestAuthorizeClientChecksConnectTopics(t *testing.T) {
+	usePolicy(t, weatherOnlyPolicy)
+
+	tests := []struct {
+		name   string
+		topics []string
+		want   []string
+		status int
+	}{
+		{"allowed topics", []string{"weather.#"}, []string{"weather.#"}, http.StatusOK},
+		{"denied topic", []string{"weather.#", "billing.#"}, nil, http.StatusForbidden},
+		{"no topics and \"#\" denied", nil, []string{}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		c := &client{subject: "alice", subscriptions: tt.topics}
+		w := httptest.NewRecorder()
+		ok := authorizeClient(w, httptest.NewRequest(http.MethodGet, "/events", http.NoBody), c)
+		if w.Code != tt.status || ok != (tt.status == http.StatusOK) {
+			t.Errorf("%s: authorizeClient() = %v with status %d, want %d", tt.name, ok, w.Code, tt.status)
+		}
+		if ok && len(c.subscriptions) != len(tt.want) {
+			t.Errorf("%s: subscriptions = %q, want %q", tt.name, c.subscriptions, tt.want)
+		}
+	}
+}
+
+func TestSSETopics(t *testing.T) {
+	useConfig(t, "subscriptions:\n  max_topics: 2\n")
+
+	tests := []struct {
+		query string
+		n     int
+		ok    bool
+	}{
+		{"", 0, true},
+		{"?topics=a.b,c.*", 2, true},
+		{"?topics=a..b", 0, false},
+		{"?topics=a,,b", 0, false},
+		{"?topics=a,b,c", 0, false},
+	}
+	for _, tt := range tests {
+		topics, err := sseTopics(httptest.NewRequest(http.MethodGet, "/events"+tt.query, http.NoBody))
+		if (err == nil) != tt.ok || (tt.ok && len(topics) != tt.n) {
+			t.Errorf("sseTopics(%q) = %q, %v", tt.query, topics, err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// BackplaneHealth names the backplane subscription in /readyz.
+const BackplaneHealth = "backplane"
+
+// Backplane carries deliveries between relay instances, so a client connected
+// to one replica gets messages consumed by any of them.
+type Backplane interface {
+	// Publish sends one encoded message to every instance, this one included.
+	Publish(ctx context.Context, data []byte) error
+	// Subscribe hands each message on the backplane to receive until ctx is
+	// done, marking BackplaneHealth ready with MarkSourceReady once
+	// subscribed.
+	Subscribe(ctx context.Context, receive func(data []byte)) error
+	Close() error
+}
+
+// BackplaneFactory builds a backplane from its config section.
+type BackplaneFactory func() (Backplane, error)
+
+var backplaneTypes = make(map[string]BackplaneFactory)
+
+// RegisterBackplane makes a backplane selectable through backplane.type. Call
+// it before New, from an init function; registering a name twice panics.
+func RegisterBackplane(name string, factory BackplaneFactory) {
+	if _, dup := backplaneTypes[name]; dup {
+		panic("backplane registered twice: " + name)
+	}
+	backplaneTypes[name] = factory
+}
+
+// backplaneMessage is a delivery as another instance consumed it, after topic
+// inference and before any per-instance processing.
+type backplaneMessage struct {
+	Instance      string     `json:"instance"`
+	Source        string     `json:"source"`
+	Topic         string     `json:"topic"`
+	MessageID     string     `json:"message_id,omitempty"`
+	AppID         string     `json:"app_id,omitempty"`
+	CorrelationID string     `json:"correlation_id,omitempty"`
+	ContentType   string     `json:"content_type,omitempty"`
+	Timestamp     time.Time  `json:"timestamp"`
+	Headers       amqp.Table `json:"headers,omitempty"`
+	Body          []byte     `json:"body"`
+}
+
+var (
+	// backplaneQueue holds encoded messages waiting for the publisher, nil
+	// when backplane.type is none.
+	backplaneQueue chan backplaneMessage
+
+	// backplaneFailureLog keeps an outage from logging on every message.
+	backplaneFailureLog = newTokenBucket(1.0/60, 1)
+)
+
+// startBackplane connects to backplane.type and starts publishing local
+// deliveries and relaying everything from other instances. A standby
+// subscribes too, so its clients get messages while another instance
+// consumes. The returned func waits for both to stop after ctx is done.
+func startBackplane(ctx context.Context) func() {
+	name := conf().GetString("backplane.type")
+	if name == "" || name == "none" {
+		return func() {}
+	}
+	bp := newBackplane(name)
+	backplaneQueue = make(chan backplaneMessage, max(conf().GetInt("backplane.queue_size"), 1))
+	ExpectSource(BackplaneHealth)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		runBackplanePublisher(ctx, bp)
+	}()
+	go func() {
+		defer wg.Done()
+		policy := loadRetryPolicy("backplane.reconnect")
+		err := retry(ctx, "backplane", policy, func() error {
+			err := bp.Subscribe(ctx, receiveBackplane)
+			if err != nil && ctx.Err() == nil {
+				MarkSourceDown(BackplaneHealth, err.Error())
+				log.WithFields(logrus.Fields{
+					"event":     "backplane",
+					"status":    "failed",
+					"backplane": name,
+					"error":     err.Error(),
+				}).Error("Backplane subscription failed")
+				return err
+			}
+			return nil
+		})
+		if err != nil && ctx.Err() == nil {
+			log.WithFields(logrus.Fields{
+				"event":     "backplane",
+				"status":    "failed",
+				"backplane": name,
+				"error":     err.Error(),
+			}).Fatal("Giving up subscribing to the backplane")
+		}
+	}()
+
+	log.WithFields(logrus.Fields{
+		"event":     "backplane",
+		"status":    "enabled",
+		"backplane": name,
+	}).Info("Relaying deliveries between instances over the backplane")
+	return func() {
+		wg.Wait()
+		bp.Close()
+	}
+}
+
+func newBackplane(name string) Backplane {
+	factory, ok := backplaneTypes[name]
+	var bp Backplane
+	var err error
+	if !ok {
+		names := make([]string, 0, len(backplaneTypes))
+		for name := range backplaneTypes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		err = fmt.Errorf("unknown backplane %q, registered: %v", name, names)
+	} else {
+		bp, err = factory()
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":     "backplane_config",
+			"status":    "failed",
+			"backplane": name,
+			"error":     err.Error(),
+		}).Fatal("Failed to configure backplane")
+	}
+	return bp
+}
+
+// publishBackplane queues a locally consumed delivery for the other
+// instances without blocking the source; a full queue drops it. Synthetic
+// topics stay local, since every instance generates its own.
+func publishBackplane(source string, msg amqp.Delivery) {
+	if backplaneQueue == nil || source == "synthetic" {
+		return
+	}
+	m := backplaneMessage{
+		Instance:      relayInstanceID(),
+		Source:        source,
+		Topic:         msg.RoutingKey,
+		MessageID:     msg.MessageId,
+		AppID:         msg.AppId,
+		CorrelationID: msg.CorrelationId,
+		ContentType:   msg.ContentType,
+		Timestamp:     msg.Timestamp,
+		Headers:       msg.Headers,
+		Body:          msg.Body,
+	}
+	select {
+	case backplaneQueue <- m:
+	default:
+		backplaneMessages.WithLabelValues("out", "dropped").Inc()
+		recordDrop(dropQueueFull, msg.RoutingKey, logrus.Fields{"queue": "backplane"})
+	}
+}
+
+func runBackplanePublisher(ctx context.Context, bp Backplane) {
+	timeout := conf().GetDuration("backplane.timeout")
+	for {
+		var m backplaneMessage
+		select {
+		case <-ctx.Done():
+			return
+		case m = <-backplaneQueue:
+		}
+
+		data, err := json.Marshal(m)
+		if err == nil {
+			pubCtx, cancel := context.WithTimeout(ctx, timeout)
+			err = bp.Publish(pubCtx, data)
+			cancel()
+		}
+		if err == nil {
+			backplaneMessages.WithLabelValues("out", "published").Inc()
+			continue
+		}
+		backplaneMessages.WithLabelValues("out", "failed").Inc()
+		if backplaneFailureLog.Allow() {
+			log.WithFields(logrus.Fields{
+				"event":  "backplane",
+				"status": "publish_failed",
+				"topic":  m.Topic,
+				"error":  err.Error(),
+			}).Warn("Failed to publish to the backplane, other instances miss this message")
+		}
+	}
+}
+
+// receiveBackplane relays a message another instance consumed. Its own
+// messages, echoed back by the backplane, were relayed when consumed.
+func receiveBackplane(data []byte) {
+	var m backplaneMessage
+	if err := json.Unmarshal(data, &m); err != nil || m.Topic == "" {
+		backplaneMessages.WithLabelValues("in", "invalid").Inc()
+		return
+	}
+	if m.Instance == relayInstanceID() {
+		return
+	}
+	backplaneMessages.WithLabelValues("in", "received").Inc()
+	awaitCapacity()
+	dispatchLocal(m.Source, amqp.Delivery{
+		RoutingKey:    m.Topic,
+		MessageId:     m.MessageID,
+		AppId:         m.AppID,
+		CorrelationId: m.CorrelationID,
+		ContentType:   m.ContentType,
+		Timestamp:     m.Timestamp,
+		Headers:       m.Headers,
+		Body:          m.Body,
+	}, nil)
+}
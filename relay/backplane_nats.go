@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"context"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+func init() {
+	RegisterBackplane("nats", func() (Backplane, error) {
+		return &natsBackplane{
+			url:     conf().GetString("backplane.nats.url"),
+			subject: conf().GetString("backplane.channel"),
+		}, nil
+	})
+}
+
+// natsBackplane fans deliveries out over a core NATS subject. Like Redis
+// pub/sub it has no persistence, so messages published while an instance is
+// disconnected are lost to it.
+type natsBackplane struct {
+	url     string
+	subject string
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+// connect returns the connection, dialing it on first use. Once connected the
+// client reconnects by itself, and BackplaneHealth follows its state.
+func (b *natsBackplane) connect() (*nats.Conn, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		return b.conn, nil
+	}
+	conn, err := nats.Connect(b.url,
+		nats.Name(relayInstanceID()),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, _ error) {
+			MarkSourceDown(BackplaneHealth, "connection lost")
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			MarkSourceReady(BackplaneHealth)
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	b.conn = conn
+	return conn, nil
+}
+
+func (b *natsBackplane) Publish(_ context.Context, data []byte) error {
+	conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	return conn.Publish(b.subject, data)
+}
+
+func (b *natsBackplane) Subscribe(ctx context.Context, receive func(data []byte)) error {
+	conn, err := b.connect()
+	if err != nil {
+		return err
+	}
+	sub, err := conn.Subscribe(b.subject, func(m *nats.Msg) { receive(m.Data) })
+	if err != nil {
+		return err
+	}
+	MarkSourceReady(BackplaneHealth)
+	<-ctx.Done()
+	return sub.Unsubscribe()
+}
+
+func (b *natsBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.conn != nil {
+		b.conn.Close()
+	}
+	return nil
+}
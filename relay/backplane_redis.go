@@ -0,0 +1,48 @@
+package relay
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func init() {
+	RegisterBackplane("redis", func() (Backplane, error) {
+		return &redisBackplane{client: sharedRedisClient(), channel: conf().GetString("backplane.channel")}, nil
+	})
+}
+
+// redisBackplane fans deliveries out over a Redis pub/sub channel on the
+// ratelimit.redis server. Pub/sub is fire and forget: an instance that is
+// disconnected when a message is published never sees it.
+type redisBackplane struct {
+	client  *redis.Client
+	channel string
+}
+
+func (b *redisBackplane) Publish(ctx context.Context, data []byte) error {
+	return b.client.Publish(ctx, b.channel, data).Err()
+}
+
+// Subscribe returns once ctx is done. The client resubscribes by itself when
+// the connection drops.
+func (b *redisBackplane) Subscribe(ctx context.Context, receive func(data []byte)) error {
+	sub := b.client.Subscribe(ctx, b.channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+	MarkSourceReady(BackplaneHealth)
+	stop := context.AfterFunc(ctx, func() { sub.Close() })
+	defer stop()
+
+	for msg := range sub.Channel() {
+		receive([]byte(msg.Payload))
+	}
+	return nil
+}
+
+// Close leaves the shared client open for rate limiting and election.
+func (b *redisBackplane) Close() error {
+	return nil
+}
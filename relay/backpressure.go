@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// queuedDeliveries returns how many deliveries are buffered in topic lanes
+// plus how many frames wait in client send queues.
+func queuedDeliveries() int {
+	total := 0
+	lanesMu.Lock()
+	for _, lane := range lanes {
+		total += len(lane.queue)
+	}
+	lanesMu.Unlock()
+
+	clientsMu.Lock()
+	for c := range clients {
+		total += c.queues.depth()
+	}
+	clientsMu.Unlock()
+	return total
+}
+
+var (
+	pauseMu sync.Mutex
+	// resumed is closed while broadcasting runs and open while an admin has
+	// paused it; pausedAt is when that happened.
+	resumed  = func() chan struct{} { ch := make(chan struct{}); close(ch); return ch }()
+	pausedAt time.Time
+)
+
+// pauseBroadcasting holds every source at its next delivery until
+// resumeBroadcasting, reporting false if already paused.
+func pauseBroadcasting() bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	if !pausedAt.IsZero() {
+		return false
+	}
+	pausedAt = time.Now()
+	resumed = make(chan struct{})
+	return true
+}
+
+func resumeBroadcasting() bool {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	if pausedAt.IsZero() {
+		return false
+	}
+	pausedAt = time.Time{}
+	close(resumed)
+	return true
+}
+
+func pausedSince() time.Time {
+	pauseMu.Lock()
+	defer pauseMu.Unlock()
+	return pausedAt
+}
+
+// awaitCapacity blocks the consumer while broadcasting is paused, and while
+// buffered deliveries are above the high watermark until they drain to the
+// low watermark. Not reading from the delivery channel stalls the AMQP
+// connection, so the backlog stays in RabbitMQ.
+func awaitCapacity() {
+	pauseMu.Lock()
+	wait := resumed
+	pauseMu.Unlock()
+	<-wait
+
+	high := conf().GetInt("backpressure.high_watermark")
+	if high <= 0 {
+		return
+	}
+	depth := queuedDeliveries()
+	if depth < high {
+		return
+	}
+
+	low := conf().GetInt("backpressure.low_watermark")
+	start := time.Now()
+	log.WithFields(logrus.Fields{
+		"event":  "backpressure",
+		"status": "paused",
+		"queued": depth,
+		"high":   high,
+	}).Warn("Relay queues are saturated, pausing consumption")
+
+	for depth > low {
+		time.Sleep(max(conf().GetDuration("backpressure.check_interval"), time.Millisecond))
+		depth = queuedDeliveries()
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":        "backpressure",
+		"status":       "resumed",
+		"queued":       depth,
+		"paused_for_s": time.Since(start).Seconds(),
+	}).Info("Relay queues drained, resuming consumption")
+}
@@ -0,0 +1,37 @@
+package relay
+
+import "testing"
+
+func TestQueuedDeliveriesCountsClientQueues(t *testing.T) {
+	useConfig(t, "clients:\n  send_queue: 4\n  priority_queue: 4\n")
+	c := &client{queues: newClientQueues()}
+	c.queues.normal <- queuedFrame{}
+	c.queues.normal <- queuedFrame{}
+	c.queues.priority <- queuedFrame{}
+	before := queuedDeliveries()
+	registerClient(t, c)
+	if got := queuedDeliveries() - before; got != 3 {
+		t.Errorf("queuedDeliveries() counted %d frames of a client's queues, want 3", got)
+	}
+}
+
+func TestValidateConfigBackpressureInterval(t *testing.T) {
+	tests := []struct {
+		config string
+		ok     bool
+	}{
+		{"backpressure:\n  high_watermark: 10\n  check_interval: 50ms\n", true},
+		{"backpressure:\n  high_watermark: 10\n  check_interval: 0s\n", false},
+		{"backpressure:\n  high_watermark: 10\n", true}, // check_interval has a default
+		{"backpressure:\n  high_watermark: 0\n  check_interval: 0s\n", true},
+	}
+	for _, tt := range tests {
+		cfg, err := newConfig([]byte(tt.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = validateConfig(cfg); (err == nil) != tt.ok {
+			t.Errorf("validateConfig(%q) = %v, want ok %v", tt.config, err, tt.ok)
+		}
+	}
+}
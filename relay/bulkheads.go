@@ -0,0 +1,209 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// overflowLane collects topics seen after bulkheads.max_topics lanes exist.
+const overflowLane = "_overflow"
+
+type topicLane struct {
+	queue   chan inbound
+	dropped atomic.Int64
+}
+
+type laneView struct {
+	Depth    int   `json:"depth"`
+	Capacity int   `json:"capacity"`
+	Dropped  int64 `json:"dropped"`
+}
+
+var (
+	lanes   = make(map[string]*topicLane)
+	lanesMu sync.Mutex
+	laneWG  sync.WaitGroup
+)
+
+// dispatchDelivery relays a delivery consumed from source here and, through
+// the backplane, on the other instances. Deliveries without a routing key are
+// routed by inferTopic first.
+func dispatchDelivery(source string, msg amqp.Delivery) {
+	msg.RoutingKey = inferTopic(msg)
+	messagesConsumed.WithLabelValues(source).Inc()
+	publishBackplane(source, msg)
+	dispatchLocal(source, msg, newDeliveryAck(source, msg))
+}
+
+// dispatchLocal hands a delivery to its topic's lane. A full lane drops the
+// delivery instead of blocking the consumer, so one flooded topic can't delay
+// others. ack is nil for deliveries from the backplane, which the consuming
+// instance settles.
+func dispatchLocal(source string, msg amqp.Delivery, ack *deliveryAck) {
+	in := inbound{msg: msg, source: source, receivedAt: time.Now(), ack: ack}
+	if !conf().GetBool("bulkheads.enabled") {
+		relayDelivery(in)
+		return
+	}
+
+	name, lane := laneFor(msg.RoutingKey)
+	select {
+	case lane.queue <- in:
+	default:
+		lane.dropped.Add(1)
+		recordDrop(dropQueueFull, msg.RoutingKey, logrus.Fields{"lane": name})
+		in.ack.drop(dropQueueFull)
+	}
+}
+
+func laneFor(topic string) (string, *topicLane) {
+	lanesMu.Lock()
+	defer lanesMu.Unlock()
+
+	name := topic
+	if _, ok := lanes[name]; !ok && len(lanes) >= conf().GetInt("bulkheads.max_topics") {
+		name = overflowLane
+	}
+	lane, ok := lanes[name]
+	if !ok {
+		lane = &topicLane{queue: make(chan inbound, conf().GetInt("bulkheads.queue_size"))}
+		lanes[name] = lane
+		for range max(conf().GetInt("bulkheads.workers_per_topic"), 1) {
+			laneWG.Add(1)
+			go runLane(lane)
+		}
+	}
+	return name, lane
+}
+
+func runLane(lane *topicLane) {
+	defer laneWG.Done()
+	for in := range lane.queue {
+		relayDelivery(in)
+	}
+}
+
+// drainLanes closes every lane and waits until the deliveries already queued
+// are relayed or ctx is done. Sources must have stopped dispatching first.
+func drainLanes(ctx context.Context) {
+	lanesMu.Lock()
+	for _, lane := range lanes {
+		close(lane.queue)
+	}
+	lanesMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		laneWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.WithFields(logrus.Fields{
+			"event":  "shutdown",
+			"status": "drain_timeout",
+			"queued": queuedDeliveries(),
+		}).Warn("Drain timeout reached with deliveries still queued")
+	}
+}
+
+func relayDelivery(in inbound) {
+	msg := in.msg
+	ctx, span := startDeliverySpan(in)
+	defer span.End()
+	recordTopic(msg.RoutingKey)
+	size := len(msg.Body)
+	if rule := mutedBy(msg.RoutingKey); rule != nil {
+		skipSpan(span, "muted", nil)
+		if rule.DeadLetter {
+			in.ack.drop(dropMute)
+		} else {
+			in.ack.accept()
+		}
+		return
+	}
+	if isRepeat(msg.RoutingKey, msg.Body) {
+		skipSpan(span, "filtered", nil)
+		in.ack.accept()
+		return
+	}
+	id := nextEventID()
+	if kept, deadLetter := limitSize(&msg, id); !kept {
+		skipSpan(span, "oversized", nil)
+		if deadLetter {
+			in.ack.drop(dropSize)
+		} else {
+			in.ack.accept()
+		}
+		return
+	}
+	var transforms []string
+	if len(msg.Body) != size { // limitSize replaced the body with a truncation placeholder
+		transforms = append(transforms, "oversized:truncate")
+	}
+	p := stages()
+	prepared := msg.Body
+	var applied []string
+	msg.Body, applied = enrichPayload(p.lookups, msg.Body)
+	for _, name := range applied {
+		transforms = append(transforms, "enrichment:"+name)
+	}
+	var err error
+	msg.Body, applied, err = transformPayload(p.transforms, in.source, msg.RoutingKey, msg.Body)
+	shadowDelivery(in.source, msg.RoutingKey, prepared, err != nil)
+	if err != nil {
+		recordDrop(dropTransform, msg.RoutingKey, logrus.Fields{"error": err.Error()})
+		skipSpan(span, "transform_failed", err)
+		in.ack.accept()
+		return
+	}
+	for _, name := range applied {
+		transforms = append(transforms, "transform:"+name)
+	}
+	trace := lineage(in, transforms)
+	out := encodeOutbound(msg, in.source, id, trace)
+	out.payload = decodedPayload(msg.Body)
+	out.project = func(fields []string) outbound {
+		projected := msg
+		projected.Body = projectPayload(msg.Body, fields)
+		p := encodeOutbound(projected, in.source, id, trace)
+		p.key = out.key
+		return p
+	}
+	retain(msg.RoutingKey, out)
+	matched, delivered := broadcastMessage(ctx, msg.RoutingKey, out, in.ack)
+	in.ack.resolve(false)
+	recordBroadcast(msg.RoutingKey, matched, delivered)
+	dispatchWebhooks(in.source, msg.RoutingKey, out.frame)
+	publishReceipt(in.source, msg, matched, delivered)
+	hooks.message(MessageInfo{
+		Source:  in.source,
+		Topic:   msg.RoutingKey,
+		EventID: id,
+		Payload: msg.Body,
+		Matched: matched,
+		Queued:  delivered,
+	})
+}
+
+func handleBulkheads(w http.ResponseWriter, _ *http.Request) {
+	lanesMu.Lock()
+	view := make(map[string]laneView, len(lanes))
+	for name, lane := range lanes {
+		view[name] = laneView{
+			Depth:    len(lane.queue),
+			Capacity: cap(lane.queue),
+			Dropped:  lane.dropped.Load(),
+		}
+	}
+	lanesMu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
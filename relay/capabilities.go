@@ -0,0 +1,47 @@
+package relay
+
+import "slices"
+
+// Capabilities a client can declare in its hello message.
+const (
+	capabilityAck    = "supports_ack"
+	capabilityBinary = "supports_binary"
+	capabilityPatch  = "supports_patch"
+)
+
+// serverCapabilities reports which declarable features this relay can use
+// with its current config. Acks and patches aren't sent by any relay feature
+// yet, so clients declaring them get the plain behaviour.
+func serverCapabilities() map[string]bool {
+	return map[string]bool{
+		capabilityAck:    false,
+		capabilityBinary: conf().GetBool("envelope.enabled") && conf().GetBool("envelope.binary_attachments"),
+		capabilityPatch:  false,
+	}
+}
+
+// negotiate records the capabilities both c and the server support, ignoring
+// ones the server doesn't know so newer clients work against older relays.
+// Features degrade per client: without supports_binary a client gets text
+// frames only, whatever it asked for with ?binary=1.
+// Must be called with clientsMu held.
+func (c *client) negotiate(declared map[string]bool) {
+	c.capabilities = make(map[string]bool)
+	for name, enabled := range serverCapabilities() {
+		c.capabilities[name] = enabled && declared[name]
+	}
+	c.binary = c.capabilities[capabilityBinary]
+}
+
+// supportedCapabilities lists the capabilities the server would accept, for
+// /api/info.
+func supportedCapabilities() []string {
+	names := []string{}
+	for name, enabled := range serverCapabilities() {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	const cooldown = 20 * time.Millisecond
+	b := newCircuitBreaker(2, cooldown)
+
+	if !b.Allow() || b.Failure() {
+		t.Fatal("breaker opened before reaching its threshold")
+	}
+	if !b.Allow() || !b.Failure() {
+		t.Fatal("breaker didn't open at its threshold")
+	}
+	if b.State() != breakerOpen || b.Allow() {
+		t.Fatalf("open breaker in state %v let a call through", b.State())
+	}
+
+	time.Sleep(cooldown)
+	if !b.Allow() {
+		t.Fatal("breaker didn't let a probe through after its cooldown")
+	}
+	if b.State() != breakerHalfOpen || b.Allow() {
+		t.Fatalf("breaker in state %v let a second probe through", b.State())
+	}
+	if !b.Failure() || b.State() != breakerOpen {
+		t.Fatal("failed probe didn't open the breaker again")
+	}
+
+	time.Sleep(cooldown)
+	if !b.Allow() {
+		t.Fatal("breaker didn't let a probe through after its second cooldown")
+	}
+	b.Success()
+	if b.State() != breakerClosed || !b.Allow() || !b.Allow() {
+		t.Fatalf("breaker in state %v after a successful probe, want closed", b.State())
+	}
+	if b.Failure() {
+		t.Error("successful probe didn't reset the failure count")
+	}
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	b := newCircuitBreaker(0, time.Hour)
+	for range 10 {
+		if !b.Allow() || b.Failure() {
+			t.Fatal("disabled breaker opened")
+		}
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("disabled breaker in state %v", b.State())
+	}
+}
+
+func TestBreakerStateString(t *testing.T) {
+	for state, want := range map[breakerState]string{
+		breakerClosed:   "closed",
+		breakerOpen:     "open",
+		breakerHalfOpen: "half_open",
+		breakerState(9): "unknown",
+	} {
+		if got := state.String(); got != want {
+			t.Errorf("%d.String() = %q, want %q", state, got, want)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package relay
+
+import (
+	"compress/flate"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientCompression tracks how well a client's traffic compresses. Every
+// compression.sample_every-th write is deflated on the side to estimate the
+// ratio and CPU cost permessage-deflate has for that client.
+type clientCompression struct {
+	negotiated      bool
+	disabled        bool
+	writes          int
+	samples         int
+	rawBytes        int64
+	compressedBytes int64
+	cpu             time.Duration
+}
+
+type clientCompressionView struct {
+	Client     string  `json:"client"`
+	ClientID   string  `json:"client_id,omitempty"`
+	Negotiated bool    `json:"negotiated"`
+	Disabled   bool    `json:"disabled"`
+	Samples    int     `json:"samples"`
+	Ratio      float64 `json:"ratio"`
+	CPUMicros  int64   `json:"cpu_us_per_sample"`
+}
+
+type compressionView struct {
+	Enabled      bool                    `json:"enabled"`
+	AutoDisabled int64                   `json:"auto_disabled"`
+	Clients      []clientCompressionView `json:"clients"`
+}
+
+var compressionAutoDisabled atomic.Int64
+
+func initCompression() {
+	upgrader.EnableCompression = conf().GetBool("compression.enabled")
+}
+
+// negotiatedCompression reports whether the upgrade will agree on
+// permessage-deflate with this client.
+func negotiatedCompression(r *http.Request) bool {
+	return upgrader.EnableCompression &&
+		strings.Contains(r.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+}
+
+func (s *clientCompression) ratio() float64 {
+	if s.rawBytes == 0 {
+		return 0
+	}
+	return float64(s.compressedBytes) / float64(s.rawBytes)
+}
+
+// sampleCompression measures a sampled frame and turns compression off for c
+// once its traffic proves incompressible. Must be called with clientsMu held.
+func sampleCompression(c *client, frame []byte) {
+	s := &c.compression
+	if !s.negotiated || s.disabled {
+		return
+	}
+	s.writes++
+	if every := max(conf().GetInt("compression.sample_every"), 1); s.writes%every != 0 {
+		return
+	}
+
+	start := time.Now()
+	counter := &countingWriter{}
+	fw, err := flate.NewWriter(counter, conf().GetInt("compression.level"))
+	if err != nil {
+		return
+	}
+	_, _ = fw.Write(frame)
+	_ = fw.Close()
+	s.cpu += time.Since(start)
+	s.samples++
+	s.rawBytes += int64(len(frame))
+	s.compressedBytes += counter.n
+
+	if s.samples < conf().GetInt("compression.min_samples") || s.ratio() < conf().GetFloat64("compression.max_ratio") {
+		return
+	}
+	s.disabled = true
+	c.conn.EnableWriteCompression(false)
+	compressionAutoDisabled.Add(1)
+
+	log.WithFields(logrus.Fields{
+		"event":   "compression_tuning",
+		"status":  "disabled",
+		"client":  c.remoteAddr,
+		"ratio":   s.ratio(),
+		"samples": s.samples,
+	}).Info("Payloads for client are incompressible, disabling permessage-deflate")
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func handleCompression(w http.ResponseWriter, _ *http.Request) {
+	clientsMu.Lock()
+	view := compressionView{
+		Enabled:      upgrader.EnableCompression,
+		AutoDisabled: compressionAutoDisabled.Load(),
+		Clients:      make([]clientCompressionView, 0, len(clients)),
+	}
+	for c := range clients {
+		s := c.compression
+		v := clientCompressionView{
+			Client:     c.remoteAddr,
+			ClientID:   c.id,
+			Negotiated: s.negotiated,
+			Disabled:   s.disabled,
+			Samples:    s.samples,
+			Ratio:      s.ratio(),
+		}
+		if s.samples > 0 {
+			v.CPUMicros = (s.cpu / time.Duration(s.samples)).Microseconds()
+		}
+		view.Clients = append(view.Clients, v)
+	}
+	clientsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
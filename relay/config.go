@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+var (
+	// runningConfig is never changed in place: a reload reads the file into
+	// a new instance and swaps it in whole, so readers see either the old
+	// config or the new one, never a half-read one.
+	runningConfig atomic.Pointer[viper.Viper]
+
+	// configFile is the file the running config was read from.
+	configFile string
+
+	// configOverrides are Config.Settings, applied on top of every read of
+	// the file.
+	configOverrides map[string]any
+)
+
+func init() {
+	runningConfig.Store(viper.New())
+}
+
+// conf returns the running config. Hold on to the result only as long as
+// several related settings must come from the same config.
+func conf() *viper.Viper {
+	return runningConfig.Load()
+}
+
+// newConfig reads a config file's contents into an instance ready to be
+// swapped in: environment variables and Config.Settings take precedence over
+// the file, as for the config the relay started with, and configDefaults fill
+// in what it leaves out.
+func newConfig(data []byte) (*viper.Viper, error) {
+	cfg := viper.New()
+	for key, value := range configDefaults {
+		cfg.SetDefault(key, value)
+	}
+	cfg.SetConfigType(configType())
+	cfg.AutomaticEnv()
+	if err := cfg.ReadConfig(bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	for key, value := range configOverrides {
+		cfg.Set(key, value)
+	}
+	return cfg, nil
+}
+
+// configType is the format of the config file, from its extension.
+func configType() string {
+	if ext := strings.TrimPrefix(filepath.Ext(configFile), "."); ext != "" {
+		return ext
+	}
+	return "yaml"
+}
+
+// unmarshalConfig decodes a config subtree, accepting RFC 3339 strings for
+// time.Time fields in addition to viper's default hooks.
+func unmarshalConfig(key string, v any) error {
+	return unmarshalConfigFrom(conf(), key, v)
+}
+
+// unmarshalConfigFrom is unmarshalConfig for a config not yet applied.
+func unmarshalConfigFrom(cfg *viper.Viper, key string, v any) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:           v,
+		WeaklyTypedInput: true,
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeHookFunc(time.RFC3339),
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(configSubtree(cfg, key))
+}
+
+// configSubtree returns the settings under key with the defaults the file
+// leaves out merged in, which viper's UnmarshalKey drops once the file sets
+// any setting under key.
+func configSubtree(cfg *viper.Viper, key string) any {
+	var tree any = cfg.AllSettings()
+	for _, part := range strings.Split(strings.ToLower(key), ".") {
+		settings, ok := tree.(map[string]any)
+		if !ok {
+			return nil
+		}
+		tree = settings[part]
+	}
+	return tree
+}
@@ -0,0 +1,388 @@
+package relay
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// sourceConfig is one RabbitMQ queue relayed by the consumer. When Exchange
+// is set the queue is bound to it with each of Bindings as a routing key pattern.
+type sourceConfig struct {
+	Name         string   `mapstructure:"name"`
+	Queue        string   `mapstructure:"queue"`
+	Exchange     string   `mapstructure:"exchange"`
+	ExchangeType string   `mapstructure:"exchange_type"`
+	Bindings     []string `mapstructure:"bindings"`
+	// OnDemand binds routing keys, or for a queue without an exchange
+	// consumes it, only while some client or webhook is subscribed.
+	OnDemand bool `mapstructure:"on_demand"`
+	// Stream declares the queue as a RabbitMQ stream, read from
+	// StartPosition: earliest, latest or a timestamp.
+	Stream        bool   `mapstructure:"stream"`
+	StartPosition string `mapstructure:"start_position"`
+}
+
+// bindings returns the source's routing key patterns, "#" when none are given.
+func (src sourceConfig) bindings() []string {
+	if len(src.Bindings) == 0 {
+		return []string{"#"}
+	}
+	return src.Bindings
+}
+
+// sourceConfigs returns the sources list, falling back to the single
+// rabbitmq.queue. A source without a name is named after its queue.
+func sourceConfigs() []sourceConfig {
+	var sources []sourceConfig
+	if err := unmarshalConfig("sources", &sources); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "sources_config",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Fatal("Failed to read sources config")
+	}
+	if len(sources) == 0 {
+		sources = []sourceConfig{{
+			Queue:         conf().GetString("rabbitmq.queue"),
+			OnDemand:      conf().GetBool("rabbitmq.on_demand"),
+			Stream:        conf().GetBool("rabbitmq.stream"),
+			StartPosition: conf().GetString("rabbitmq.start_position"),
+		}}
+	}
+	for i := range sources {
+		if sources[i].Name == "" {
+			sources[i].Name = sources[i].Queue
+		}
+		if !sources[i].Stream {
+			continue
+		}
+		if _, err := sources[i].streamOffset(); err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "sources_config",
+				"status": "failed",
+				"source": sources[i].Name,
+				"error":  err.Error(),
+			}).Fatal("Invalid stream start position")
+		}
+	}
+	return sources
+}
+
+var (
+	// drainedSources close the channels of stopped sources once shutdown has
+	// settled the deliveries received on them.
+	drainedSources   []func()
+	drainedSourcesMu sync.Mutex
+)
+
+// closeAfterDrain keeps a stopped source's channel open until
+// closeDrainedSources: a delivery acked or nacked on a closed channel is
+// redelivered, so every in-flight message would be relayed twice.
+func closeAfterDrain(closeSource func()) {
+	drainedSourcesMu.Lock()
+	drainedSources = append(drainedSources, closeSource)
+	drainedSourcesMu.Unlock()
+}
+
+// closeDrainedSources closes the channels kept open by closeAfterDrain.
+func closeDrainedSources() {
+	drainedSourcesMu.Lock()
+	defer drainedSourcesMu.Unlock()
+	for _, closeSource := range drainedSources {
+		closeSource()
+	}
+	drainedSources = nil
+}
+
+// runConsumer relays deliveries from every configured source, one consumer
+// goroutine each, and returns once ctx is done and all of them have stopped.
+func runConsumer(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, src := range sourceConfigs() {
+		ExpectSource(src.Name)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSource(ctx, src)
+		}()
+	}
+	wg.Wait()
+}
+
+// runSource relays deliveries from one source, reconnecting with backoff
+// whenever the connection is lost or rabbitmq.url is reloaded. A standby connects and binds its queue but
+// only starts consuming once promoted, and an on-demand queue only while it
+// has subscribers. When ctx is done the consumer is cancelled and it returns,
+// leaving the channel open for the deliveries already received to be relayed
+// and settled; see closeAfterDrain.
+func runSource(ctx context.Context, src sourceConfig) {
+	policy := loadRetryPolicy("rabbitmq.reconnect")
+	tag := "event-relay." + src.Name
+
+	for ctx.Err() == nil {
+		restart := restartSignal()
+		rabbitMQURL := conf().GetString("rabbitmq.url")
+		var conn *amqp.Connection
+		var ch *amqp.Channel
+		err := retry(ctx, "amqp", policy, func() error {
+			var err error
+			conn, ch, err = openSource(rabbitMQURL, src)
+			return err
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "rabbitmq_connection",
+				"status": "failed",
+				"source": src.Name,
+				"error":  err.Error(),
+			}).Fatal("Giving up connecting to RabbitMQ")
+		}
+		watchSource(src.Name, conn, ch)
+		if !awaitActive(ctx) {
+			closeReceiptChannel(src.Name)
+			conn.Close()
+			return
+		}
+		if src.OnDemand && src.Exchange != "" {
+			go reconcileBindings(ch, src)
+		}
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		waitForDemand := src.OnDemand && src.Exchange == ""
+		for {
+			if waitForDemand && !awaitDemand(ctx, restart, closed) {
+				break
+			}
+			if !consumeSource(ctx, ch, src, tag, restart) {
+				break
+			}
+		}
+
+		closeReceiptChannel(src.Name)
+		if ctx.Err() != nil {
+			closeAfterDrain(func() {
+				ch.Close()
+				conn.Close()
+			})
+			log.WithFields(logrus.Fields{
+				"event":  "rabbitmq_connection",
+				"status": "stopped",
+				"source": src.Name,
+			}).Info("Stopped consuming from RabbitMQ")
+			return
+		}
+		ch.Close()
+		conn.Close()
+		select {
+		case <-restart:
+			log.WithFields(logrus.Fields{
+				"event":  "rabbitmq_connection",
+				"status": "restarting",
+				"source": src.Name,
+			}).Info("RabbitMQ settings changed, reconnecting")
+			continue
+		default:
+		}
+		amqpReconnects.WithLabelValues(src.Name).Inc()
+		log.WithFields(logrus.Fields{
+			"event":  "rabbitmq_connection",
+			"status": "lost",
+			"source": src.Name,
+			"queue":  src.Queue,
+		}).Warn("RabbitMQ connection lost, reconnecting")
+	}
+}
+
+// consumeSource relays deliveries from ch until ctx is done, the sources
+// restart, the channel fails or an on-demand queue loses its last subscriber,
+// and reports whether it stopped for the last reason.
+func consumeSource(ctx context.Context, ch *amqp.Channel, src sourceConfig, tag string, restart <-chan struct{}) bool {
+	var args amqp.Table
+	if src.Stream {
+		offset, _ := src.streamOffset() // validated by sourceConfigs
+		args = amqp.Table{streamOffsetHeader: offset}
+	}
+	// Streams only accept consumers that ack, so in auto mode the relay acks
+	// them on receipt itself.
+	autoAck := !manualAcks() && !src.Stream
+	msgs, err := ch.Consume(src.Queue, tag, autoAck, false, false, false, args)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "queue_subscribe",
+			"status": "failed",
+			"queue":  src.Queue,
+			"error":  err.Error(),
+		}).Error("Failed to subscribe to queue")
+		return false
+	}
+
+	stopCancel := context.AfterFunc(ctx, func() { _ = ch.Cancel(tag, false) })
+	consuming := make(chan struct{})
+	var idled atomic.Bool
+	go func() {
+		select {
+		case <-restart:
+			_ = ch.Cancel(tag, false)
+		case <-idleSignal(src, consuming):
+			idled.Store(true)
+			_ = ch.Cancel(tag, false)
+		case <-consuming:
+		}
+	}()
+	for msg := range msgs {
+		log.WithFields(logrus.Fields{
+			"event":   "message_received",
+			"status":  "success",
+			"source":  src.Name,
+			"queue":   src.Queue,
+			"message": string(msg.Body),
+		}).Info("Received message from RabbitMQ")
+		if src.Stream {
+			advanceStreamCursor(src.Name, msg)
+			if !manualAcks() {
+				_ = msg.Ack(false)
+			}
+		}
+		awaitCapacity()
+		dispatchDelivery(src.Name, msg)
+	}
+
+	stopCancel()
+	close(consuming)
+	if idled.Load() {
+		log.WithFields(logrus.Fields{
+			"event":  "queue_subscribe",
+			"status": "idle",
+			"source": src.Name,
+			"queue":  src.Queue,
+		}).Info("No subscribers left, pausing consumption")
+	}
+	return idled.Load()
+}
+
+// openSource connects to RabbitMQ and declares and binds the source's queue,
+// ready to consume from.
+func openSource(rabbitMQURL string, src sourceConfig) (*amqp.Connection, *amqp.Channel, error) {
+	queueName := src.Queue
+	conn, err := amqp.Dial(rabbitMQURL)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "rabbitmq_connection",
+			"status": "failed",
+			"source": src.Name,
+			"error":  err.Error(),
+		}).Error("Failed to connect to RabbitMQ")
+		return nil, nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "channel_creation",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Error("Failed to create RabbitMQ channel")
+		conn.Close()
+		return nil, nil, err
+	}
+
+	var args amqp.Table
+	if src.Stream {
+		args = amqp.Table{"x-queue-type": "stream"}
+	}
+	_, err = ch.QueueDeclare(queueName, true, false, false, false, args)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "queue_declare",
+			"status": "failed",
+			"queue":  queueName,
+			"error":  err.Error(),
+		}).Error("Failed to declare queue")
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if err = bindSource(ch, src); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if manualAcks() || src.Stream {
+		if err = ch.Qos(conf().GetInt("rabbitmq.ack.prefetch"), 0, false); err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "channel_qos",
+				"status": "failed",
+				"source": src.Name,
+				"error":  err.Error(),
+			}).Error("Failed to set consumer prefetch")
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	if err = openReceiptChannel(src.Name, conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":  "rabbitmq_connection",
+		"status": "connected",
+		"source": src.Name,
+		"queue":  queueName,
+	}).Info("Connected to RabbitMQ")
+	return conn, ch, nil
+}
+
+// bindSource declares the source's exchange and binds its queue to every
+// routing key pattern. On-demand sources are bound later by
+// reconcileBindings.
+func bindSource(ch *amqp.Channel, src sourceConfig) error {
+	if src.Exchange == "" {
+		return nil
+	}
+	kind := src.ExchangeType
+	if kind == "" {
+		kind = amqp.ExchangeTopic
+	}
+	if err := ch.ExchangeDeclare(src.Exchange, kind, true, false, false, false, nil); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":    "exchange_declare",
+			"status":   "failed",
+			"exchange": src.Exchange,
+			"error":    err.Error(),
+		}).Error("Failed to declare source exchange")
+		return err
+	}
+	if src.OnDemand {
+		return nil
+	}
+
+	for _, key := range src.bindings() {
+		if err := bindKey(ch, src, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func bindKey(ch *amqp.Channel, src sourceConfig, key string) error {
+	err := ch.QueueBind(src.Queue, key, src.Exchange, false, nil)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":       "queue_bind",
+			"status":      "failed",
+			"queue":       src.Queue,
+			"exchange":    src.Exchange,
+			"routing_key": key,
+			"error":       err.Error(),
+		}).Error("Failed to bind queue to exchange")
+	}
+	return err
+}
@@ -0,0 +1,204 @@
+package relay
+
+import (
+	"encoding/json"
+	"maps"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Headers a dead-lettered message carries besides its own.
+const (
+	deadLetterHeaderReason   = "x-relay-failure-reason"
+	deadLetterHeaderSource   = "x-relay-source"
+	deadLetterHeaderTopic    = "x-relay-topic"
+	deadLetterHeaderFailedAt = "x-relay-failed-at"
+	deadLetterHeaderQueued   = "x-relay-clients-queued"
+	deadLetterHeaderWritten  = "x-relay-clients-written"
+	deadLetterHeaderInstance = "x-relay-instance"
+
+	deadLetterHeaderSubscription = "x-relay-webhook-subscription"
+	deadLetterHeaderError        = "x-relay-error"
+)
+
+// deadLetter is a delivery no client got, as it stood when it failed. headers
+// are added to the failure metadata.
+type deadLetter struct {
+	ack      *deliveryAck
+	reason   string
+	queued   int
+	written  int
+	failedAt time.Time
+	headers  amqp.Table
+}
+
+var (
+	deadLetterPublisher = publisher{section: "dead_letter"}
+
+	// deadLetters holds failed deliveries waiting for the publisher, nil when
+	// dead_letter is off.
+	deadLetters chan deadLetter
+
+	// deadLetterFailureLog keeps an outage from logging on every message.
+	deadLetterFailureLog = newTokenBucket(1.0/60, 1)
+)
+
+// deadLettering reports whether deliveries from source are dead-lettered.
+// Synthetic topics aren't, since they are generated again every interval.
+func deadLettering(source string) bool {
+	return deadLetters != nil && source != "synthetic"
+}
+
+// startDeadLetters starts publishing failed deliveries to dead_letter.exchange.
+// The returned func publishes what is still queued and waits for that,
+// so it belongs after shutdown has drained the clients.
+func startDeadLetters() func() {
+	if !conf().GetBool("dead_letter.enabled") {
+		return func() {}
+	}
+	deadLetters = make(chan deadLetter, max(conf().GetInt("dead_letter.queue_size"), 1))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case d := <-deadLetters:
+				publishDeadLetter(d)
+			case <-stop:
+				for {
+					select {
+					case d := <-deadLetters:
+						publishDeadLetter(d)
+					default:
+						return
+					}
+				}
+			}
+		}
+	}()
+
+	log.WithFields(logrus.Fields{
+		"event":    "dead_letter",
+		"status":   "enabled",
+		"exchange": conf().GetString("dead_letter.exchange"),
+		"queue":    conf().GetString("dead_letter.queue"),
+	}).Info("Publishing undeliverable messages to the dead-letter exchange")
+	return func() {
+		close(stop)
+		wg.Wait()
+	}
+}
+
+// queueDeadLetter hands a failed delivery to the publisher without blocking,
+// reporting false when the queue is full. Must be called with a.mu held.
+func queueDeadLetter(a *deliveryAck) bool {
+	d := deadLetter{ack: a, reason: a.failure(), queued: a.queued, written: a.written, failedAt: time.Now().UTC()}
+	select {
+	case deadLetters <- d:
+		return true
+	default:
+		deadLettersPublished.WithLabelValues(d.reason, "dropped").Inc()
+		return false
+	}
+}
+
+// queueWebhookDeadLetter hands a webhook delivery that sub gave up on, for
+// reason, to the publisher, unless dead_letter is off. The delivery it was
+// dispatched for is settled already, so there is nothing to ack once it is
+// published.
+func queueWebhookDeadLetter(sub *webhookSubscription, d webhookDelivery, reason string, err error) {
+	if !deadLettering(d.source) {
+		return
+	}
+	headers := amqp.Table{deadLetterHeaderSubscription: sub.ID}
+	if err != nil {
+		headers[deadLetterHeaderError] = err.Error()
+	}
+	contentType := "application/octet-stream"
+	if json.Valid(d.body) {
+		contentType = "application/json"
+	}
+	ack := &deliveryAck{
+		msg:    amqp.Delivery{MessageId: d.id, RoutingKey: d.topic, ContentType: contentType, Body: d.body},
+		source: d.source,
+	}
+	dl := deadLetter{ack: ack, reason: reason, failedAt: time.Now().UTC(), headers: headers}
+	select {
+	case deadLetters <- dl:
+	default:
+		deadLettersPublished.WithLabelValues(reason, "dropped").Inc()
+	}
+}
+
+// publishDeadLetter publishes d with its failure metadata. A RabbitMQ
+// delivery in broadcast ack mode is acked once its dead letter is out, and
+// nacked as usual when publishing fails.
+func publishDeadLetter(d deadLetter) {
+	msg := d.ack.msg
+	headers := maps.Clone(msg.Headers)
+	if headers == nil {
+		headers = make(amqp.Table)
+	}
+	headers[deadLetterHeaderReason] = d.reason
+	headers[deadLetterHeaderSource] = d.ack.source
+	headers[deadLetterHeaderTopic] = msg.RoutingKey
+	headers[deadLetterHeaderFailedAt] = d.failedAt
+	headers[deadLetterHeaderQueued] = int32(d.queued)   //nolint:gosec // client counts fit
+	headers[deadLetterHeaderWritten] = int32(d.written) //nolint:gosec // client counts fit
+	headers[deadLetterHeaderInstance] = relayInstanceID()
+	maps.Copy(headers, d.headers)
+
+	routingKey := conf().GetString("dead_letter.routing_key")
+	if conf().GetString("dead_letter.exchange") == "" {
+		routingKey = conf().GetString("dead_letter.queue") // the default exchange routes by queue name
+	} else if routingKey == "" {
+		routingKey = msg.RoutingKey
+	}
+	err := deadLetterPublisher.publish(routingKey, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		CorrelationId:   msg.CorrelationId,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	})
+
+	if err == nil {
+		deadLettersPublished.WithLabelValues(d.reason, "published").Inc()
+		log.WithFields(logrus.Fields{
+			"event":  "dead_letter",
+			"status": "published",
+			"topic":  msg.RoutingKey,
+			"reason": d.reason,
+		}).Debug("Undeliverable message dead-lettered")
+		if d.ack.manual {
+			_ = msg.Ack(false)
+			forgetRequeues(msg)
+		}
+		return
+	}
+
+	deadLettersPublished.WithLabelValues(d.reason, "failed").Inc()
+	if deadLetterFailureLog.Allow() {
+		log.WithFields(logrus.Fields{
+			"event":  "dead_letter",
+			"status": "failed",
+			"topic":  msg.RoutingKey,
+			"reason": d.reason,
+			"error":  err.Error(),
+		}).Error("Failed to publish to the dead-letter exchange")
+	}
+	if d.ack.manual {
+		d.ack.mu.Lock()
+		d.ack.nack()
+		d.ack.mu.Unlock()
+	}
+}
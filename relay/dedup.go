@@ -0,0 +1,40 @@
+package relay
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+type lastPayload struct {
+	hash [sha256.Size]byte
+	at   time.Time
+}
+
+var (
+	lastPayloads   = make(map[string]lastPayload)
+	lastPayloadsMu sync.Mutex
+)
+
+// isRepeat reports whether body repeats the previous payload on topic within
+// the dedup window, for topics that opted into suppression.
+func isRepeat(topic string, body []byte) bool {
+	if !matchesAny(conf().GetStringSlice("dedup.topics"), topic) {
+		return false
+	}
+	hash := sha256.Sum256(body)
+	now := time.Now()
+
+	lastPayloadsMu.Lock()
+	prev, ok := lastPayloads[topic]
+	repeat := ok && prev.hash == hash && now.Sub(prev.at) < conf().GetDuration("dedup.window")
+	if !repeat {
+		lastPayloads[topic] = lastPayload{hash: hash, at: now}
+	}
+	lastPayloadsMu.Unlock()
+
+	if repeat {
+		recordDrop(dropDedup, topic, nil)
+	}
+	return repeat
+}
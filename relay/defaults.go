@@ -0,0 +1,202 @@
+package relay
+
+import "time"
+
+// configDefaults are the settings a config file may leave out, the same as in
+// the example config.yaml. Endpoints and credentials have none.
+var configDefaults = map[string]any{
+	"annotations.default_ttl": time.Hour,
+
+	"auth.api_key.header":   "X-API-Key",
+	"auth.jwt.jwks_refresh": time.Hour,
+	"auth.jwt.jwks_timeout": 5 * time.Second,
+	"auth.jwt.leeway":       30 * time.Second,
+	"auth.provider":         "none",
+
+	"authz.engine":             "none",
+	"authz.opa.bundle_refresh": 5 * time.Minute,
+	"authz.opa.query":          "data.event_relay.allow",
+	"authz.opa.timeout":        time.Second,
+
+	"backplane.channel":                 "event-relay:backplane",
+	"backplane.queue_size":              1024,
+	"backplane.reconnect.initial_delay": time.Second,
+	"backplane.reconnect.jitter":        0.2,
+	"backplane.reconnect.max_delay":     30 * time.Second,
+	"backplane.reconnect.multiplier":    2,
+	"backplane.timeout":                 time.Second,
+	"backplane.type":                    "none",
+
+	"backpressure.check_interval": 50 * time.Millisecond,
+
+	"bulkheads.max_topics":        100,
+	"bulkheads.queue_size":        1000,
+	"bulkheads.workers_per_topic": 1,
+
+	"clients.escalation.behind_depth":   128,
+	"clients.escalation.grace":          30 * time.Second,
+	"clients.escalation.write_deadline": 2 * time.Second,
+	"clients.keepalive.ping_interval":   30 * time.Second,
+	"clients.keepalive.pong_timeout":    75 * time.Second,
+	"clients.overflow":                  "drop",
+	"clients.priority_queue":            64,
+	"clients.rate_limit.burst":          20,
+	"clients.rate_limit.max_pending":    100,
+	"clients.rate_limit.policy":         "coalesce",
+	"clients.send_queue":                256,
+
+	"compression.level":        1,
+	"compression.max_ratio":    0.9,
+	"compression.min_samples":  10,
+	"compression.sample_every": 20,
+
+	"config.rollback.bake_period":    2 * time.Minute,
+	"config.rollback.check_interval": 10 * time.Second,
+	"config.rollback.min_messages":   100,
+	"config.rollback.min_ratio":      0.05,
+	"config.rollback.shadow_period":  30 * time.Second,
+	"config.rollback.spike_factor":   3,
+
+	"dead_letter.confirm_timeout": 5 * time.Second,
+	"dead_letter.exchange":        "relay.dead_letters",
+	"dead_letter.exchange_type":   "topic",
+	"dead_letter.queue":           "relay.dead_letters",
+	"dead_letter.queue_size":      1000,
+
+	"dedup.window": 30 * time.Second,
+
+	"demo.rate": 2,
+
+	"diagnostics.flight_recorder.enabled":    true,
+	"diagnostics.flight_recorder.max_events": 10000,
+	"diagnostics.flight_recorder.window":     time.Minute,
+
+	"drops.log_sample_rate": 0.01,
+
+	"envelope.compression.algorithm": "none",
+	"envelope.compression.min_size":  16384,
+
+	"filters.enabled":    true,
+	"filters.max_length": 1024,
+	"filters.max_nodes":  100,
+
+	"goroutines.max_per_client": 4,
+
+	"ha.election":  "none",
+	"ha.lease_key": "event-relay:leader",
+	"ha.lease_ttl": 10 * time.Second,
+	"ha.mode":      "active",
+
+	"kafka.commit":                  "interval",
+	"kafka.commit_interval":         time.Second,
+	"kafka.group_id":                "event-relay",
+	"kafka.max_wait":                500 * time.Millisecond,
+	"kafka.reconnect.initial_delay": time.Second,
+	"kafka.reconnect.jitter":        0.2,
+	"kafka.reconnect.max_delay":     30 * time.Second,
+	"kafka.reconnect.multiplier":    2,
+	"kafka.start_offset":            "latest",
+	"kafka.start_position":          "stored",
+
+	"log.file_path":   "logs/event_relay.log",
+	"log.level":       "info",
+	"log.max_age":     30,
+	"log.max_backups": 5,
+	"log.max_size":    10,
+
+	"metrics.enabled":    true,
+	"metrics.max_topics": 100,
+
+	"oversized.policy":     "drop",
+	"oversized.store_size": 100,
+
+	"publish.burst":           10,
+	"publish.confirm_timeout": 5 * time.Second,
+	"publish.exchange":        "client_events",
+	"publish.exchange_type":   "topic",
+	"publish.max_size":        65536,
+	"publish.rate":            "10/s",
+
+	"quotas.max_tenants": 1000,
+	"quotas.window":      time.Minute,
+
+	"rabbitmq.ack.max_redeliveries":    5,
+	"rabbitmq.ack.min_clients":         1,
+	"rabbitmq.ack.mode":                "auto",
+	"rabbitmq.ack.on_failure":          "requeue",
+	"rabbitmq.ack.prefetch":            100,
+	"rabbitmq.ack.requeue_delay":       time.Second,
+	"rabbitmq.queue":                   "events_queue",
+	"rabbitmq.reconnect.initial_delay": time.Second,
+	"rabbitmq.reconnect.jitter":        0.2,
+	"rabbitmq.reconnect.max_delay":     30 * time.Second,
+	"rabbitmq.reconnect.multiplier":    2,
+	"rabbitmq.start_position":          "latest",
+
+	"ratelimit.backend":       "local",
+	"ratelimit.redis.prefix":  "event-relay:ratelimit:",
+	"ratelimit.redis.timeout": 50 * time.Millisecond,
+
+	"receipts.exchange":      "relay.receipts",
+	"receipts.exchange_type": "topic",
+
+	"replay.max_age":      5 * time.Minute,
+	"replay.max_messages": 1000,
+
+	"server.accept_burst":     100,
+	"server.duplicate_policy": "allow",
+	"server.ip_mode":          "dual",
+	"server.port":             "8080",
+	"server.retry_after":      5 * time.Second,
+	"server.retry_jitter":     30 * time.Second,
+	"server.tls.client_auth":  "require",
+
+	"shutdown.close_code":    1001,
+	"shutdown.close_reason":  "server shutting down",
+	"shutdown.drain_timeout": 15 * time.Second,
+
+	"soak.max_goroutine_growth": 20,
+	"soak.max_heap_growth":      67108864,
+	"soak.sample_interval":      30 * time.Second,
+	"soak.settle":               10 * time.Second,
+	"soak.storm_interval":       time.Minute,
+	"soak.warmup":               5 * time.Second,
+
+	"sse.heartbeat": 15 * time.Second,
+
+	"subscriptions.default":            "all",
+	"subscriptions.demand_interval":    time.Second,
+	"subscriptions.field":              "type",
+	"subscriptions.match":              "routing_key",
+	"subscriptions.max_pattern_length": 255,
+	"subscriptions.max_pattern_words":  32,
+	"subscriptions.max_topics":         100,
+
+	"tenants.header":    "X-Tenant",
+	"tenants.namespace": true,
+	"tenants.source":    "subdomain",
+
+	"topics.infer.fallback": "unrouted",
+
+	"tracing.client_spans": true,
+	"tracing.insecure":     true,
+	"tracing.sample_ratio": 1.0,
+	"tracing.service_name": "event-relay",
+
+	"upstream.reconnect.initial_delay": time.Second,
+	"upstream.reconnect.jitter":        0.2,
+	"upstream.reconnect.max_delay":     30 * time.Second,
+	"upstream.reconnect.multiplier":    2,
+
+	"webhooks.breaker_cooldown":            30 * time.Second,
+	"webhooks.breaker_threshold":           5,
+	"webhooks.max_subscriptions_per_owner": 100,
+	"webhooks.queue_size":                  1000,
+	"webhooks.retry.budget":                10,
+	"webhooks.retry.initial_delay":         time.Second,
+	"webhooks.retry.jitter":                0.2,
+	"webhooks.retry.max_attempts":          3,
+	"webhooks.retry.max_delay":             30 * time.Second,
+	"webhooks.retry.multiplier":            2,
+	"webhooks.timeout":                     5 * time.Second,
+}
@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// subscriberCounts returns how many clients and webhook subscriptions hold
+// each topic pattern, and how many clients take every topic because they
+// never subscribed.
+func subscriberCounts() (map[string]int, int) {
+	counts := make(map[string]int)
+	all := 0
+	everything := conf().GetString("subscriptions.default") != "none"
+	clientsMu.Lock()
+	for c := range clients {
+		if c.subscriptions == nil {
+			if everything {
+				all++
+			}
+			continue
+		}
+		for _, pattern := range c.subscriptions {
+			counts[pattern]++
+		}
+	}
+	clientsMu.Unlock()
+
+	webhookSubsMu.RLock()
+	for _, sub := range webhookSubs {
+		for _, pattern := range sub.Topics {
+			counts[pattern]++
+		}
+	}
+	webhookSubsMu.RUnlock()
+	return counts, all
+}
+
+func handleSubscribers(w http.ResponseWriter, _ *http.Request) {
+	counts, all := subscriberCounts()
+	writeJSON(w, http.StatusOK, map[string]any{"topics": counts, "all_topics": all})
+}
+
+// demandedBindings returns the routing key patterns an on-demand source should
+// have bound right now. A subscription narrower than one of the source's
+// bindings is bound as is, a wider one binds the source's binding, and a
+// client taking every topic binds them all. Subscriptions matched against a
+// payload field say nothing about routing keys, so any subscriber binds all.
+func demandedBindings(src sourceConfig) []string {
+	bindings := src.bindings()
+	counts, all := subscriberCounts()
+	if all > 0 || (len(counts) > 0 && conf().GetString("subscriptions.match") == subscriptionMatchField) {
+		return bindings
+	}
+	var want []string
+	for pattern := range counts {
+		for _, b := range bindings {
+			if topicMatches(b, pattern) {
+				want = append(want, pattern)
+				break
+			}
+			if topicMatches(pattern, b) {
+				want = append(want, b)
+			}
+		}
+	}
+	slices.Sort(want)
+	return slices.Compact(want)
+}
+
+// hasDemand reports whether any client or webhook would receive a message.
+func hasDemand() bool {
+	counts, all := subscriberCounts()
+	return all > 0 || len(counts) > 0
+}
+
+// awaitDemand blocks until hasDemand, checking every
+// subscriptions.demand_interval, and reports false if ctx is done, the sources
+// restart or the connection closes first.
+func awaitDemand(ctx context.Context, restart <-chan struct{}, closed <-chan *amqp.Error) bool {
+	ticker := time.NewTicker(conf().GetDuration("subscriptions.demand_interval"))
+	defer ticker.Stop()
+	for !hasDemand() {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-restart:
+			return false
+		case <-closed:
+			return false
+		case <-ticker.C:
+		}
+	}
+	return true
+}
+
+// idleSignal is closed once an on-demand queue has no subscribers left, and is
+// nil for every other source. It stops checking when stop is closed.
+func idleSignal(src sourceConfig, stop <-chan struct{}) <-chan struct{} {
+	if !src.OnDemand || src.Exchange != "" {
+		return nil
+	}
+	idle := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(conf().GetDuration("subscriptions.demand_interval"))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if !hasDemand() {
+				close(idle)
+				return
+			}
+		}
+	}()
+	return idle
+}
+
+// reconcileBindings keeps an on-demand source's queue bound to the routing
+// keys demandedBindings asks for, until the channel closes.
+func reconcileBindings(ch *amqp.Channel, src sourceConfig) {
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	ticker := time.NewTicker(conf().GetDuration("subscriptions.demand_interval"))
+	defer ticker.Stop()
+	var bound []string
+	for {
+		want := demandedBindings(src)
+		for _, key := range want {
+			if !slices.Contains(bound, key) && bindKey(ch, src, key) != nil {
+				return
+			}
+		}
+		for _, key := range bound {
+			if slices.Contains(want, key) {
+				continue
+			}
+			if err := ch.QueueUnbind(src.Queue, key, src.Exchange, nil); err != nil {
+				log.WithFields(logrus.Fields{
+					"event":       "queue_unbind",
+					"status":      "failed",
+					"queue":       src.Queue,
+					"exchange":    src.Exchange,
+					"routing_key": key,
+					"error":       err.Error(),
+				}).Error("Failed to unbind queue from exchange")
+				return
+			}
+		}
+		if !slices.Equal(bound, want) {
+			log.WithFields(logrus.Fields{
+				"event":    "queue_bind",
+				"status":   "reconciled",
+				"source":   src.Name,
+				"bindings": want,
+			}).Info("Updated on-demand bindings")
+		}
+		bound = want
+
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand/v2"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// runDemoSource feeds synthetic events through the normal relay pipeline in
+// place of RabbitMQ, so the relay can be run locally without a broker. It
+// starts once the instance is active and returns when ctx is done.
+func runDemoSource(ctx context.Context) {
+	if !awaitActive(ctx) {
+		return
+	}
+	rate := conf().GetFloat64("demo.rate")
+	if rate <= 0 {
+		rate = 1
+	}
+	topics := conf().GetStringSlice("demo.topics")
+	if len(topics) == 0 {
+		topics = []string{"demo.events"}
+	}
+	fields := conf().GetStringMapString("demo.fields")
+
+	log.WithFields(logrus.Fields{
+		"event":  "demo_source",
+		"status": "started",
+		"rate":   rate,
+		"topics": topics,
+	}).Info("Demo mode: generating synthetic events instead of consuming RabbitMQ")
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer ticker.Stop()
+
+	for seq := 1; ; seq++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		topic := topics[rand.IntN(len(topics))] //nolint:gosec // synthetic data
+		body, err := json.Marshal(demoEvent(seq, topic, fields))
+		if err != nil {
+			continue
+		}
+		awaitCapacity()
+		dispatchDelivery("demo", amqp.Delivery{
+			RoutingKey:  topic,
+			MessageId:   newID(),
+			AppId:       "event-relay-demo",
+			ContentType: "application/json",
+			Timestamp:   time.Now(),
+			Body:        body,
+		})
+	}
+}
+
+// demoEvent builds a payload whose extra fields follow demo.fields, a map of
+// field name to type: int, float, bool, string or timestamp.
+func demoEvent(seq int, topic string, fields map[string]string) map[string]any {
+	event := map[string]any{
+		"seq":   seq,
+		"topic": topic,
+		"ts":    time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for name, kind := range fields {
+		switch kind {
+		case "int":
+			event[name] = rand.IntN(1000) //nolint:gosec // synthetic data
+		case "float":
+			event[name] = rand.Float64() * 100 //nolint:gosec // synthetic data
+		case "bool":
+			event[name] = rand.IntN(2) == 1 //nolint:gosec // synthetic data
+		case "timestamp":
+			event[name] = time.Now().UTC().Format(time.RFC3339)
+		default:
+			event[name] = newID()[:8]
+		}
+	}
+	return event
+}
@@ -0,0 +1,175 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// flightEvent is one internal event kept by the flight recorder.
+type flightEvent struct {
+	Time    time.Time     `json:"time"`
+	Level   string        `json:"level"`
+	Message string        `json:"msg,omitempty"`
+	Fields  logrus.Fields `json:"fields,omitempty"`
+}
+
+// flightRecorder keeps the most recent internal events in a fixed-size ring
+// so a dump can show what led up to an incident.
+type flightRecorder struct {
+	mu     sync.Mutex
+	events []flightEvent
+	next   int
+	full   bool
+	window time.Duration
+}
+
+// flight is nil unless diagnostics.flight_recorder.enabled is set.
+var flight *flightRecorder
+
+func (f *flightRecorder) record(e flightEvent) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.events[f.next] = e
+	f.next = (f.next + 1) % len(f.events)
+	f.full = f.full || f.next == 0
+	f.mu.Unlock()
+}
+
+// snapshot returns the recorded events within the window, oldest first.
+func (f *flightRecorder) snapshot() []flightEvent {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ordered := append([]flightEvent{}, f.events[:f.next]...)
+	if f.full {
+		ordered = append(append([]flightEvent{}, f.events[f.next:]...), ordered...)
+	}
+	cutoff := time.Now().Add(-f.window)
+	for i, e := range ordered {
+		if e.Time.After(cutoff) {
+			return ordered[i:]
+		}
+	}
+	return nil
+}
+
+// Levels and Fire make the recorder a logrus hook, so everything logged lands
+// in the ring alongside the broadcasts recorded explicitly.
+func (f *flightRecorder) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (f *flightRecorder) Fire(entry *logrus.Entry) error {
+	f.record(flightEvent{Time: entry.Time, Level: entry.Level.String(), Message: entry.Message, Fields: entry.Data})
+	return nil
+}
+
+// recordBroadcast notes a broadcast in the flight recorder; successful
+// broadcasts are only logged at debug level.
+func recordBroadcast(topic string, matched, queued int) {
+	if flight == nil {
+		return
+	}
+	flight.record(flightEvent{
+		Time:   time.Now(),
+		Level:  logrus.DebugLevel.String(),
+		Fields: logrus.Fields{"event": "message_broadcast", "topic": topic, "matched": matched, "queued": queued},
+	})
+}
+
+// startDiagnostics starts the flight recorder and writes a dump whenever the
+// process receives SIGQUIT, instead of Go's default dump-and-exit.
+func startDiagnostics() {
+	if conf().GetBool("diagnostics.flight_recorder.enabled") {
+		flight = &flightRecorder{
+			events: make([]flightEvent, max(conf().GetInt("diagnostics.flight_recorder.max_events"), 1)),
+			window: conf().GetDuration("diagnostics.flight_recorder.window"),
+		}
+		log.AddHook(flight)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	go func() {
+		for range quit {
+			_, _ = writeDump("sigquit")
+		}
+	}()
+}
+
+// writeDump writes goroutine stacks, a heap profile and the flight recorder
+// window to a new file in diagnostics.dump_dir and returns its path.
+func writeDump(reason string) (string, error) {
+	dir := conf().GetString("diagnostics.dump_dir")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	now := time.Now().UTC()
+	path := filepath.Join(dir, fmt.Sprintf("event-relay-%s.dump", now.Format("20060102T150405.000Z")))
+
+	err := func() error {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		w := bufio.NewWriter(f)
+		fmt.Fprintf(w, "event-relay diagnostic dump\ntime: %s\nreason: %s\ninstance: %s\n",
+			now.Format(time.RFC3339Nano), reason, relayInstanceID())
+		fmt.Fprint(w, "\n=== goroutines\n")
+		_ = pprof.Lookup("goroutine").WriteTo(w, 2)
+		fmt.Fprint(w, "\n=== heap\n")
+		_ = pprof.Lookup("heap").WriteTo(w, 1)
+		fmt.Fprint(w, "\n=== flight recorder\n")
+		enc := json.NewEncoder(w)
+		for _, e := range flight.snapshot() {
+			_ = enc.Encode(e)
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		return f.Sync()
+	}()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "diagnostic_dump",
+			"status": "failed",
+			"reason": reason,
+			"error":  err.Error(),
+		}).Error("Failed to write diagnostic dump")
+		return "", err
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":  "diagnostic_dump",
+		"status": "written",
+		"reason": reason,
+		"path":   path,
+	}).Warn("Diagnostic dump written")
+	return path, nil
+}
+
+func handleDump(w http.ResponseWriter, _ *http.Request) {
+	path, err := writeDump("admin")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"path": path})
+}
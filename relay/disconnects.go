@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// disconnectReason is the single taxonomy used for close frames, disconnect
+// logs and the admin API.
+type disconnectReason string
+
+const (
+	reasonAuthExpired     disconnectReason = "auth_expired"
+	reasonSlowConsumer    disconnectReason = "slow_consumer"
+	reasonServerDrain     disconnectReason = "server_drain"
+	reasonPolicyViolation disconnectReason = "policy_violation"
+	reasonIdleTimeout     disconnectReason = "idle_timeout"
+	reasonReplaced        disconnectReason = "replaced"
+	reasonKicked          disconnectReason = "kicked"
+	reasonClientClosed    disconnectReason = "client_closed"
+	reasonConnectionLost  disconnectReason = "connection_lost"
+)
+
+const (
+	closeCodeReplaced     = 4001
+	closeCodeSlowConsumer = 4002
+	closeCodeIdleTimeout  = 4003
+	closeCodeAuthExpired  = 4004
+	closeCodeKicked       = 4005
+)
+
+var (
+	disconnectCounts   = make(map[disconnectReason]int64)
+	disconnectCountsMu sync.Mutex
+)
+
+// closeCode returns the close frame code sent for server-initiated disconnects.
+func (r disconnectReason) closeCode() int {
+	switch r {
+	case reasonAuthExpired:
+		return closeCodeAuthExpired
+	case reasonSlowConsumer:
+		return closeCodeSlowConsumer
+	case reasonServerDrain:
+		if code := conf().GetInt("shutdown.close_code"); code > 0 {
+			return code
+		}
+		return websocket.CloseGoingAway
+	case reasonPolicyViolation:
+		return websocket.ClosePolicyViolation
+	case reasonIdleTimeout:
+		return closeCodeIdleTimeout
+	case reasonReplaced:
+		return closeCodeReplaced
+	case reasonKicked:
+		return closeCodeKicked
+	case reasonClientClosed, reasonConnectionLost:
+		return websocket.CloseNormalClosure
+	}
+	return websocket.CloseInternalServerErr
+}
+
+// retryable reports whether clients should be told when to reconnect.
+// Replaced and expired sessions must not come back on their own.
+func (r disconnectReason) retryable() bool {
+	switch r {
+	case reasonSlowConsumer, reasonServerDrain, reasonPolicyViolation, reasonIdleTimeout:
+		return true
+	case reasonAuthExpired, reasonReplaced, reasonKicked, reasonClientClosed, reasonConnectionLost:
+		return false
+	}
+	return false
+}
+
+// closeClient records why c is closed and closes its connection with a close
+// frame, or ends c's SSE stream. The frame is sent from its own goroutine:
+// WriteControl waits for a write in progress, so a client with a stuck writer
+// would otherwise hold clientsMu, and every broadcast, until its deadline. The
+// reader then sees the closed connection and closes c's queues.
+// Must be called with clientsMu held.
+func closeClient(c *client, reason disconnectReason, detail string) {
+	c.stats.closeReason = reason
+	if c.sse != nil {
+		c.sse.close() // SSE has no close frame; EventSource reconnects after its retry interval
+		return
+	}
+	if c.closing {
+		return
+	}
+	c.closing = true
+	text := string(reason)
+	if detail != "" {
+		text += ": " + detail
+	}
+	if reason.retryable() {
+		seconds := int(suggestedRetryAfter().Round(time.Second) / time.Second)
+		text = fmt.Sprintf("%s; retry_after=%d", text, seconds)
+	}
+	msg := websocket.FormatCloseMessage(reason.closeCode(), text)
+	conn := c.conn
+	go func() {
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+		conn.Close()
+	}()
+}
+
+func recordDisconnect(reason disconnectReason) {
+	disconnectCountsMu.Lock()
+	disconnectCounts[reason]++
+	disconnectCountsMu.Unlock()
+	clientDisconnects.WithLabelValues(string(reason)).Inc()
+}
+
+func handleDisconnects(w http.ResponseWriter, _ *http.Request) {
+	disconnectCountsMu.Lock()
+	view := make(map[disconnectReason]int64, len(disconnectCounts))
+	for reason, n := range disconnectCounts {
+		view[reason] = n
+	}
+	disconnectCountsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
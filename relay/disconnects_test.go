@@ -0,0 +1,64 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stuckClient returns a WebSocket client whose peer never reads, with a write
+// blocked on the full connection.
+func stuckClient(t *testing.T) *client {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+	peer, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	t.Cleanup(func() { peer.Close() })
+	conn := <-conns
+	t.Cleanup(func() { conn.Close() })
+
+	var written atomic.Int64
+	go func() {
+		chunk := make([]byte, 1<<20)
+		for conn.WriteMessage(websocket.BinaryMessage, chunk) == nil {
+			written.Add(1)
+		}
+	}()
+	for last := int64(-1); last != written.Load(); {
+		last = written.Load()
+		time.Sleep(100 * time.Millisecond)
+	}
+	return &client{conn: conn}
+}
+
+func TestCloseClientDoesNotWaitForStuckWriter(t *testing.T) {
+	c := stuckClient(t)
+	start := time.Now()
+	clientsMu.Lock()
+	closeClient(c, reasonSlowConsumer, "send queue full")
+	closeClient(c, reasonServerDrain, "")
+	clientsMu.Unlock()
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("closeClient() held clientsMu for %s behind a stuck write", elapsed)
+	}
+	if !c.closing || c.stats.closeReason != reasonServerDrain {
+		t.Errorf("closing = %v with reason %q, want closing with %q", c.closing, c.stats.closeReason, reasonServerDrain)
+	}
+}
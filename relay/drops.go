@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dropReason labels why a message was not delivered.
+type dropReason string
+
+const (
+	dropQueueFull   dropReason = "queue_full"
+	dropSize        dropReason = "size"
+	dropDedup       dropReason = "dedup"
+	dropMute        dropReason = "mute"
+	dropWriteFailed dropReason = "write_failed"
+	dropCircuitOpen dropReason = "circuit_open"
+	dropTransform   dropReason = "transform"
+	dropRateLimited dropReason = "rate_limited"
+	// Skips of a message one subscribed client doesn't get.
+	dropFiltered dropReason = "filtered"
+	dropSampled  dropReason = "sampled"
+	dropDegraded dropReason = "degraded"
+)
+
+type dropKey struct {
+	reason dropReason
+	topic  string
+}
+
+type dropView struct {
+	Reason dropReason `json:"reason"`
+	Topic  string     `json:"topic"`
+	Count  int64      `json:"count"`
+}
+
+var (
+	dropCounts   = make(map[dropKey]int64)
+	dropCountsMu sync.Mutex
+)
+
+// recordDrop counts a dropped message and, for a drops.log_sample_rate share
+// of drops, emits a structured log with the caller's context.
+func recordDrop(reason dropReason, topic string, fields logrus.Fields) {
+	dropCountsMu.Lock()
+	dropCounts[dropKey{reason: reason, topic: topic}]++
+	dropCountsMu.Unlock()
+	messageDrops.WithLabelValues(string(reason), metricTopic(topic)).Inc()
+	countDropOutcome(reason)
+
+	rate := conf().GetFloat64("drops.log_sample_rate")
+	if rate > 0 && rand.Float64() < rate { //nolint:gosec // sampling doesn't need a secure source
+		entry := log.WithFields(logrus.Fields{
+			"event":  "message_drop",
+			"status": "dropped",
+			"reason": reason,
+			"topic":  topic,
+		})
+		entry.WithFields(fields).Warn("Message dropped")
+	}
+}
+
+func handleDrops(w http.ResponseWriter, _ *http.Request) {
+	dropCountsMu.Lock()
+	views := make([]dropView, 0, len(dropCounts))
+	for key, n := range dropCounts {
+		views = append(views, dropView{Reason: key.reason, Topic: key.topic, Count: n})
+	}
+	dropCountsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, views)
+}
@@ -0,0 +1,45 @@
+package relay
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func dropCount(reason dropReason, topic string) int64 {
+	dropCountsMu.Lock()
+	defer dropCountsMu.Unlock()
+	return dropCounts[dropKey{reason: reason, topic: topic}]
+}
+
+func TestBroadcastRecordsSkips(t *testing.T) {
+	useConfig(t, "filters:\n  enabled: true\n")
+	const topic = "skips.a"
+	filter, err := compileFilter(`topic == "skips.b"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drained := newTokenBucket(1.0/3600, 1)
+	drained.Allow()
+	subscribed := []string{"skips.#"}
+
+	registerClient(t, &client{id: "filtered", subscriptions: subscribed, filter: filter})
+	registerClient(t, &client{id: "sampled", subscriptions: subscribed,
+		options: map[string]subscriptionOptions{"skips.#": {limiter: drained}}})
+	registerClient(t, &client{id: "degraded", subscriptions: subscribed, degradedAt: time.Now()})
+	registerClient(t, &client{id: "elsewhere", subscriptions: []string{"other.#"}})
+
+	before := map[dropReason]int64{}
+	for _, reason := range []dropReason{dropFiltered, dropSampled, dropDegraded} {
+		before[reason] = dropCount(reason, topic)
+	}
+	matched, queued := broadcastMessage(context.Background(), topic, outbound{key: topic, frame: []byte(`{}`)}, nil)
+	if matched != 2 || queued != 0 {
+		t.Errorf("broadcastMessage() = %d matched, %d queued, want 2 and 0", matched, queued)
+	}
+	for reason, n := range before {
+		if got := dropCount(reason, topic) - n; got != 1 {
+			t.Errorf("recorded %d %s drops, want 1", got, reason)
+		}
+	}
+}
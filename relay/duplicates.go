@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Any other duplicate_policy value, including "allow", permits duplicates.
+const (
+	duplicatePolicyReplace = "replace"
+	duplicatePolicyReject  = "reject"
+)
+
+// clientID returns the identity a connection is deduplicated by.
+func clientID(r *http.Request) string {
+	return r.URL.Query().Get("client_id")
+}
+
+// rejectDuplicate reports whether the upgrade must be refused because a client
+// with the same identity is already connected under the reject policy; see
+// sameIdentity. It lets a duplicate be refused with a status before the
+// upgrade; addClient settles connections that race past it.
+func rejectDuplicate(tenant, subject, id string) bool {
+	if (id == "" && subject == "") || conf().GetString("server.duplicate_policy") != duplicatePolicyReject {
+		return false
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return findClientByID(tenant, subject, id) != nil
+}
+
+// addClient registers c, replacing connections that share its identity under
+// the replace policy. Under the reject policy it reports false and leaves c
+// unregistered if one is already connected. Checking and registering in one
+// critical section keeps two connections with the same identity from both
+// getting in. Must be called with clientsMu held.
+func addClient(c *client) bool {
+	if (c.id != "" || c.subject != "") && conf().GetString("server.duplicate_policy") == duplicatePolicyReject &&
+		findClientByID(c.tenant, c.subject, c.id) != nil {
+		log.WithFields(logrus.Fields{
+			"event":     "websocket_duplicate",
+			"status":    "rejected",
+			"client_id": c.id,
+			"client":    c.remoteAddr,
+		}).Warn("Rejected connection that raced an already connected client ID")
+		return false
+	}
+	replaceDuplicates(c)
+	clients[c] = struct{}{}
+	return true
+}
+
+// replaceDuplicates closes connections sharing c's identity under the replace
+// policy. Must be called with clientsMu held, before c is registered.
+func replaceDuplicates(c *client) {
+	if (c.id == "" && c.subject == "") || conf().GetString("server.duplicate_policy") != duplicatePolicyReplace {
+		return
+	}
+	for old := range clients {
+		if !old.sameIdentity(c.tenant, c.subject, c.id) {
+			continue
+		}
+		log.WithFields(logrus.Fields{
+			"event":      "websocket_duplicate",
+			"status":     "replaced",
+			"client_id":  c.id,
+			"client":     old.remoteAddr,
+			"new_client": c.remoteAddr,
+		}).Info("Replacing existing connection with the same client ID")
+
+		closeClient(old, reasonReplaced, "new connection with the same client_id")
+		delete(clients, old)
+	}
+}
+
+func findClientByID(tenant, subject, id string) *client {
+	for c := range clients {
+		if c.sameIdentity(tenant, subject, id) {
+			return c
+		}
+	}
+	return nil
+}
+
+// sameIdentity reports whether c is a session of the identity given by tenant,
+// authenticated subject and client_id. A client_id names one of the subject's
+// sessions; a connection without one stands for all of them, so leaving it out
+// doesn't get around the duplicate policy. Anonymous clients are only matched
+// by client_id.
+func (c *client) sameIdentity(tenant, subject, id string) bool {
+	if c.tenant != tenant || c.subject != subject {
+		return false
+	}
+	if id == "" || c.id == "" {
+		return subject != ""
+	}
+	return c.id == id
+}
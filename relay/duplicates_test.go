@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// registerClient registers a bare client for the rest of the test.
+func registerClient(t *testing.T, c *client) {
+	t.Helper()
+	clientsMu.Lock()
+	clients[c] = struct{}{}
+	clientsMu.Unlock()
+	t.Cleanup(func() {
+		clientsMu.Lock()
+		delete(clients, c)
+		clientsMu.Unlock()
+	})
+}
+
+func TestRejectDuplicate(t *testing.T) {
+	registerClient(t, &client{id: "dup", tenant: "acme", subject: "alice"})
+	registerClient(t, &client{tenant: "acme", subject: "carol"})
+	registerClient(t, &client{id: "anon", tenant: "acme"})
+
+	tests := []struct {
+		policy, tenant, subject, id string
+		want                        bool
+	}{
+		{"reject", "acme", "alice", "dup", true},
+		{"reject", "other", "alice", "dup", false},
+		{"reject", "acme", "bob", "dup", false},
+		{"reject", "acme", "alice", "fresh", false},
+		{"reject", "acme", "alice", "", true},
+		{"reject", "acme", "carol", "", true},
+		{"reject", "acme", "carol", "fresh", true},
+		{"reject", "other", "carol", "", false},
+		{"reject", "acme", "", "anon", true},
+		{"reject", "acme", "", "", false},
+		{"replace", "acme", "alice", "dup", false},
+		{"allow", "acme", "alice", "dup", false},
+	}
+	for _, tt := range tests {
+		useConfig(t, "server:\n  duplicate_policy: "+tt.policy+"\n")
+		if got := rejectDuplicate(tt.tenant, tt.subject, tt.id); got != tt.want {
+			t.Errorf("%s policy: rejectDuplicate(%q, %q, %q) = %v, want %v",
+				tt.policy, tt.tenant, tt.subject, tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestAddClientRejectsRacingDuplicates(t *testing.T) {
+	useConfig(t, "server:\n  duplicate_policy: reject\n")
+	const connections = 20
+	var (
+		wg    sync.WaitGroup
+		added atomic.Int32
+	)
+	for range connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := &client{id: "racer", tenant: "acme", subject: "alice"}
+			clientsMu.Lock()
+			ok := addClient(c)
+			clientsMu.Unlock()
+			if ok {
+				added.Add(1)
+				t.Cleanup(func() {
+					clientsMu.Lock()
+					delete(clients, c)
+					clientsMu.Unlock()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if n := added.Load(); n != 1 {
+		t.Errorf("addClient() registered %d of %d racing duplicates, want 1", n, connections)
+	}
+}
+
+func TestReplaceDuplicates(t *testing.T) {
+	useConfig(t, "server:\n  duplicate_policy: replace\n")
+	old := &client{id: "dup", tenant: "acme", subject: "alice", sse: &sseStream{done: make(chan struct{})}}
+	otherTenant := &client{id: "dup", tenant: "other", subject: "alice", sse: &sseStream{done: make(chan struct{})}}
+	otherSubject := &client{id: "dup", tenant: "acme", subject: "bob", sse: &sseStream{done: make(chan struct{})}}
+	registerClient(t, old)
+	registerClient(t, otherTenant)
+	registerClient(t, otherSubject)
+
+	clientsMu.Lock()
+	replaceDuplicates(&client{id: "dup", tenant: "acme", subject: "alice"})
+	_, oldKept := clients[old]
+	_, otherKept := clients[otherTenant]
+	_, otherSubjectKept := clients[otherSubject]
+	clientsMu.Unlock()
+
+	if oldKept || old.stats.closeReason != reasonReplaced {
+		t.Errorf("duplicate in the same tenant wasn't replaced: registered %v, close reason %q",
+			oldKept, old.stats.closeReason)
+	}
+	if !otherKept {
+		t.Error("client with the same ID in another tenant was replaced")
+	}
+	if !otherSubjectKept {
+		t.Error("client with the same ID under another subject was replaced")
+	}
+}
+
+func TestReplaceDuplicatesWithoutClientID(t *testing.T) {
+	useConfig(t, "server:\n  duplicate_policy: replace\n")
+	tests := []struct {
+		name     string
+		old      *client
+		replaced bool
+	}{
+		{"same subject", &client{id: "tab-1", tenant: "acme", subject: "alice"}, true},
+		{"other subject", &client{id: "tab-1", tenant: "acme", subject: "bob"}, false},
+		{"anonymous", &client{tenant: "acme"}, false},
+	}
+	for _, tt := range tests {
+		tt.old.sse = &sseStream{done: make(chan struct{})}
+		registerClient(t, tt.old)
+	}
+
+	clientsMu.Lock()
+	replaceDuplicates(&client{tenant: "acme", subject: "alice"})
+	for _, tt := range tests {
+		if _, kept := clients[tt.old]; kept == tt.replaced {
+			t.Errorf("%s: replaced %v, want %v", tt.name, !kept, tt.replaced)
+		}
+	}
+	clientsMu.Unlock()
+}
@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type lookupConfig struct {
+	Name        string `mapstructure:"name"`
+	File        string `mapstructure:"file"`
+	KeyField    string `mapstructure:"key_field"`
+	TargetField string `mapstructure:"target_field"`
+}
+
+type lookupTable struct {
+	lookupConfig
+	rows map[string]map[string]string
+}
+
+func readLookups(cfg *viper.Viper) ([]lookupTable, error) {
+	var configs []lookupConfig
+	if err := cfg.UnmarshalKey("enrichment.lookups", &configs); err != nil {
+		return nil, err
+	}
+
+	tables := make([]lookupTable, 0, len(configs))
+	for _, c := range configs {
+		rows, err := readLookupCSV(c.File)
+		if err != nil {
+			return nil, fmt.Errorf("lookup %q: %w", c.Name, err)
+		}
+		tables = append(tables, lookupTable{lookupConfig: c, rows: rows})
+
+		log.WithFields(logrus.Fields{
+			"event":  "enrichment_load",
+			"status": "success",
+			"lookup": c.Name,
+			"rows":   len(rows),
+		}).Info("Lookup table loaded")
+	}
+	return tables, nil
+}
+
+// readLookupCSV indexes a CSV file by its first column. The header row names
+// the fields of each joined record.
+func readLookupCSV(path string) (map[string]map[string]string, error) {
+	f, err := os.Open(path) //nolint:gosec // path comes from operator config
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%s has no header row", path)
+	}
+
+	header := records[0]
+	rows := make(map[string]map[string]string, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header)-1)
+		for i := 1; i < len(header) && i < len(record); i++ {
+			row[header[i]] = record[i]
+		}
+		rows[record[0]] = row
+	}
+	return rows, nil
+}
+
+// enrichPayload joins a JSON object payload against lookup tables and
+// returns the names of the lookups that matched. Payloads that aren't JSON
+// objects, or have no matches, pass through.
+func enrichPayload(lookups []lookupTable, body []byte) ([]byte, []string) {
+	if len(lookups) == 0 {
+		return body, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return body, nil
+	}
+
+	var applied []string
+	for _, table := range lookups {
+		key, ok := lookupField(doc, table.KeyField)
+		if !ok {
+			continue
+		}
+		if row, found := table.rows[key]; found {
+			doc[table.TargetField] = row
+			applied = append(applied, table.Name)
+		}
+	}
+	if applied == nil {
+		return body, nil
+	}
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return body, nil
+	}
+	return out, applied
+}
+
+// lookupField resolves a dotted path such as "device.id" to a string value.
+func lookupField(doc map[string]any, path string) (string, bool) {
+	var cur any = doc
+	for _, part := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if cur, ok = m[part]; !ok {
+			return "", false
+		}
+	}
+	switch v := cur.(type) {
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+type envelope struct {
+	ID       string            `json:"id,omitempty"`
+	Topic    string            `json:"topic"`
+	Metadata *envelopeMetadata `json:"metadata,omitempty"`
+	Payload  json.RawMessage   `json:"payload"`
+	// PayloadEncoding is set when Payload is a base64 string of the payload
+	// compressed with it.
+	PayloadEncoding string              `json:"payload_encoding,omitempty"`
+	Attachment      *envelopeAttachment `json:"attachment,omitempty"`
+	Signature       *envelopeSignature  `json:"signature,omitempty"`
+	Trace           []traceHop          `json:"_trace,omitempty"`
+}
+
+// envelopeAttachment links an envelope to the binary frame that follows it.
+type envelopeAttachment struct {
+	ID          string `json:"id"`
+	ContentType string `json:"content_type,omitempty"`
+	Size        int    `json:"size"`
+}
+
+// outbound holds the frames relayed for one delivery. Clients that accept
+// binary frames get link followed by attachment instead of frame. key is what
+// client subscriptions are matched against, and project re-encodes the
+// delivery with only the given payload fields. id is the replay buffer event
+// ID, empty when replay is off. payload decodes the body for client filters,
+// and prepared is frame encoded once for every WebSocket client.
+type outbound struct {
+	frame      []byte
+	link       []byte
+	attachment []byte
+	key        string
+	id         string
+	project    func(fields []string) outbound
+	payload    func() any
+	prepared   func() *websocket.PreparedMessage
+}
+
+type envelopeSignature struct {
+	KeyID string `json:"key_id"`
+	Alg   string `json:"alg"`
+	Value string `json:"value"`
+}
+
+type envelopeMetadata struct {
+	Source        string         `json:"source,omitempty"`
+	MessageID     string         `json:"message_id,omitempty"`
+	AppID         string         `json:"app_id,omitempty"`
+	CorrelationID string         `json:"correlation_id,omitempty"`
+	Timestamp     *time.Time     `json:"timestamp,omitempty"`
+	Headers       map[string]any `json:"headers,omitempty"`
+}
+
+// encodeMessage returns the frame delivered to clients for a delivery: the raw
+// body, or a JSON envelope with the event ID, producer metadata and any hop
+// trace when envelopes are enabled.
+func encodeMessage(msg amqp.Delivery, source, id string, trace []traceHop) []byte {
+	if !conf().GetBool("envelope.enabled") {
+		return msg.Body
+	}
+
+	payload := json.RawMessage(msg.Body)
+	if !json.Valid(msg.Body) {
+		payload, _ = json.Marshal(string(msg.Body))
+	}
+	return marshalEnvelope(msg, envelope{
+		ID:       id,
+		Topic:    msg.RoutingKey,
+		Metadata: deliveryMetadata(msg, source),
+		Payload:  payload,
+		Trace:    trace,
+	})
+}
+
+// encodeOutbound prepares every frame variant for a delivery. Non-JSON bodies
+// additionally get a link envelope and a binary attachment frame when
+// envelope.binary_attachments is on.
+func encodeOutbound(msg amqp.Delivery, source, id string, trace []traceHop) outbound {
+	out := outbound{
+		frame: encodeMessage(msg, source, id, trace),
+		key:   subscriptionKey(msg.RoutingKey, msg.Body),
+		id:    id,
+	}
+	out.prepared = prepareFrame(out.frame)
+	if !conf().GetBool("envelope.enabled") || !conf().GetBool("envelope.binary_attachments") || json.Valid(msg.Body) {
+		return out
+	}
+
+	attachmentID := msg.MessageId
+	if attachmentID == "" {
+		attachmentID = newID()
+	}
+	out.link = marshalEnvelope(msg, envelope{
+		ID:         id,
+		Topic:      msg.RoutingKey,
+		Metadata:   deliveryMetadata(msg, source),
+		Payload:    json.RawMessage("null"),
+		Attachment: &envelopeAttachment{ID: attachmentID, ContentType: msg.ContentType, Size: len(msg.Body)},
+		Trace:      trace,
+	})
+	out.attachment = msg.Body
+	return out
+}
+
+func marshalEnvelope(msg amqp.Delivery, env envelope) []byte {
+	if key := currentSigningKey(time.Now()); key != nil {
+		signed := env.Payload
+		if env.Attachment != nil {
+			signed = msg.Body
+		}
+		env.Signature = &envelopeSignature{KeyID: key.ID, Alg: "hmac-sha256", Value: signHMAC(key.Secret, signed)}
+	}
+	if env.Attachment == nil {
+		env.Payload, env.PayloadEncoding = compressPayload(env.Payload)
+	}
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "envelope_encode",
+			"status": "failed",
+			"topic":  msg.RoutingKey,
+			"error":  err.Error(),
+		}).Error("Failed to encode envelope, relaying raw body")
+		return msg.Body
+	}
+	return data
+}
+
+func deliveryMetadata(msg amqp.Delivery, source string) *envelopeMetadata {
+	md := &envelopeMetadata{
+		Source:        source,
+		MessageID:     msg.MessageId,
+		AppID:         msg.AppId,
+		CorrelationID: msg.CorrelationId,
+	}
+	if !msg.Timestamp.IsZero() {
+		ts := msg.Timestamp.UTC()
+		md.Timestamp = &ts
+	}
+
+	allowed := conf().GetStringSlice("envelope.headers")
+	for name, value := range msg.Headers {
+		if !headerAllowed(allowed, name) {
+			continue
+		}
+		if md.Headers == nil {
+			md.Headers = make(map[string]any)
+		}
+		md.Headers[name] = value
+	}
+
+	if md.Source == "" && md.MessageID == "" && md.AppID == "" && md.CorrelationID == "" &&
+		md.Timestamp == nil && md.Headers == nil {
+		return nil
+	}
+	return md
+}
+
+// headerAllowed matches name against the allowlist; an entry ending in "*"
+// matches any header with that prefix.
+func headerAllowed(allowed []string, name string) bool {
+	for _, a := range allowed {
+		if prefix, ok := strings.CutSuffix(a, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if a == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// escalationDeadline bounds a single WebSocket write when escalation is on, so
+// a client that stops reading entirely fails its write after the grace period
+// instead of holding its writer forever.
+func escalationDeadline() time.Duration {
+	if !conf().GetBool("clients.escalation.enabled") {
+		return 0
+	}
+	return conf().GetDuration("clients.escalation.write_deadline") + conf().GetDuration("clients.escalation.grace")
+}
+
+// behind reports whether c is falling behind: its last write took longer than
+// clients.escalation.write_deadline or its send queue holds at least
+// behind_depth frames. Must be called with clientsMu held.
+func (c *client) behind(elapsed time.Duration) bool {
+	depth := conf().GetInt("clients.escalation.behind_depth")
+	return elapsed > conf().GetDuration("clients.escalation.write_deadline") ||
+		(depth > 0 && c.queues.depth() >= depth)
+}
+
+// escalate applies the two-stage slow client response after each write and
+// before each broadcast frame is queued, which catches a stuck write. A
+// client that falls behind is degraded to priority topics only; one still
+// behind after clients.escalation.grace is disconnected as a slow consumer,
+// and one that drains its queue is restored. It reports false once c is
+// disconnected. Must be called with clientsMu held.
+func (c *client) escalate(elapsed time.Duration) bool {
+	if !conf().GetBool("clients.escalation.enabled") {
+		return true
+	}
+	behind := c.behind(elapsed)
+	fields := logrus.Fields{
+		"event":       "slow_client",
+		"client":      c.remoteAddr,
+		"client_id":   c.id,
+		"write_ms":    elapsed.Milliseconds(),
+		"queue_depth": c.queues.depth(),
+	}
+
+	switch {
+	case c.degradedAt.IsZero():
+		if !behind {
+			return true
+		}
+		c.degradedAt = time.Now()
+		fields["status"] = "degraded"
+		log.WithFields(fields).Warn("Client falling behind, sending priority topics only")
+		c.announceEscalation("degraded", conf().GetStringSlice("topics.priority"))
+	case behind && time.Since(c.degradedAt) >= conf().GetDuration("clients.escalation.grace"):
+		fields["status"] = "disconnected"
+		fields["degraded_for_s"] = time.Since(c.degradedAt).Seconds()
+		log.WithFields(fields).Warn("Client still behind after grace period, disconnecting slow consumer")
+		closeClient(c, reasonSlowConsumer, "still behind after priority-only grace period")
+		delete(clients, c)
+		return false
+	case !behind && len(c.queues.normal) == 0:
+		fields["status"] = "restored"
+		fields["degraded_for_s"] = time.Since(c.degradedAt).Seconds()
+		c.degradedAt = time.Time{}
+		log.WithFields(fields).Info("Client caught up, restoring its subscriptions")
+		c.announceEscalation("restored", c.subscriptions)
+	}
+	return true
+}
+
+// degraded reports whether c currently only gets priority topics.
+// Must be called with clientsMu held.
+func (c *client) degraded() bool {
+	return !c.degradedAt.IsZero()
+}
+
+// announceEscalation tells c which topics it gets from now on.
+// Must be called with clientsMu held.
+func (c *client) announceEscalation(kind string, topics []string) {
+	frame, _ := json.Marshal(controlReply{
+		Type:       kind,
+		Topics:     topics,
+		Reason:     string(reasonSlowConsumer),
+		ServerTime: time.Now().UTC(),
+	})
+	c.enqueue(queuedFrame{out: outbound{frame: frame}, control: true}, true)
+}
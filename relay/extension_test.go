@@ -0,0 +1,149 @@
+package relay_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/reaport/event-relay/relay"
+	"github.com/streadway/amqp"
+)
+
+// Extensions registered from outside the package, as an embedding program would.
+var (
+	authenticatorBuilt = make(chan struct{}, 1)
+	backplaneData      = make(chan []byte, 16)
+)
+
+type headerAuth struct{}
+
+func (headerAuth) ValidateUpgrade(r *http.Request) (relay.Identity, error) {
+	if r.Header.Get("X-User") == "" {
+		return relay.Identity{}, errors.New("no X-User header")
+	}
+	return relay.Identity{Subject: r.Header.Get("X-User")}, nil
+}
+
+type feedSource struct{}
+
+func (feedSource) Run(ctx context.Context) {
+	relay.ExpectSource("feed")
+	relay.MarkSourceReady("feed")
+	relay.Dispatch("feed", amqp.Delivery{RoutingKey: "ext.orders", ContentType: "application/json", Body: []byte(`{}`)})
+	<-ctx.Done()
+}
+
+type loopBackplane struct{}
+
+func (loopBackplane) Publish(_ context.Context, data []byte) error {
+	select {
+	case backplaneData <- data:
+	default:
+	}
+	return nil
+}
+
+func (loopBackplane) Subscribe(ctx context.Context, _ func(data []byte)) error {
+	relay.MarkSourceReady(relay.BackplaneHealth)
+	<-ctx.Done()
+	return nil
+}
+
+func (loopBackplane) Close() error { return nil }
+
+func init() {
+	relay.RegisterAuthenticator("header", func() (relay.Authenticator, error) {
+		select {
+		case authenticatorBuilt <- struct{}{}:
+		default:
+		}
+		return headerAuth{}, nil
+	})
+	relay.RegisterSource("feed", func() (relay.Source, error) { return feedSource{}, nil })
+	relay.RegisterBackplane("loop", func() (relay.Backplane, error) { return loopBackplane{}, nil })
+}
+
+// TestExternalExtensions runs a whole relay, which can only be created once and
+// leaves process-wide state behind, so it reruns the test binary for it.
+func TestExternalExtensions(t *testing.T) {
+	if os.Getenv("RELAY_TEST_EXTENSIONS") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestExternalExtensions$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "RELAY_TEST_EXTENSIONS=1")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		return
+	}
+	messages := make(chan relay.MessageInfo, 1)
+	r, err := relay.New(relay.Config{
+		File: filepath.Join("..", "config.yaml"),
+		Settings: map[string]any{
+			"server.port":    "0",
+			"log.file_path":  filepath.Join(t.TempDir(), "relay.log"),
+			"log.level":      "error",
+			"auth.provider":  "header",
+			"source.type":    "feed",
+			"backplane.type": "loop",
+		},
+		OnMessage: func(info relay.MessageInfo) {
+			select {
+			case messages <- info:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		r.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		select {
+		case <-stopped:
+		case <-time.After(30 * time.Second):
+			t.Error("Run didn't return after ctx was cancelled")
+		}
+	}()
+
+	timeout := time.After(5 * time.Second)
+	for _, step := range []struct {
+		name string
+		done <-chan struct{}
+	}{
+		{"authenticator built", authenticatorBuilt},
+		{"delivery relayed", received(messages, func(info relay.MessageInfo) bool {
+			return info.Source == "feed" && info.Topic == "ext.orders"
+		})},
+		{"delivery published to the backplane", received(backplaneData, func([]byte) bool { return true })},
+	} {
+		select {
+		case <-step.done:
+		case <-timeout:
+			t.Fatalf("timed out waiting for: %s", step.name)
+		}
+	}
+}
+
+// received closes the returned channel once ch yields a value that matches.
+func received[T any](ch <-chan T, matches func(T) bool) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		for v := range ch {
+			if matches(v) {
+				close(done)
+				return
+			}
+		}
+	}()
+	return done
+}
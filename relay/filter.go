@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
+)
+
+// messageFilter is a client's compiled ?filter= expression, such as
+// payload.airport == "SVO" && topic startsWith "flights.".
+type messageFilter struct {
+	source  string
+	program *vm.Program
+}
+
+// filterEnv is what a filter expression can refer to.
+type filterEnv struct {
+	Topic   string `expr:"topic"`
+	Payload any    `expr:"payload"`
+}
+
+// compileFilter compiles a filter expression, returning nil for an empty one.
+func compileFilter(source string) (*messageFilter, error) {
+	if source == "" {
+		return nil, nil
+	}
+	if !conf().GetBool("filters.enabled") {
+		return nil, errors.New("filters are disabled")
+	}
+	if limit := conf().GetInt("filters.max_length"); limit > 0 && len(source) > limit {
+		return nil, fmt.Errorf("filter is longer than %d characters", limit)
+	}
+	nodes := &nodeCounter{}
+	program, err := expr.Compile(source, expr.Env(filterEnv{}), expr.AsBool(), expr.Patch(nodes))
+	if err != nil {
+		return nil, err
+	}
+	if limit := conf().GetInt("filters.max_nodes"); limit > 0 && nodes.n > limit {
+		return nil, fmt.Errorf("filter has more than %d nodes", limit)
+	}
+	return &messageFilter{source: source, program: program}, nil
+}
+
+// nodeCounter counts the nodes of a filter's syntax tree. Filters run for
+// every matching client under clientsMu, so filters.max_nodes caps how much
+// work one can add to a broadcast.
+type nodeCounter struct {
+	n int
+}
+
+func (c *nodeCounter) Visit(*ast.Node) { c.n++ }
+
+// accepts reports whether a message passes f. A nil filter accepts everything;
+// an expression that fails to evaluate, e.g. on a payload that isn't JSON,
+// rejects the message.
+func (f *messageFilter) accepts(topic string, out outbound) bool {
+	if f == nil {
+		return true
+	}
+	env := filterEnv{Topic: topic}
+	if out.payload != nil {
+		env.Payload = out.payload()
+	}
+	result, err := expr.Run(f.program, env)
+	return err == nil && result == true
+}
+
+// decodedPayload returns body decoded as JSON on first use, so only
+// deliveries some client filters on are parsed. Bodies that aren't JSON
+// decode to nil.
+func decodedPayload(body []byte) func() any {
+	return sync.OnceValue(func() any {
+		var doc any
+		if json.Unmarshal(body, &doc) != nil {
+			return nil
+		}
+		return doc
+	})
+}
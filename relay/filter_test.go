@@ -0,0 +1,24 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCompileFilterNodeBudget(t *testing.T) {
+	useConfig(t, "filters:\n  enabled: true\n  max_length: 4096\n  max_nodes: 10\n")
+	tests := []struct {
+		source string
+		ok     bool
+	}{
+		{`topic == "a.b"`, true},
+		{`payload.airport == "SVO" && topic startsWith "flights."`, true},
+		{strings.Repeat(`topic == "a" || `, 10) + `false`, false},
+	}
+	for _, tt := range tests {
+		_, err := compileFilter(tt.source)
+		if (err == nil) != tt.ok {
+			t.Errorf("compileFilter(%q) error = %v, want ok %v", tt.source, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// goroutineBudget accounts goroutines spawned on behalf of connections
+// (reader, writer, pinger, RPC waiters) against a global and per-client cap.
+type goroutineBudget struct {
+	mu        sync.Mutex
+	total     int
+	perClient map[*client]map[string]int
+}
+
+var goroutines = &goroutineBudget{perClient: make(map[*client]map[string]int)}
+
+type clientGoroutinesView struct {
+	Client     string         `json:"client"`
+	ClientID   string         `json:"client_id,omitempty"`
+	Tenant     string         `json:"tenant,omitempty"`
+	Goroutines map[string]int `json:"goroutines"`
+}
+
+type goroutinesView struct {
+	Total          int                    `json:"total"`
+	Limit          int                    `json:"limit"`
+	PerClientLimit int                    `json:"per_client_limit"`
+	Runtime        int                    `json:"runtime"`
+	Clients        []clientGoroutinesView `json:"clients"`
+}
+
+// acquire reserves a goroutine of the given role for c and reports whether the
+// global and per-client budgets allowed it.
+func (b *goroutineBudget) acquire(c *client, role string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if limit := conf().GetInt("goroutines.max_total"); limit > 0 && b.total >= limit {
+		return false
+	}
+	roles := b.perClient[c]
+	if limit := conf().GetInt("goroutines.max_per_client"); limit > 0 && sumRoles(roles) >= limit {
+		return false
+	}
+	if roles == nil {
+		roles = make(map[string]int)
+		b.perClient[c] = roles
+	}
+	roles[role]++
+	b.total++
+	return true
+}
+
+func (b *goroutineBudget) release(c *client, role string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	roles := b.perClient[c]
+	if roles[role] == 0 {
+		return
+	}
+	roles[role]--
+	b.total--
+	if roles[role] == 0 {
+		delete(roles, role)
+	}
+	if len(roles) == 0 {
+		delete(b.perClient, c)
+	}
+}
+
+func sumRoles(roles map[string]int) int {
+	n := 0
+	for _, count := range roles {
+		n += count
+	}
+	return n
+}
+
+// admitGoroutine reserves the reader and writer goroutines for a new
+// connection. When the budget is exhausted it responds 503 with a jittered
+// Retry-After and returns false.
+func admitGoroutine(w http.ResponseWriter, c *client) bool {
+	if goroutines.acquire(c, "reader") {
+		if goroutines.acquire(c, "writer") {
+			return true
+		}
+		goroutines.release(c, "reader")
+	}
+	delay := suggestedRetryAfter()
+	seconds := int(delay.Round(time.Second) / time.Second)
+
+	log.WithFields(logrus.Fields{
+		"event":       "goroutine_budget",
+		"status":      "rejected",
+		"client":      c.remoteAddr,
+		"retry_after": seconds,
+	}).Warn("Goroutine budget exhausted, rejecting connection")
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "server busy, retry later", http.StatusServiceUnavailable)
+	return false
+}
+
+func handleGoroutines(w http.ResponseWriter, _ *http.Request) {
+	goroutines.mu.Lock()
+	view := goroutinesView{
+		Total:          goroutines.total,
+		Limit:          conf().GetInt("goroutines.max_total"),
+		PerClientLimit: conf().GetInt("goroutines.max_per_client"),
+		Runtime:        runtime.NumGoroutine(),
+		Clients:        make([]clientGoroutinesView, 0, len(goroutines.perClient)),
+	}
+	for c, roles := range goroutines.perClient {
+		counts := make(map[string]int, len(roles))
+		for role, n := range roles {
+			counts[role] = n
+		}
+		view.Clients = append(view.Clients, clientGoroutinesView{
+			Client:     c.remoteAddr,
+			ClientID:   c.id,
+			Tenant:     c.tenant,
+			Goroutines: counts,
+		})
+	}
+	goroutines.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
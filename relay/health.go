@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/streadway/amqp"
+)
+
+var (
+	// sourceHealth maps each expected source to why it isn't ready, or "" once
+	// its connection and channel are open.
+	sourceHealth   = make(map[string]string)
+	sourceHealthMu sync.Mutex
+
+	wsBound  atomic.Bool
+	draining atomic.Bool
+)
+
+// ExpectSource registers a source that must be connected for the relay to be
+// ready. Sources that are never expected, such as the demo generator, don't
+// affect readiness.
+func ExpectSource(name string) {
+	MarkSourceDown(name, "connecting")
+}
+
+// MarkSourceReady reports an expected source connected.
+func MarkSourceReady(name string) {
+	sourceHealthMu.Lock()
+	sourceHealth[name] = ""
+	sourceHealthMu.Unlock()
+}
+
+// MarkSourceDown reports an expected source not ready, and why, on /readyz.
+func MarkSourceDown(name, reason string) {
+	sourceHealthMu.Lock()
+	sourceHealth[name] = reason
+	sourceHealthMu.Unlock()
+}
+
+// watchSource marks the source ready and keeps it so until its connection or
+// channel closes, including when the broker drops them without a delivery
+// error reaching the consumer.
+func watchSource(name string, conn *amqp.Connection, ch *amqp.Channel) {
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	chClosed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	MarkSourceReady(name)
+	go func() {
+		reason := "channel closed"
+		select {
+		case <-connClosed:
+			reason = "connection closed"
+		case <-chClosed:
+		}
+		MarkSourceDown(name, reason)
+	}()
+}
+
+// markListenerBound records a bound listener; only one serving the ws group
+// counts towards readiness.
+func markListenerBound(l listenerConfig) {
+	if len(l.Endpoints) == 0 || slices.Contains(l.Endpoints, endpointsWS) {
+		wsBound.Store(true)
+	}
+}
+
+// handleHealthz reports that the process is alive and serving HTTP.
+func handleHealthz(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz reports whether the relay should receive traffic: every
+// expected source has an open connection and channel, a WebSocket listener is
+// bound and the relay isn't shutting down. It answers 503 with the failing
+// checks otherwise.
+func handleReadyz(w http.ResponseWriter, _ *http.Request) {
+	failing := make(map[string]string)
+	sourceHealthMu.Lock()
+	for name, reason := range sourceHealth {
+		if reason != "" {
+			failing["source:"+name] = reason
+		}
+	}
+	sourceHealthMu.Unlock()
+	if !wsBound.Load() {
+		failing["listener"] = "no WebSocket listener bound"
+	}
+	if draining.Load() {
+		failing["shutdown"] = "draining"
+	}
+
+	if len(failing) > 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "unavailable", "failing": failing})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
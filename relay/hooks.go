@@ -0,0 +1,58 @@
+package relay
+
+// MessageInfo describes a message the relay broadcast, for Config.OnMessage.
+type MessageInfo struct {
+	Source string
+	Topic  string
+	// EventID is the relay-assigned event ID, empty unless replay is enabled.
+	EventID string
+	// Payload is the body as broadcast, after enrichment and transforms.
+	// It must not be modified.
+	Payload []byte
+	// Matched is how many clients were subscribed, Queued how many of them
+	// got it queued.
+	Matched int
+	Queued  int
+}
+
+// lifecycleHooks are the hooks of the Config a Relay was created with. They
+// are set once by New, before anything could call them.
+type lifecycleHooks struct {
+	onStart            func()
+	onClientConnect    func(ClientInfo)
+	onClientDisconnect func(ClientInfo, string)
+	onMessage          func(MessageInfo)
+	onShutdown         func()
+}
+
+var hooks lifecycleHooks
+
+func (h lifecycleHooks) started() {
+	if h.onStart != nil {
+		h.onStart()
+	}
+}
+
+func (h lifecycleHooks) clientConnected(info ClientInfo) {
+	if h.onClientConnect != nil {
+		h.onClientConnect(info)
+	}
+}
+
+func (h lifecycleHooks) clientDisconnected(info ClientInfo, reason string) {
+	if h.onClientDisconnect != nil {
+		h.onClientDisconnect(info, reason)
+	}
+}
+
+func (h lifecycleHooks) message(info MessageInfo) {
+	if h.onMessage != nil {
+		h.onMessage(info)
+	}
+}
+
+func (h lifecycleHooks) shutDown() {
+	if h.onShutdown != nil {
+		h.onShutdown()
+	}
+}
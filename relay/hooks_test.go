@@ -0,0 +1,76 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// useHooks makes h the lifecycle hooks for the rest of the test.
+func useHooks(t *testing.T, h lifecycleHooks) {
+	t.Helper()
+	previous := hooks
+	hooks = h
+	t.Cleanup(func() { hooks = previous })
+}
+
+func TestClientHooks(t *testing.T) {
+	useConfig(t, "log:\n  level: info\n")
+	connected := make(chan ClientInfo, 1)
+	disconnected := make(chan string, 1)
+	useHooks(t, lifecycleHooks{
+		onClientConnect:    func(info ClientInfo) { connected <- info },
+		onClientDisconnect: func(_ ClientInfo, reason string) { disconnected <- reason },
+	})
+	initAcceptLimiter()
+	initAuthenticator()
+	srv := httptest.NewServer(http.HandlerFunc(handleSSE))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"?topics=a.*", http.NoBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	select {
+	case info := <-connected:
+		if info.Transport != sinkSSE || len(info.Subscriptions) != 1 {
+			t.Errorf("OnClientConnect got %+v", info)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnClientConnect wasn't called")
+	}
+	cancel()
+	select {
+	case reason := <-disconnected:
+		if reason != string(reasonClientClosed) {
+			t.Errorf("OnClientDisconnect reason = %q, want %q", reason, reasonClientClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("OnClientDisconnect wasn't called")
+	}
+}
+
+func TestMessageHook(t *testing.T) {
+	useConfig(t, "log:\n  level: info\n")
+	usePipeline(&pipeline{})
+	var got []MessageInfo
+	useHooks(t, lifecycleHooks{onMessage: func(info MessageInfo) { got = append(got, info) }})
+
+	relayDelivery(inbound{source: "test", msg: amqp.Delivery{RoutingKey: "a.b", Body: []byte(`{"x":1}`)}})
+
+	if len(got) != 1 || got[0].Topic != "a.b" || got[0].Source != "test" || string(got[0].Payload) != `{"x":1}` {
+		t.Errorf("OnMessage got %+v, want one call for the a.b message", got)
+	}
+}
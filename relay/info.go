@@ -0,0 +1,167 @@
+package relay
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// version is set at build time with
+// -ldflags "-X github.com/reaport/event-relay/relay.version=...".
+var version = "dev"
+
+type serverInfo struct {
+	Version      string     `json:"version"`
+	Role         string     `json:"role"`
+	ServerTime   time.Time  `json:"server_time"`
+	Protocols    []string   `json:"protocols"`
+	Capabilities []string   `json:"capabilities"`
+	Topics       []string   `json:"topics"`
+	Priority     []string   `json:"priority_topics"`
+	Retained     []string   `json:"retained_topics"`
+	Limits       infoLimits `json:"limits"`
+	Replay       infoReplay `json:"replay"`
+}
+
+// infoReplay is how far back a reconnecting client can catch up.
+type infoReplay struct {
+	Enabled     bool   `json:"enabled"`
+	MaxMessages int    `json:"max_messages"`
+	MaxAge      string `json:"max_age"`
+	DedupWindow string `json:"dedup_window"`
+}
+
+type infoLimits struct {
+	QuotaWindow        string  `json:"quota_window"`
+	ClientSoftBytes    int64   `json:"client_soft_bytes"`
+	ClientHardBytes    int64   `json:"client_hard_bytes"`
+	TenantSoftBytes    int64   `json:"tenant_soft_bytes"`
+	TenantHardBytes    int64   `json:"tenant_hard_bytes"`
+	AcceptRate         float64 `json:"accept_rate"`
+	MaxMessageSize     int     `json:"max_message_size"`
+	DuplicatePolicy    string  `json:"duplicate_policy"`
+	WebhookQueueSize   int     `json:"webhook_queue_size"`
+	WebhookMaxAttempts int     `json:"webhook_max_attempts"`
+}
+
+var (
+	// seenTopics maps the topics /api/info lists to when each was last seen.
+	// It holds at most metrics.max_topics topics, none older than
+	// replay.max_age.
+	seenTopics   = make(map[string]time.Time)
+	seenTopicsMu sync.Mutex
+)
+
+func recordTopic(topic string) {
+	now := time.Now()
+	seenTopicsMu.Lock()
+	defer seenTopicsMu.Unlock()
+	if _, ok := seenTopics[topic]; !ok && len(seenTopics) >= conf().GetInt("metrics.max_topics") {
+		expireSeenTopics(now)
+		if len(seenTopics) >= conf().GetInt("metrics.max_topics") {
+			forgetOldestSeenTopic()
+		}
+	}
+	seenTopics[topic] = now
+}
+
+// expireSeenTopics drops the topics not seen within replay.max_age, if set.
+// Must be called with seenTopicsMu held.
+func expireSeenTopics(now time.Time) {
+	maxAge := conf().GetDuration("replay.max_age")
+	if maxAge <= 0 {
+		return
+	}
+	maps.DeleteFunc(seenTopics, func(_ string, seen time.Time) bool { return now.Sub(seen) > maxAge })
+}
+
+// forgetOldestSeenTopic makes room for a topic by dropping the one seen
+// longest ago. Must be called with seenTopicsMu held.
+func forgetOldestSeenTopic() {
+	var oldest string
+	var oldestSeen time.Time
+	for topic, seen := range seenTopics {
+		if oldest == "" || seen.Before(oldestSeen) {
+			oldest, oldestSeen = topic, seen
+		}
+	}
+	delete(seenTopics, oldest)
+}
+
+// visibleTopics keeps the topics caller could subscribe to, so /api/info
+// doesn't list other tenants' topics or ones the policy denies.
+func visibleTopics(ctx context.Context, caller *client, topics []string) []string {
+	visible := make([]string, 0, len(topics))
+	for _, topic := range topics {
+		if tenantAllows(caller.tenant, topic) && caller.authorizeTopics(ctx, []string{topic}) == nil {
+			visible = append(visible, topic)
+		}
+	}
+	return visible
+}
+
+func handleInfo(w http.ResponseWriter, r *http.Request) {
+	caller, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+
+	seenTopicsMu.Lock()
+	expireSeenTopics(time.Now())
+	topics := make([]string, 0, len(seenTopics))
+	for topic := range seenTopics {
+		topics = append(topics, topic)
+	}
+	seenTopicsMu.Unlock()
+	slices.Sort(topics)
+
+	protocols := []string{"raw"}
+	if conf().GetBool("envelope.enabled") {
+		protocols = []string{"envelope"}
+	}
+
+	writeJSON(w, http.StatusOK, serverInfo{
+		Version:      version,
+		Role:         haRole(),
+		ServerTime:   time.Now().UTC(),
+		Protocols:    protocols,
+		Capabilities: supportedCapabilities(),
+		Topics:       visibleTopics(r.Context(), caller, topics),
+		Priority:     visibleTopics(r.Context(), caller, conf().GetStringSlice("topics.priority")),
+		Retained:     visibleTopics(r.Context(), caller, conf().GetStringSlice("retained.topics")),
+		Limits: infoLimits{
+			QuotaWindow:        conf().GetDuration("quotas.window").String(),
+			ClientSoftBytes:    conf().GetInt64("quotas.client_soft_bytes"),
+			ClientHardBytes:    conf().GetInt64("quotas.client_hard_bytes"),
+			TenantSoftBytes:    conf().GetInt64("quotas.tenant_soft_bytes"),
+			TenantHardBytes:    conf().GetInt64("quotas.tenant_hard_bytes"),
+			AcceptRate:         conf().GetFloat64("server.accept_rate"),
+			MaxMessageSize:     conf().GetInt("oversized.max_size"),
+			DuplicatePolicy:    conf().GetString("server.duplicate_policy"),
+			WebhookQueueSize:   conf().GetInt("webhooks.queue_size"),
+			WebhookMaxAttempts: conf().GetInt("webhooks.retry.max_attempts"),
+		},
+		Replay: infoReplay{
+			Enabled:     conf().GetBool("replay.enabled"),
+			MaxMessages: conf().GetInt("replay.max_messages"),
+			MaxAge:      conf().GetDuration("replay.max_age").String(),
+			DedupWindow: conf().GetDuration("dedup.window").String(),
+		},
+	})
+}
+
+// serverTime lets clients estimate their clock offset: with the request sent
+// at t0 and the reply read at t1, offset ≈ server_time - (t0+t1)/2.
+type serverTime struct {
+	ServerTime time.Time `json:"server_time"`
+	UnixMillis int64     `json:"unix_ms"`
+}
+
+func handleTime(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now().UTC()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, serverTime{ServerTime: now, UnixMillis: now.UnixMilli()})
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+// useSeenTopics gives the test an empty seenTopics.
+func useSeenTopics(t *testing.T) {
+	t.Helper()
+	seenTopicsMu.Lock()
+	previous := seenTopics
+	seenTopics = make(map[string]time.Time)
+	seenTopicsMu.Unlock()
+	t.Cleanup(func() {
+		seenTopicsMu.Lock()
+		seenTopics = previous
+		seenTopicsMu.Unlock()
+	})
+}
+
+func TestSeenTopicsAreCappedAndExpire(t *testing.T) {
+	useConfig(t, "replay:\n  max_age: 1m\nmetrics:\n  max_topics: 2\n")
+	useSeenTopics(t)
+
+	recordTopic("a")
+	recordTopic("b")
+	recordTopic("a")
+	recordTopic("c") // evicts b, seen longest ago
+	seenTopicsMu.Lock()
+	_, hasB := seenTopics["b"]
+	if len(seenTopics) != 2 || hasB {
+		t.Errorf("seen topics %v, want a and c", slices.Sorted(maps.Keys(seenTopics)))
+	}
+	seenTopics["a"] = time.Now().Add(-2 * time.Minute)
+	expireSeenTopics(time.Now())
+	if _, ok := seenTopics["a"]; ok || len(seenTopics) != 1 {
+		t.Errorf("seen topics %v after a expired, want c", slices.Sorted(maps.Keys(seenTopics)))
+	}
+	seenTopicsMu.Unlock()
+}
+
+func TestInfoListsVisibleTopics(t *testing.T) {
+	useConfig(t, `tenants:
+  enabled: true
+  source: header
+  header: X-Tenant
+  namespace: true
+replay:
+  enabled: true
+  max_messages: 10
+  max_age: 1m
+metrics:
+  max_topics: 10
+`)
+	initAuthenticator()
+	for _, topic := range []string{"acme.orders", "globex.orders"} {
+		recordTopic(topic)
+	}
+
+	tests := []struct {
+		tenant string
+		status int
+		topic  string
+		hidden string
+	}{
+		{"acme", http.StatusOK, "acme.orders", "globex.orders"},
+		{"globex", http.StatusOK, "globex.orders", "acme.orders"},
+		{"", http.StatusForbidden, "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/api/info", http.NoBody)
+		if tt.tenant != "" {
+			r.Header.Set("X-Tenant", tt.tenant)
+		}
+		w := httptest.NewRecorder()
+		handleInfo(w, r)
+		if w.Code != tt.status {
+			t.Errorf("GET /api/info as tenant %q = %d, want %d", tt.tenant, w.Code, tt.status)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		var info serverInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(info.Topics, tt.topic) || slices.Contains(info.Topics, tt.hidden) {
+			t.Errorf("tenant %q sees topics %q, want %q without %q", tt.tenant, info.Topics, tt.topic, tt.hidden)
+		}
+		if !info.Replay.Enabled || info.Replay.MaxMessages != 10 || info.Replay.MaxAge != "1m0s" {
+			t.Errorf("tenant %q sees replay %+v, want enabled, 10 messages, 1m0s", tt.tenant, info.Replay)
+		}
+	}
+}
+
+func TestVisibleTopicsAppliesPolicy(t *testing.T) {
+	usePolicy(t, weatherOnlyPolicy)
+	caller := &client{subject: "alice"}
+	got := visibleTopics(context.Background(), caller, []string{"weather.today", "billing.invoices"})
+	if !slices.Equal(got, []string{"weather.today"}) {
+		t.Errorf("visibleTopics() = %q, want only weather.today", got)
+	}
+}
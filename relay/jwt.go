@@ -0,0 +1,250 @@
+package relay
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// jwksMinRefresh stops tokens with unknown key IDs from hammering the JWKS URL.
+	jwksMinRefresh = 10 * time.Second
+	// jwksTimeout bounds a JWKS fetch when auth.jwt.jwks_timeout is unset.
+	jwksTimeout = 5 * time.Second
+)
+
+// jwtMethods are the asymmetric algorithms a JWKS can publish keys for.
+var jwtMethods = []string{
+	"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA",
+}
+
+func init() {
+	RegisterAuthenticator("jwt", newJWTAuth)
+}
+
+// jwtAuth validates bearer tokens from the Authorization header or the token
+// query parameter against keys published at auth.jwt.jwks_url.
+type jwtAuth struct {
+	parser      *jwt.Parser
+	keys        *jwksCache
+	tenantClaim string
+	leeway      time.Duration
+}
+
+func newJWTAuth() (Authenticator, error) {
+	jwksURL := conf().GetString("auth.jwt.jwks_url")
+	if jwksURL == "" {
+		return nil, errors.New("auth.jwt.jwks_url is required")
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtMethods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(conf().GetDuration("auth.jwt.leeway")),
+	}
+	if issuer := conf().GetString("auth.jwt.issuer"); issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience := conf().GetString("auth.jwt.audience"); audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+
+	timeout := conf().GetDuration("auth.jwt.jwks_timeout")
+	if timeout <= 0 {
+		timeout = jwksTimeout
+	}
+	return &jwtAuth{
+		parser: jwt.NewParser(opts...),
+		keys: &jwksCache{
+			url:     jwksURL,
+			refresh: conf().GetDuration("auth.jwt.jwks_refresh"),
+			client:  &http.Client{Timeout: timeout},
+		},
+		tenantClaim: conf().GetString("auth.jwt.tenant_claim"),
+		leeway:      conf().GetDuration("auth.jwt.leeway"),
+	}, nil
+}
+
+func (a *jwtAuth) ValidateUpgrade(r *http.Request) (Identity, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		raw = r.URL.Query().Get("token")
+	}
+	if raw == "" {
+		return Identity{}, errUnauthenticated
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := a.parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.key(r.Context(), kid)
+	})
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{Claims: claims}
+	identity.Subject, _ = claims.GetSubject()
+	if exp, _ := claims.GetExpirationTime(); exp != nil {
+		identity.ExpiresAt = exp.Add(a.leeway) // accepted until then, as in validation
+	}
+	if a.tenantClaim != "" {
+		identity.Tenant, _ = claims[a.tenantClaim].(string)
+	}
+	return identity, nil
+}
+
+// jwksCache holds the verification keys published at a JWKS URL, refetching
+// them after refresh or when a token names an unknown key ID. Fetches run
+// without c.mu, so tokens with known keys validate meanwhile, and concurrent
+// refetches share one request.
+type jwksCache struct {
+	url      string
+	refresh  time.Duration
+	client   *http.Client
+	fetching singleflight.Group
+
+	mu      sync.Mutex
+	keys    map[string]any
+	fetched time.Time
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (c *jwksCache) key(ctx context.Context, kid string) (any, error) {
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	stale := c.refresh > 0 && time.Since(c.fetched) > c.refresh
+	due := (!ok || stale) && time.Since(c.fetched) > jwksMinRefresh
+	c.mu.Unlock()
+
+	if due {
+		// The fetch outlives a caller that gives up, since others may share it.
+		_, err, _ := c.fetching.Do(c.url, func() (any, error) { return nil, c.fetch(context.WithoutCancel(ctx)) })
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "jwks_fetch",
+				"status": "failed",
+				"url":    c.url,
+				"error":  err.Error(),
+			}).Error("Failed to fetch JWKS")
+		}
+		c.mu.Lock()
+		key, ok = c.keys[kid]
+		c.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// fetch replaces the cached keys.
+func (c *jwksCache) fetch(ctx context.Context) error {
+	c.mu.Lock()
+	c.fetched = time.Now()
+	c.mu.Unlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]any, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("unsupported OKP key %q", k.Kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
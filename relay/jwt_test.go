@@ -0,0 +1,59 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJWKSFetchRunsOutsideTheLock(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		time.Sleep(300 * time.Millisecond)
+		_, _ = w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer srv.Close()
+	cache := &jwksCache{
+		url:     srv.URL,
+		client:  &http.Client{Timeout: time.Second},
+		keys:    map[string]any{"known": "key"},
+		fetched: time.Now().Add(-time.Minute),
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = cache.key(context.Background(), "unknown")
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if _, err := cache.key(context.Background(), "known"); err != nil {
+		t.Errorf("key(known) = %v during a fetch", err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("key(known) waited %s for a JWKS fetch", elapsed)
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("concurrent lookups of an unknown key fetched the JWKS %d times, want 1", n)
+	}
+}
+
+func TestJWKSTimeoutDefault(t *testing.T) {
+	useConfig(t, "auth:\n  jwt:\n    jwks_url: http://127.0.0.1:9/jwks\n")
+	a, err := newJWTAuth()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := a.(*jwtAuth).keys.client.Timeout; got != jwksTimeout {
+		t.Errorf("JWKS client timeout = %s, want %s", got, jwksTimeout)
+	}
+}
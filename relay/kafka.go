@@ -0,0 +1,314 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	kafkaSourceName     = "kafka"
+	kafkaCommitInterval = "interval"
+	kafkaCommitMessage  = "message"
+)
+
+func init() {
+	RegisterSource(kafkaSourceName, newKafkaSource)
+}
+
+// kafkaSource relays records from kafka.topics, read as a member of the
+// kafka.group_id consumer group. The Kafka topic becomes the relay topic.
+type kafkaSource struct {
+	config kafka.ReaderConfig
+	commit string
+	start  startPosition
+}
+
+func newKafkaSource() (Source, error) {
+	brokers := conf().GetStringSlice("kafka.brokers")
+	topics := conf().GetStringSlice("kafka.topics")
+	if len(brokers) == 0 || len(topics) == 0 {
+		return nil, errors.New("kafka.brokers and kafka.topics are required")
+	}
+	start := kafka.LastOffset
+	switch conf().GetString("kafka.start_offset") {
+	case "", "latest":
+	case "earliest":
+		start = kafka.FirstOffset
+	default:
+		return nil, fmt.Errorf("unknown kafka.start_offset %q", conf().GetString("kafka.start_offset"))
+	}
+
+	pos, err := parseStartPosition(conf().GetString("kafka.start_position"), startStored)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &kafkaSource{
+		config: kafka.ReaderConfig{
+			Brokers:     brokers,
+			GroupID:     conf().GetString("kafka.group_id"),
+			GroupTopics: topics,
+			StartOffset: start,
+			MaxWait:     conf().GetDuration("kafka.max_wait"),
+		},
+		commit: conf().GetString("kafka.commit"),
+		start:  pos,
+	}
+	if pos.kind == startEarliest {
+		s.config.StartOffset = kafka.FirstOffset
+	}
+	switch s.commit {
+	case "", kafkaCommitInterval:
+		s.commit = kafkaCommitInterval
+		s.config.CommitInterval = conf().GetDuration("kafka.commit_interval")
+	case kafkaCommitMessage:
+	default:
+		return nil, fmt.Errorf("unknown kafka.commit %q", s.commit)
+	}
+	if s.config.GroupID == "" {
+		return nil, errors.New("kafka.group_id is required")
+	}
+	return s, nil
+}
+
+// kafkaReader is the part of *kafka.Reader the source uses.
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Run checks that a broker is reachable and then, like a RabbitMQ standby
+// that connects but doesn't consume, reports ready while it waits to be
+// promoted. Only an active instance joins the consumer group, so a standby
+// doesn't take partitions from the active relay.
+func (s *kafkaSource) Run(ctx context.Context) {
+	ExpectSource(kafkaSourceName)
+	policy := loadRetryPolicy("kafka.reconnect")
+	err := retry(ctx, kafkaSourceName, policy, func() error { return s.dialBroker(ctx) })
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":   "kafka_connection",
+			"status":  "failed",
+			"brokers": s.config.Brokers,
+			"error":   err.Error(),
+		}).Fatal("Giving up connecting to Kafka")
+	}
+	MarkSourceReady(kafkaSourceName)
+	if !awaitActive(ctx) {
+		return
+	}
+	if s.start.kind != startStored {
+		s.resetOffsets(ctx)
+	}
+
+	reader := kafka.NewReader(s.config)
+	defer reader.Close()
+	log.WithFields(logrus.Fields{
+		"event":  "kafka_connection",
+		"status": "connected",
+		"group":  s.config.GroupID,
+		"topics": s.config.GroupTopics,
+		"commit": s.commit,
+		"start":  s.start.String(),
+	}).Info("Consuming from Kafka")
+	s.consume(ctx, reader)
+}
+
+// consume dispatches records until reader fails or ctx is done, committing
+// each one's offset after it has been dispatched. With kafka.commit "interval"
+// the reader batches those commits every commit_interval; with "message"
+// each is committed before the next record is fetched.
+func (s *kafkaSource) consume(ctx context.Context, reader kafkaReader) {
+	for {
+		rec, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				MarkSourceDown(kafkaSourceName, err.Error())
+				log.WithFields(logrus.Fields{
+					"event":  "kafka_connection",
+					"status": "failed",
+					"error":  err.Error(),
+				}).Error("Kafka reader stopped")
+			}
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"event":     "message_received",
+			"status":    "success",
+			"source":    kafkaSourceName,
+			"topic":     rec.Topic,
+			"partition": rec.Partition,
+			"offset":    rec.Offset,
+			"message":   string(rec.Value),
+		}).Info("Received message from Kafka")
+		awaitCapacity()
+		dispatchDelivery(kafkaSourceName, kafkaDelivery(rec))
+
+		if err = reader.CommitMessages(ctx, rec); err != nil && ctx.Err() == nil {
+			log.WithFields(logrus.Fields{
+				"event":     "kafka_commit",
+				"status":    "failed",
+				"topic":     rec.Topic,
+				"partition": rec.Partition,
+				"offset":    rec.Offset,
+				"error":     err.Error(),
+			}).Warn("Failed to commit Kafka offset")
+		}
+	}
+}
+
+// dialBroker checks that a broker is reachable before joining the group; the
+// reader itself retries silently and would leave readiness unknown.
+func (s *kafkaSource) dialBroker(ctx context.Context) error {
+	var err error
+	for _, broker := range s.config.Brokers {
+		var conn *kafka.Conn
+		dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		conn, err = kafka.DialContext(dialCtx, "tcp", broker)
+		cancel()
+		if err == nil {
+			return conn.Close()
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"event":   "kafka_connection",
+		"status":  "failed",
+		"brokers": s.config.Brokers,
+		"error":   err.Error(),
+	}).Error("Failed to connect to Kafka")
+	return err
+}
+
+// resetOffsets commits the group's offsets at kafka.start_position before it
+// joins, so earliest, latest or a timestamp apply at every start and not only
+// to a new group. Kafka only accepts this while no other member is in the
+// group; otherwise the instance keeps the stored offsets and logs why.
+func (s *kafkaSource) resetOffsets(ctx context.Context) {
+	offsets, err := s.startOffsets(ctx)
+	if err == nil {
+		err = s.commitOffsets(ctx, offsets)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "kafka_start_position",
+			"status": "failed",
+			"group":  s.config.GroupID,
+			"start":  s.start.String(),
+			"error":  err.Error(),
+		}).Warn("Failed to move the consumer group, resuming from its stored offsets")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":  "kafka_start_position",
+		"status": "reset",
+		"group":  s.config.GroupID,
+		"start":  s.start.String(),
+	}).Info("Moved the consumer group to the start position")
+}
+
+// startOffsets resolves the start position to an offset per partition. A
+// timestamp after the newest record resolves to the end of the partition.
+func (s *kafkaSource) startOffsets(ctx context.Context) (map[string][]kafka.OffsetCommit, error) {
+	client := &kafka.Client{Addr: kafka.TCP(s.config.Brokers...)}
+	md, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: s.config.GroupTopics})
+	if err != nil {
+		return nil, err
+	}
+	ends := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest)}
+	starts := &kafka.ListOffsetsRequest{Topics: make(map[string][]kafka.OffsetRequest)}
+	for _, topic := range md.Topics {
+		if topic.Error != nil {
+			return nil, fmt.Errorf("topic %s: %w", topic.Name, topic.Error)
+		}
+		for _, p := range topic.Partitions {
+			ends.Topics[topic.Name] = append(ends.Topics[topic.Name], kafka.LastOffsetOf(p.ID))
+			if s.start.kind == startEarliest {
+				starts.Topics[topic.Name] = append(starts.Topics[topic.Name], kafka.FirstOffsetOf(p.ID))
+			} else if !s.start.at.IsZero() {
+				starts.Topics[topic.Name] = append(starts.Topics[topic.Name], kafka.TimeOffsetOf(p.ID, s.start.at))
+			}
+		}
+	}
+
+	offsets := make(map[string][]kafka.OffsetCommit)
+	found := make(map[string]map[int]bool)
+	for _, req := range []*kafka.ListOffsetsRequest{starts, ends} {
+		if len(req.Topics) == 0 {
+			continue
+		}
+		resp, err := client.ListOffsets(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		for topic, partitions := range resp.Topics {
+			if found[topic] == nil {
+				found[topic] = make(map[int]bool)
+			}
+			for _, p := range partitions {
+				if p.Error != nil {
+					return nil, fmt.Errorf("topic %s partition %d: %w", topic, p.Partition, p.Error)
+				}
+				offset := max(p.FirstOffset, p.LastOffset)
+				for o := range p.Offsets {
+					offset = max(offset, o)
+				}
+				if offset < 0 || found[topic][p.Partition] {
+					continue
+				}
+				found[topic][p.Partition] = true
+				offsets[topic] = append(offsets[topic], kafka.OffsetCommit{Partition: p.Partition, Offset: offset})
+			}
+		}
+	}
+	return offsets, nil
+}
+
+func (s *kafkaSource) commitOffsets(ctx context.Context, offsets map[string][]kafka.OffsetCommit) error {
+	client := &kafka.Client{Addr: kafka.TCP(s.config.Brokers...)}
+	resp, err := client.OffsetCommit(ctx, &kafka.OffsetCommitRequest{
+		GroupID:      s.config.GroupID,
+		GenerationID: -1, // a commit from outside the group, allowed only while it is empty
+		Topics:       offsets,
+	})
+	if err != nil {
+		return err
+	}
+	for topic, partitions := range resp.Topics {
+		for _, p := range partitions {
+			if p.Error != nil {
+				return fmt.Errorf("topic %s partition %d: %w", topic, p.Partition, p.Error)
+			}
+		}
+	}
+	return nil
+}
+
+// kafkaDelivery maps a record onto the delivery the rest of the relay works
+// with. The record key travels as the x-kafka-key header and its position
+// as the message ID.
+func kafkaDelivery(rec kafka.Message) amqp.Delivery {
+	headers := amqp.Table{}
+	for _, h := range rec.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	if len(rec.Key) > 0 {
+		headers["x-kafka-key"] = string(rec.Key)
+	}
+	return amqp.Delivery{
+		RoutingKey:  rec.Topic,
+		MessageId:   fmt.Sprintf("%s/%d/%d", rec.Topic, rec.Partition, rec.Offset),
+		ContentType: "application/json",
+		Timestamp:   rec.Time,
+		Headers:     headers,
+		Body:        rec.Value,
+	}
+}
@@ -0,0 +1,62 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafkaReader hands out records and then io.EOF, recording commits.
+type fakeKafkaReader struct {
+	records   []kafka.Message
+	committed []kafka.Message
+}
+
+func (r *fakeKafkaReader) FetchMessage(context.Context) (kafka.Message, error) {
+	if len(r.records) == 0 {
+		return kafka.Message{}, io.EOF
+	}
+	rec := r.records[0]
+	r.records = r.records[1:]
+	return rec, nil
+}
+
+func (r *fakeKafkaReader) CommitMessages(_ context.Context, msgs ...kafka.Message) error {
+	r.committed = append(r.committed, msgs...)
+	return nil
+}
+
+func TestKafkaCommitsDispatchedRecords(t *testing.T) {
+	usePipeline(&pipeline{})
+	tests := []struct {
+		commit   string
+		interval time.Duration
+	}{
+		{kafkaCommitInterval, time.Second},
+		{kafkaCommitMessage, 0},
+	}
+	for _, tt := range tests {
+		useConfig(t, "kafka:\n  brokers: [localhost:9092]\n  group_id: relay\n  topics: [orders]\n"+
+			"  commit: "+tt.commit+"\n  commit_interval: 1s\n")
+		src, err := newKafkaSource()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := src.(*kafkaSource)
+		if s.config.CommitInterval != tt.interval {
+			t.Errorf("%s: CommitInterval = %s, want %s", tt.commit, s.config.CommitInterval, tt.interval)
+		}
+
+		reader := &fakeKafkaReader{records: []kafka.Message{
+			{Topic: "orders", Offset: 1, Value: []byte(`{}`)},
+			{Topic: "orders", Offset: 2, Value: []byte(`{}`)},
+		}}
+		s.consume(context.Background(), reader)
+		if len(reader.committed) != 2 || reader.committed[1].Offset != 2 {
+			t.Errorf("%s: committed %+v, want offsets 1 and 2", tt.commit, reader.committed)
+		}
+	}
+}
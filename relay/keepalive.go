@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pingWriteTimeout bounds writing one ping frame.
+const pingWriteTimeout = 10 * time.Second
+
+// keepaliveEnabled reports whether WebSocket clients are pinged.
+func keepaliveEnabled() bool {
+	return conf().GetDuration("clients.keepalive.ping_interval") > 0 &&
+		conf().GetDuration("clients.keepalive.pong_timeout") > 0
+}
+
+// startKeepalive arms c's read deadline, so a half-open connection that stops
+// answering pings fails its read and is removed like any closed one. Pongs
+// and any other frame from the client extend the deadline.
+func (c *client) startKeepalive() {
+	if !keepaliveEnabled() {
+		return
+	}
+	c.touch()
+	c.conn.SetPongHandler(func(string) error {
+		c.touch()
+		return nil
+	})
+}
+
+// touch extends c's read deadline by clients.keepalive.pong_timeout.
+func (c *client) touch() {
+	if keepaliveEnabled() {
+		_ = c.conn.SetReadDeadline(time.Now().Add(conf().GetDuration("clients.keepalive.pong_timeout")))
+	}
+}
+
+// pings returns the channel c's writer sends pings on, nil for SSE clients or
+// when keepalive is off. stop releases its ticker.
+func (c *client) pings() (ticks <-chan time.Time, stop func()) {
+	if c.conn == nil || !keepaliveEnabled() {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(conf().GetDuration("clients.keepalive.ping_interval"))
+	return ticker.C, ticker.Stop
+}
+
+// ping sends a ping carrying the server time, which clients may use to
+// estimate clock skew. It reports whether the connection is still usable.
+func (c *client) ping() bool {
+	now := time.Now()
+	serverTime := []byte(now.UTC().Format(time.RFC3339Nano))
+	err := c.conn.WriteControl(websocket.PingMessage, serverTime, now.Add(pingWriteTimeout))
+	if err != nil {
+		c.closeConn()
+		return false
+	}
+	return true
+}
+
+// missedPong reports whether a read failed because the keepalive deadline
+// passed.
+func missedPong(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,52 @@
+package relay
+
+import (
+	"math"
+	"net/http"
+)
+
+type lbWeight struct {
+	Connections int     `json:"connections"`
+	Saturation  float64 `json:"saturation"`
+	Weight      int     `json:"weight"`
+}
+
+// handleLBWeight reports load for least-loaded routing by an L7 balancer. It
+// is unauthenticated and cheap so it can be polled every few seconds.
+// Saturation is the highest of connection count against lb.capacity, the
+// goroutine budget in use, and the average send queue fill; weight is its
+// complement on a 0-100 scale, and 0 on a standby.
+func handleLBWeight(w http.ResponseWriter, _ *http.Request) {
+	clientsMu.Lock()
+	connections := len(clients)
+	queueFill := 0.0
+	for c := range clients {
+		queueFill += float64(c.queues.depth()) / float64(cap(c.queues.normal)+cap(c.queues.priority))
+	}
+	clientsMu.Unlock()
+
+	saturation := 0.0
+	if connections > 0 {
+		saturation = queueFill / float64(connections)
+	}
+	if capacity := conf().GetInt("lb.capacity"); capacity > 0 {
+		saturation = max(saturation, float64(connections)/float64(capacity))
+	}
+	if limit := conf().GetInt("goroutines.max_total"); limit > 0 {
+		goroutines.mu.Lock()
+		saturation = max(saturation, float64(goroutines.total)/float64(limit))
+		goroutines.mu.Unlock()
+	}
+	saturation = min(saturation, 1)
+
+	weight := int(math.Round((1 - saturation) * 100))
+	if haRole() == haModeStandby {
+		weight = 0
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, lbWeight{
+		Connections: connections,
+		Saturation:  math.Round(saturation*1000) / 1000,
+		Weight:      weight,
+	})
+}
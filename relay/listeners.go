@@ -0,0 +1,205 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Endpoint groups a listener can expose.
+const (
+	endpointsWS      = "ws"
+	endpointsAPI     = "api"
+	endpointsAdmin   = "admin"
+	endpointsMetrics = "metrics"
+	endpointsHealth  = "health"
+)
+
+type route struct {
+	group   string
+	pattern string
+	handler http.HandlerFunc
+}
+
+// tlsConfig enables TLS on a listener. With a client CA file, client
+// certificates are verified against it: required by default, or only when
+// presented with client_auth "optional".
+type tlsConfig struct {
+	CertFile     string `mapstructure:"cert_file"`
+	KeyFile      string `mapstructure:"key_file"`
+	ClientCAFile string `mapstructure:"client_ca_file"`
+	ClientAuth   string `mapstructure:"client_auth"`
+}
+
+// serverConfig builds the listener's TLS settings, or returns nil for a
+// plaintext listener.
+func (t tlsConfig) serverConfig() (*tls.Config, error) {
+	if t.CertFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if t.ClientCAFile == "" {
+		return cfg, nil
+	}
+
+	pem, err := os.ReadFile(t.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg.ClientCAs = x509.NewCertPool()
+	if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", t.ClientCAFile)
+	}
+	switch t.ClientAuth {
+	case "", "require":
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client_auth %q", t.ClientAuth)
+	}
+	return cfg, nil
+}
+
+type listenerConfig struct {
+	Address   string    `mapstructure:"address"`
+	IPMode    string    `mapstructure:"ip_mode"`
+	Endpoints []string  `mapstructure:"endpoints"`
+	TLS       tlsConfig `mapstructure:"tls"`
+}
+
+// network maps ip_mode to a Go network. "tcp" on a wildcard address is dual
+// stack, while "tcp6" sets IPV6_V6ONLY and "tcp4" binds IPv4 only.
+func (l listenerConfig) network() string {
+	switch l.IPMode {
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	}
+	return "tcp"
+}
+
+var (
+	routes    []route
+	servers   []*http.Server
+	serversMu sync.Mutex
+)
+
+// handle registers a route in an endpoint group. Routes are mounted on every
+// listener that exposes the group when the listeners start.
+func handle(group, pattern string, handler http.HandlerFunc) {
+	routes = append(routes, route{group: group, pattern: pattern, handler: handler})
+}
+
+// listenerConfigs returns server.listeners, falling back to a single listener
+// on server.port with server.tls that exposes every endpoint group.
+func listenerConfigs() []listenerConfig {
+	var listeners []listenerConfig
+	if err := conf().UnmarshalKey("server.listeners", &listeners); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "listeners_config",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Fatal("Failed to read listener config")
+	}
+	if len(listeners) == 0 {
+		fallback := listenerConfig{
+			Address: net.JoinHostPort(conf().GetString("server.host"), conf().GetString("server.port")),
+			IPMode:  conf().GetString("server.ip_mode"),
+		}
+		if err := unmarshalConfig("server.tls", &fallback.TLS); err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "listeners_config",
+				"status": "failed",
+				"error":  err.Error(),
+			}).Fatal("Failed to read TLS config")
+		}
+		listeners = []listenerConfig{fallback}
+	}
+	return listeners
+}
+
+func startListeners() {
+	for _, l := range listenerConfigs() {
+		mux := http.NewServeMux()
+		for _, rt := range routes {
+			if len(l.Endpoints) == 0 || slices.Contains(l.Endpoints, rt.group) {
+				mux.HandleFunc(rt.pattern, rt.handler)
+			}
+		}
+		go serveListener(l, mux)
+	}
+}
+
+func serveListener(l listenerConfig, mux *http.ServeMux) {
+	tlsCfg, err := l.TLS.serverConfig()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":   "websocket_server",
+			"status":  "failed",
+			"address": l.Address,
+			"error":   err.Error(),
+		}).Fatal("Invalid listener TLS config")
+	}
+	useTLS := tlsCfg != nil
+	log.WithFields(logrus.Fields{
+		"event":       "websocket_server",
+		"status":      "started",
+		"address":     l.Address,
+		"network":     l.network(),
+		"endpoints":   l.Endpoints,
+		"tls":         useTLS,
+		"client_cert": useTLS && tlsCfg.ClientCAs != nil,
+	}).Info("WebSocket server started")
+
+	srv := &http.Server{Addr: l.Address, Handler: mux, TLSConfig: tlsCfg} //nolint:gosec // timeout doesn't matter
+	serversMu.Lock()
+	servers = append(servers, srv)
+	serversMu.Unlock()
+
+	ln, err := net.Listen(l.network(), l.Address)
+	if err == nil {
+		markListenerBound(l)
+		if useTLS {
+			err = srv.ServeTLS(ln, l.TLS.CertFile, l.TLS.KeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":   "websocket_server",
+		"status":  "failed",
+		"address": l.Address,
+		"error":   err.Error(),
+	}).Fatal("Listener stopped")
+}
+
+// shutdownListeners stops every listener from accepting new connections and
+// waits for in-flight requests until ctx is done.
+func shutdownListeners(ctx context.Context) {
+	serversMu.Lock()
+	defer serversMu.Unlock()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.WithFields(logrus.Fields{
+				"event":   "websocket_server",
+				"status":  "shutdown_failed",
+				"address": srv.Addr,
+				"error":   err.Error(),
+			}).Warn("Listener did not shut down cleanly")
+		}
+	}
+}
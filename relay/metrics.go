@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "event_relay"
+
+// overflowTopicLabel labels topics seen after metrics.max_topics others.
+const overflowTopicLabel = "_overflow"
+
+// Sinks label the delivery path in the sink_* metrics, which share one label
+// schema so a single dashboard covers every path.
+const (
+	sinkWebSocket = "websocket"
+	sinkSSE       = "sse"
+	sinkWebhook   = "webhook"
+)
+
+var (
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_consumed_total",
+		Help:      "Messages received from a source.",
+	}, []string{"source"})
+
+	messagesBroadcast = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_broadcast_total",
+		Help:      "Messages written to WebSocket clients.",
+	})
+
+	broadcastFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "broadcast_failures_total",
+		Help:      "Writes to WebSocket clients that failed.",
+	})
+
+	broadcastDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "broadcast_duration_seconds",
+		Help:      "Time to fan one message out to every interested client.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+
+	amqpReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "amqp_reconnects_total",
+		Help:      "RabbitMQ connections lost and re-established.",
+	}, []string{"source"})
+
+	backplaneMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "backplane_messages_total",
+		Help:      "Messages published to (out) and received from (in) the backplane, by outcome.",
+	}, []string{"direction", "status"})
+
+	configReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Config reloads, by outcome (applied, invalid, baked, rolled_back).",
+	}, []string{"status"})
+
+	deadLettersPublished = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dead_letters_total",
+		Help:      "Undeliverable messages sent to the dead-letter exchange, by failure reason and outcome.",
+	}, []string{"reason", "status"})
+
+	authzDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "authz_decisions_total",
+		Help:      "Authorization policy decisions, by action and outcome.",
+	}, []string{"action", "status"})
+
+	clientPublishes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_publishes_total",
+		Help:      "Messages clients asked to publish, by outcome.",
+	}, []string{"status"})
+
+	clientReconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_reconnects_total",
+		Help:      "Reconnects reported in client hellos, by reason and cause (server, network, client, unknown).",
+	}, []string{"reason", "cause"})
+
+	clientPreviousSession = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_previous_session_seconds",
+		Help:      "How long the session a reconnecting client lost had lasted, by cause.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"cause"})
+
+	sinkDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_deliveries_total",
+		Help:      "Messages delivered through a sink, by outcome.",
+	}, []string{"sink", "status"})
+
+	sinkDeliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_delivery_duration_seconds",
+		Help:      "Time to deliver one message through a sink, retries included.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"sink"})
+
+	sinkRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_retries_total",
+		Help:      "Delivery attempts after the first, by sink.",
+	}, []string{"sink"})
+
+	sinkPayloadBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "sink_payload_bytes_total",
+		Help:      "Bytes delivered through a sink.",
+	}, []string{"sink"})
+
+	messageDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "message_drops_total",
+		Help:      "Messages dropped, by reason and topic. Topics past metrics.max_topics are labelled _overflow.",
+	}, []string{"reason", "topic"})
+
+	clientDisconnects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_disconnects_total",
+		Help:      "Clients disconnected, by reason.",
+	}, []string{"reason"})
+
+	laneDepthDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "bulkhead_lane_depth"),
+		"Deliveries queued in a bulkhead lane, by topic; topics past bulkheads.max_topics share the _overflow lane.",
+		[]string{"topic"}, nil,
+	)
+
+	connectedClients = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "connected_clients",
+		Help:      "WebSocket clients currently connected.",
+	}, func() float64 {
+		clientsMu.Lock()
+		defer clientsMu.Unlock()
+		return float64(len(clients))
+	})
+)
+
+var (
+	// metricTopics are the topics labelled so far, at most metrics.max_topics.
+	metricTopics   = make(map[string]struct{})
+	metricTopicsMu sync.Mutex
+)
+
+func init() {
+	prometheus.MustRegister(laneCollector{})
+}
+
+// metricTopic returns topic as a metric label, or _overflow once
+// metrics.max_topics other topics are labelled, as bulkheads.max_topics caps
+// lanes.
+func metricTopic(topic string) string {
+	metricTopicsMu.Lock()
+	defer metricTopicsMu.Unlock()
+	if _, ok := metricTopics[topic]; ok {
+		return topic
+	}
+	if len(metricTopics) >= conf().GetInt("metrics.max_topics") {
+		return overflowTopicLabel
+	}
+	metricTopics[topic] = struct{}{}
+	return topic
+}
+
+// laneCollector reports the depth of every bulkhead lane when scraped.
+type laneCollector struct{}
+
+func (laneCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- laneDepthDesc
+}
+
+func (laneCollector) Collect(ch chan<- prometheus.Metric) {
+	lanesMu.Lock()
+	defer lanesMu.Unlock()
+	for name, lane := range lanes {
+		ch <- prometheus.MustNewConstMetric(laneDepthDesc, prometheus.GaugeValue, float64(len(lane.queue)), name)
+	}
+}
+
+func registerMetricsRoutes() {
+	handler := promhttp.Handler()
+	handle(endpointsMetrics, "GET /metrics", handler.ServeHTTP)
+}
+
+// recordSinkDelivery accounts for one delivery through sink that took elapsed
+// over retries attempts after the first and, unless it failed, wrote bytes.
+func recordSinkDelivery(sink string, elapsed time.Duration, retries, bytes int, err error) {
+	status := "delivered"
+	if err != nil {
+		status = "failed"
+	}
+	sinkDeliveries.WithLabelValues(sink, status).Inc()
+	sinkDeliveryDuration.WithLabelValues(sink).Observe(elapsed.Seconds())
+	if retries > 0 {
+		sinkRetries.WithLabelValues(sink).Add(float64(retries))
+	}
+	if err == nil {
+		sinkPayloadBytes.WithLabelValues(sink).Add(float64(bytes))
+	}
+}
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	t.Helper()
+	var m dto.Metric
+	if err := c.Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func TestMetricTopicCapsCardinality(t *testing.T) {
+	useConfig(t, "metrics:\n  max_topics: 2\n")
+	metricTopicsMu.Lock()
+	previous := metricTopics
+	metricTopics = make(map[string]struct{})
+	metricTopicsMu.Unlock()
+	t.Cleanup(func() {
+		metricTopicsMu.Lock()
+		metricTopics = previous
+		metricTopicsMu.Unlock()
+	})
+
+	for _, tt := range []struct{ topic, want string }{
+		{"a", "a"},
+		{"b", "b"},
+		{"c", overflowTopicLabel},
+		{"a", "a"},
+		{"d", overflowTopicLabel},
+	} {
+		if got := metricTopic(tt.topic); got != tt.want {
+			t.Errorf("metricTopic(%q) = %q, want %q", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestDropAndDisconnectCounters(t *testing.T) {
+	useConfig(t, "metrics:\n  max_topics: 1000\n")
+	drops := messageDrops.WithLabelValues(string(dropSampled), "counters.a")
+	disconnects := clientDisconnects.WithLabelValues(string(reasonKicked))
+	dropsBefore, disconnectsBefore := counterValue(t, drops), counterValue(t, disconnects)
+
+	recordDrop(dropSampled, "counters.a", nil)
+	recordDisconnect(reasonKicked)
+
+	if got := counterValue(t, drops) - dropsBefore; got != 1 {
+		t.Errorf("message_drops_total grew by %v, want 1", got)
+	}
+	if got := counterValue(t, disconnects) - disconnectsBefore; got != 1 {
+		t.Errorf("client_disconnects_total grew by %v, want 1", got)
+	}
+}
+
+func TestLaneCollector(t *testing.T) {
+	lanesMu.Lock()
+	previous := lanes
+	lanes = map[string]*topicLane{
+		"a.b":        {queue: make(chan inbound, 4)},
+		overflowLane: {queue: make(chan inbound, 4)},
+	}
+	lanes["a.b"].queue <- inbound{}
+	lanesMu.Unlock()
+	t.Cleanup(func() {
+		lanesMu.Lock()
+		lanes = previous
+		lanesMu.Unlock()
+	})
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(laneCollector{})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	depths := make(map[string]float64)
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			depths[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	if len(depths) != 2 || depths["a.b"] != 1 || depths[overflowLane] != 0 {
+		t.Errorf("lane depths = %v, want a.b at 1 and %s at 0", depths, overflowLane)
+	}
+}
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+type muteRule struct {
+	Name       string    `mapstructure:"name"`
+	Topics     []string  `mapstructure:"topics"`
+	From       time.Time `mapstructure:"from"`
+	Until      time.Time `mapstructure:"until"`
+	DailyFrom  string    `mapstructure:"daily_from"`
+	DailyUntil string    `mapstructure:"daily_until"`
+	Timezone   string    `mapstructure:"timezone"`
+	DeadLetter bool      `mapstructure:"dead_letter"`
+
+	location   *time.Location
+	dailyStart time.Duration
+	dailyEnd   time.Duration
+	muted      atomic.Int64
+}
+
+type muteRuleView struct {
+	Name       string   `json:"name"`
+	Topics     []string `json:"topics"`
+	Active     bool     `json:"active"`
+	DeadLetter bool     `json:"dead_letter"`
+	Muted      int64    `json:"muted"`
+}
+
+func readMuteRules(cfg *viper.Viper) ([]*muteRule, error) {
+	var rules []*muteRule
+	if err := unmarshalConfigFrom(cfg, "mute.rules", &rules); err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		if err := rule.prepare(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+		if rule.DeadLetter && !cfg.GetBool("dead_letter.enabled") {
+			return nil, fmt.Errorf("rule %q: dead_letter needs dead_letter.enabled", rule.Name)
+		}
+	}
+	return rules, nil
+}
+
+func (m *muteRule) prepare() error {
+	m.location = time.UTC
+	if m.Timezone != "" {
+		loc, err := time.LoadLocation(m.Timezone)
+		if err != nil {
+			return err
+		}
+		m.location = loc
+	}
+	if m.DailyFrom == "" && m.DailyUntil == "" {
+		return nil
+	}
+	var err error
+	if m.dailyStart, err = parseClock(m.DailyFrom); err != nil {
+		return err
+	}
+	m.dailyEnd, err = parseClock(m.DailyUntil)
+	return err
+}
+
+// parseClock parses "HH:MM" into an offset from midnight.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q: %w", s, err)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// activeAt reports whether now falls inside the rule's absolute window and,
+// if set, its daily quiet hours. A daily window may wrap past midnight.
+func (m *muteRule) activeAt(now time.Time) bool {
+	if !m.From.IsZero() && now.Before(m.From) {
+		return false
+	}
+	if !m.Until.IsZero() && !now.Before(m.Until) {
+		return false
+	}
+	if m.DailyFrom == "" && m.DailyUntil == "" {
+		return !m.From.IsZero() || !m.Until.IsZero()
+	}
+
+	local := now.In(m.location)
+	sinceMidnight := time.Duration(local.Hour())*time.Hour + time.Duration(local.Minute())*time.Minute
+	if m.dailyStart <= m.dailyEnd {
+		return sinceMidnight >= m.dailyStart && sinceMidnight < m.dailyEnd
+	}
+	return sinceMidnight >= m.dailyStart || sinceMidnight < m.dailyEnd
+}
+
+// mutedBy returns the first rule that currently mutes topic, counting the
+// event against it, or nil when topic isn't muted.
+func mutedBy(topic string) *muteRule {
+	now := time.Now()
+	for _, rule := range stages().muteRules {
+		if rule.activeAt(now) && matchesAny(rule.Topics, topic) {
+			rule.muted.Add(1)
+			recordDrop(dropMute, topic, logrus.Fields{"rule": rule.Name})
+			return rule
+		}
+	}
+	return nil
+}
+
+func handleMutes(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	rules := stages().muteRules
+	views := make([]muteRuleView, 0, len(rules))
+	for _, rule := range rules {
+		views = append(views, muteRuleView{
+			Name:       rule.Name,
+			Topics:     rule.Topics,
+			Active:     rule.activeAt(now),
+			DeadLetter: rule.DeadLetter,
+			Muted:      rule.muted.Load(),
+		})
+	}
+	writeJSON(w, http.StatusOK, views)
+}
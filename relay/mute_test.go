@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+const muteRulesConfig = `dead_letter:
+  enabled: true
+rabbitmq:
+  ack:
+    mode: broadcast
+mute:
+  rules:
+    - name: quiet
+      topics: ["quiet.#"]
+      from: "2000-01-01T00:00:00Z"
+    - name: held
+      topics: ["held.#"]
+      from: "2000-01-01T00:00:00Z"
+      dead_letter: true
+`
+
+func TestMuteRuleDeadLetter(t *testing.T) {
+	useConfig(t, muteRulesConfig)
+	p, err := newPipeline(conf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usePipeline(p)
+	deadLetters = make(chan deadLetter, 2)
+	t.Cleanup(func() { deadLetters = nil })
+
+	tests := []struct {
+		topic      string
+		deadLetter bool
+	}{
+		{"quiet.a", false},
+		{"held.a", true},
+	}
+	for _, tt := range tests {
+		acks := &recordedAcks{}
+		msg := amqp.Delivery{Acknowledger: acks, RoutingKey: tt.topic, Body: []byte(`{}`)}
+		relayDelivery(inbound{source: "rabbitmq", msg: msg, ack: newDeliveryAck("rabbitmq", msg)})
+
+		var d deadLetter
+		deadLettered := false
+		select {
+		case d = <-deadLetters:
+			deadLettered = true
+		default:
+		}
+		if deadLettered != tt.deadLetter || (deadLettered && d.reason != string(dropMute)) {
+			t.Errorf("muted %s: dead-lettered %v with reason %q, want %v", tt.topic, deadLettered, d.reason, tt.deadLetter)
+		}
+		wantAcks := 1
+		if tt.deadLetter {
+			wantAcks = 0 // until its dead letter is published
+		}
+		if acked, _, _ := acks.counts(); acked != wantAcks {
+			t.Errorf("muted %s: acked %d times, want %d", tt.topic, acked, wantAcks)
+		}
+	}
+}
+
+func TestMuteRuleDeadLetterNeedsDeadLetters(t *testing.T) {
+	cfg, err := newConfig([]byte("mute:\n  rules:\n    - name: held\n      topics: [\"#\"]\n      dead_letter: true\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMuteRules(cfg); err == nil {
+		t.Error("readMuteRules() accepted a dead_letter rule without dead_letter.enabled")
+	}
+}
@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	outboundCoalesce   = "coalesce"
+	outboundDropOldest = "drop_oldest"
+	outboundDisconnect = "disconnect"
+)
+
+// outboundLimitConfig is clients.rate_limit, part of the pipeline. Rate is
+// "<count>/<s|m|h>" as for publish.rate; empty disables the limit.
+type outboundLimitConfig struct {
+	Rate       string `mapstructure:"rate"`
+	Burst      int    `mapstructure:"burst"`
+	Policy     string `mapstructure:"policy"`
+	MaxPending int    `mapstructure:"max_pending"`
+
+	perSecond float64
+}
+
+func readOutboundLimit(cfg *viper.Viper) (outboundLimitConfig, error) {
+	var limit outboundLimitConfig
+	err := unmarshalConfigFrom(cfg, "clients.rate_limit", &limit)
+	if err == nil && limit.Rate != "" {
+		limit.perSecond, err = parseRate(limit.Rate)
+	}
+	if err == nil && limit.perSecond > 0 {
+		switch limit.Policy {
+		case outboundCoalesce, outboundDropOldest, outboundDisconnect:
+		default:
+			err = fmt.Errorf("unknown policy %q, want coalesce, drop_oldest or disconnect", limit.Policy)
+		}
+	}
+	return limit, err
+}
+
+// outboundLimiter paces the messages written to one client. Messages over
+// the rate wait in pending, where coalesce keeps only the latest per topic
+// and both coalesce and drop_oldest drop the oldest beyond max_pending. Only
+// the client's writer goroutine uses it.
+type outboundLimiter struct {
+	// limit is the clients.rate_limit the bucket was made for, picked up
+	// again when a reload changes it.
+	limit   *outboundLimitConfig
+	bucket  *tokenBucket
+	pending []queuedFrame
+}
+
+func newOutboundLimiter() *outboundLimiter {
+	l := &outboundLimiter{}
+	l.refresh()
+	return l
+}
+
+// refresh follows a reload of clients.rate_limit. The bucket is nil while
+// there is no limit.
+func (l *outboundLimiter) refresh() {
+	limit := &stages().outboundLimit
+	if limit == l.limit {
+		return
+	}
+	l.limit = limit
+	switch {
+	case limit.perSecond <= 0:
+		l.bucket = nil
+	case l.bucket == nil || l.bucket.rate != limit.perSecond || l.bucket.burst != float64(max(limit.Burst, 1)):
+		l.bucket = newTokenBucket(limit.perSecond, max(limit.Burst, 1))
+	}
+}
+
+// paces reports whether a message from the normal queue goes through pace:
+// while there is a limit, or messages still pending from one.
+func (l *outboundLimiter) paces() bool {
+	l.refresh()
+	return l.bucket != nil || len(l.pending) > 0
+}
+
+func (l *outboundLimiter) allow() bool {
+	return l.bucket == nil || l.bucket.Allow()
+}
+
+// ready fires when the first pending message may be written; it is nil, and
+// never fires, while nothing is pending.
+func (l *outboundLimiter) ready() <-chan time.Time {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	if l.bucket == nil {
+		return time.After(0)
+	}
+	return time.After(l.bucket.delay())
+}
+
+// pace writes a message from the normal queue now if c's rate allows it,
+// otherwise applies clients.rate_limit.policy. It reports whether the
+// connection is still usable.
+func (c *client) pace(f queuedFrame) bool {
+	l := c.limiter
+	if len(l.pending) == 0 && l.allow() {
+		return c.deliver(f)
+	}
+	switch l.limit.Policy {
+	case outboundDisconnect:
+		c.dropPaced(f)
+		clientsMu.Lock()
+		defer clientsMu.Unlock()
+		if _, ok := clients[c]; ok {
+			log.WithFields(logrus.Fields{
+				"event":     "rate_limit",
+				"status":    "disconnected",
+				"client":    c.remoteAddr,
+				"client_id": c.id,
+				"rate":      l.limit.Rate,
+			}).Warn("Client exceeded the outbound rate limit, disconnecting")
+			closeClient(c, reasonSlowConsumer, "outbound rate limit exceeded")
+			delete(clients, c)
+		}
+		return false
+	case outboundCoalesce:
+		if i := slices.IndexFunc(l.pending, func(p queuedFrame) bool { return p.topic == f.topic }); i >= 0 {
+			c.dropPaced(l.pending[i])
+			l.pending[i] = f
+			return true
+		}
+	}
+	l.pending = append(l.pending, f)
+	if len(l.pending) > max(l.limit.MaxPending, 1) {
+		c.dropPaced(l.pending[0])
+		l.pending = slices.Delete(l.pending, 0, 1)
+	}
+	return true
+}
+
+// releasePaced writes the pending messages the rate allows by now, reporting
+// whether the connection is still usable.
+func (c *client) releasePaced() bool {
+	l := c.limiter
+	for len(l.pending) > 0 && l.allow() {
+		f := l.pending[0]
+		l.pending = slices.Delete(l.pending, 0, 1)
+		if !c.deliver(f) {
+			return false
+		}
+	}
+	return true
+}
+
+// discardPaced resolves the messages still pending as unwritten.
+func (c *client) discardPaced() {
+	for _, f := range c.limiter.pending {
+		f.ack.resolve(false)
+	}
+	c.limiter.pending = nil
+}
+
+// dropPaced accounts for a message the rate limit dropped.
+func (c *client) dropPaced(f queuedFrame) {
+	f.ack.resolve(false)
+	clientsMu.Lock()
+	c.stats.drops++
+	clientsMu.Unlock()
+	recordDrop(dropRateLimited, f.topic, logrus.Fields{"client": c.remoteAddr, "policy": c.limiter.limit.Policy})
+}
@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	oversizedPolicyTruncate   = "truncate"
+	oversizedPolicyDeadLetter = "dead_letter"
+)
+
+// oversizedBody is the full body of a truncated message, served only to
+// callers who could subscribe to its topic.
+type oversizedBody struct {
+	topic       string
+	contentType string
+	body        []byte
+}
+
+type truncatedEvent struct {
+	Truncated bool   `json:"truncated"`
+	EventID   string `json:"event_id"`
+	Size      int    `json:"size"`
+	BodyURL   string `json:"body_url"`
+}
+
+var (
+	oversizedBodies = make(map[string]oversizedBody)
+	oversizedOrder  []string
+	oversizedMu     sync.Mutex
+)
+
+// limitSize enforces oversized.max_size on a delivery. It reports false when
+// the delivery must be dropped, and deadLetter when the dead_letter policy
+// wants it dead-lettered rather than acked. Under the truncate policy the body
+// is replaced with a pointer to GET /api/events/{id}/body and the full body is
+// kept under eventID, the relay's ID for the event, or a new ID without one.
+func limitSize(msg *amqp.Delivery, eventID string) (kept, deadLetter bool) {
+	limit := conf().GetInt("oversized.max_size")
+	if limit <= 0 || len(msg.Body) <= limit {
+		return true, false
+	}
+
+	policy := conf().GetString("oversized.policy")
+	log.WithFields(logrus.Fields{
+		"event":  "message_oversized",
+		"status": policy,
+		"topic":  msg.RoutingKey,
+		"size":   len(msg.Body),
+		"limit":  limit,
+	}).Warn("Message exceeds maximum size")
+
+	if policy != oversizedPolicyTruncate {
+		recordDrop(dropSize, msg.RoutingKey, logrus.Fields{"size": len(msg.Body)})
+		return false, policy == oversizedPolicyDeadLetter
+	}
+
+	id := eventID
+	if id == "" {
+		id = newID()
+	}
+	storeOversized(id, oversizedBody{topic: msg.RoutingKey, contentType: msg.ContentType, body: msg.Body})
+
+	placeholder, err := json.Marshal(truncatedEvent{
+		Truncated: true,
+		EventID:   id,
+		Size:      len(msg.Body),
+		BodyURL:   "/api/events/" + id + "/body",
+	})
+	if err != nil {
+		return false, false
+	}
+	msg.Body = placeholder
+	return true, false
+}
+
+func storeOversized(id string, b oversizedBody) {
+	oversizedMu.Lock()
+	defer oversizedMu.Unlock()
+
+	if _, exists := oversizedBodies[id]; !exists {
+		oversizedOrder = append(oversizedOrder, id)
+	}
+	oversizedBodies[id] = b
+	for len(oversizedOrder) > max(conf().GetInt("oversized.store_size"), 1) {
+		delete(oversizedBodies, oversizedOrder[0])
+		oversizedOrder = oversizedOrder[1:]
+	}
+}
+
+// handleEventBody serves the full body of a truncated message to a caller
+// authenticated like a client whose tenant and policy let it subscribe to the
+// message's topic. Other callers get the same 404 as for an unknown ID.
+func handleEventBody(w http.ResponseWriter, r *http.Request) {
+	caller, ok := authenticateRequest(w, r)
+	if !ok {
+		return
+	}
+	oversizedMu.Lock()
+	b, ok := oversizedBodies[r.PathValue("id")]
+	oversizedMu.Unlock()
+	if ok && (!tenantAllows(caller.tenant, b.topic) || caller.authorizeTopics(r.Context(), []string{b.topic}) != nil) {
+		ok = false
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "event body not found or expired")
+		return
+	}
+
+	contentType := b.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	_, _ = w.Write(b.body)
+}
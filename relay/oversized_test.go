@@ -0,0 +1,126 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestLimitSize(t *testing.T) {
+	tests := []struct {
+		name, config string
+		body         string
+		kept         bool
+		deadLetter   bool
+		truncated    bool
+	}{
+		{"no limit", "oversized:\n  max_size: 0\n", strings.Repeat("x", 100), true, false, false},
+		{"under the limit", "oversized:\n  max_size: 10\n  policy: drop\n", "0123456789", true, false, false},
+		{"dropped", "oversized:\n  max_size: 10\n  policy: drop\n", "0123456789a", false, false, false},
+		{"dead-lettered", "oversized:\n  max_size: 10\n  policy: dead_letter\n", "0123456789a", false, true, false},
+		{"truncated", "oversized:\n  max_size: 10\n  policy: truncate\n", "0123456789a", true, false, true},
+	}
+	for _, tt := range tests {
+		useConfig(t, tt.config)
+		msg := amqp.Delivery{RoutingKey: "a.b", MessageId: "m-1", Body: []byte(tt.body)}
+		kept, deadLetter := limitSize(&msg, "e-1")
+		if kept != tt.kept || deadLetter != tt.deadLetter {
+			t.Errorf("%s: limitSize() = %v, %v, want %v, %v", tt.name, kept, deadLetter, tt.kept, tt.deadLetter)
+			continue
+		}
+		var placeholder truncatedEvent
+		_ = json.Unmarshal(msg.Body, &placeholder)
+		if placeholder.Truncated != tt.truncated || (tt.truncated && placeholder.EventID != "e-1") {
+			t.Errorf("%s: body after limitSize() = %s", tt.name, msg.Body)
+		}
+	}
+}
+
+func TestOversizedDeadLetter(t *testing.T) {
+	useConfig(t, "oversized:\n  max_size: 4\n  policy: dead_letter\n")
+	usePipeline(&pipeline{})
+	deadLetters = make(chan deadLetter, 1)
+	t.Cleanup(func() { deadLetters = nil })
+
+	msg := amqp.Delivery{RoutingKey: "a.b", Body: []byte("too large")}
+	relayDelivery(inbound{source: "test", msg: msg, ack: newDeliveryAck("test", msg)})
+	select {
+	case d := <-deadLetters:
+		if d.reason != string(dropSize) {
+			t.Errorf("dead letter reason = %q, want %q", d.reason, dropSize)
+		}
+	default:
+		t.Error("oversized message wasn't dead-lettered")
+	}
+}
+
+// getEventBody requests url from GET /api/events/{id}/body as tenant.
+func getEventBody(url, tenant string) *httptest.ResponseRecorder {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/events/{id}/body", handleEventBody)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, url, http.NoBody)
+	r.Header.Set("X-Tenant", tenant)
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+// truncate runs msg through limitSize and returns its body URL.
+func truncate(t *testing.T, msg amqp.Delivery) string {
+	t.Helper()
+	limitSize(&msg, "")
+	var placeholder truncatedEvent
+	if err := json.Unmarshal(msg.Body, &placeholder); err != nil {
+		t.Fatal(err)
+	}
+	return placeholder.BodyURL
+}
+
+func TestTruncatedBodyIsServed(t *testing.T) {
+	useConfig(t, "oversized:\n  max_size: 4\n  policy: truncate\n  store_size: 1\n")
+	initAuthenticator()
+	get := func(url string) *httptest.ResponseRecorder { return getEventBody(url, "") }
+
+	url := truncate(t, amqp.Delivery{RoutingKey: "a.b", ContentType: "text/plain", Body: []byte("first body")})
+	w := get(url)
+	if w.Code != http.StatusOK || w.Body.String() != "first body" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("GET %s = %d %q", url, w.Code, w.Body)
+	}
+
+	truncate(t, amqp.Delivery{RoutingKey: "a.b", Body: []byte("second body")})
+	if w := get(url); w.Code != http.StatusNotFound {
+		t.Errorf("GET %s past oversized.store_size = %d, want 404", url, w.Code)
+	}
+}
+
+func TestTruncatedBodyIsTenantScoped(t *testing.T) {
+	useConfig(t, `oversized:
+  max_size: 4
+  policy: truncate
+tenants:
+  enabled: true
+  source: header
+  header: X-Tenant
+  namespace: true
+`)
+	initAuthenticator()
+	url := truncate(t, amqp.Delivery{RoutingKey: "acme.orders", Body: []byte("acme's order")})
+
+	tests := []struct {
+		tenant string
+		status int
+	}{
+		{"acme", http.StatusOK},
+		{"globex", http.StatusNotFound},
+		{"", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		if w := getEventBody(url, tt.tenant); w.Code != tt.status {
+			t.Errorf("GET %s as tenant %q = %d, want %d", url, tt.tenant, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	payloadEncodingGzip = "gzip"
+	payloadEncodingZstd = "zstd"
+)
+
+var (
+	zstdEncoder     *zstd.Encoder
+	zstdDecoder     *zstd.Decoder
+	zstdEncoderOnce sync.Once
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder) {
+	zstdEncoderOnce.Do(func() {
+		zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		zstdDecoder, _ = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder
+}
+
+// compressPayload compresses a payload of at least
+// envelope.compression.min_size bytes with envelope.compression.algorithm and
+// returns it as a base64 JSON string with its encoding. Small payloads, and
+// ones that don't shrink, come back unchanged with an empty encoding, so each
+// event is decided on its own regardless of frame compression.
+func compressPayload(payload json.RawMessage) (json.RawMessage, string) {
+	algorithm := conf().GetString("envelope.compression.algorithm")
+	if algorithm != payloadEncodingGzip && algorithm != payloadEncodingZstd {
+		return payload, ""
+	}
+	if len(payload) < conf().GetInt("envelope.compression.min_size") {
+		return payload, ""
+	}
+
+	var compressed []byte
+	switch algorithm {
+	case payloadEncodingGzip:
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		_, _ = zw.Write(payload)
+		if zw.Close() != nil {
+			return payload, ""
+		}
+		compressed = b.Bytes()
+	case payloadEncodingZstd:
+		enc, _ := zstdCodec()
+		compressed = enc.EncodeAll(payload, nil)
+	}
+	if base64.StdEncoding.EncodedLen(len(compressed))+2 >= len(payload) {
+		return payload, ""
+	}
+	encoded, err := json.Marshal(base64.StdEncoding.EncodeToString(compressed))
+	if err != nil {
+		return payload, ""
+	}
+	return encoded, algorithm
+}
+
+// decompressPayload reverses compressPayload for envelopes received from an
+// upstream relay.
+func decompressPayload(payload json.RawMessage, encoding string) (json.RawMessage, error) {
+	if encoding == "" {
+		return payload, nil
+	}
+	var encoded string
+	if err := json.Unmarshal(payload, &encoded); err != nil {
+		return nil, err
+	}
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	switch encoding {
+	case payloadEncodingGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(zr)
+	case payloadEncodingZstd:
+		_, dec := zstdCodec()
+		return dec.DecodeAll(compressed, nil)
+	}
+	return nil, fmt.Errorf("unknown payload encoding %q", encoding)
+}
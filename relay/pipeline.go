@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+// pipeline is the part of the config that is compiled once rather than read
+// where it is used: the per-message stages, and the per-client limits and
+// profiles. A reload builds a new one from the new config and swaps it in
+// whole, like the config itself.
+type pipeline struct {
+	lookups       []lookupTable
+	transforms    []transformStep
+	muteRules     []*muteRule
+	profiles      map[string]subscriptionProfile
+	outboundLimit outboundLimitConfig
+	signingKeys   []signingKey
+}
+
+var activePipeline atomic.Pointer[pipeline]
+
+func init() {
+	activePipeline.Store(&pipeline{})
+}
+
+// stages returns the running pipeline.
+func stages() *pipeline {
+	return activePipeline.Load()
+}
+
+// newPipeline compiles the pipeline cfg describes, reporting every part of it
+// that is invalid.
+func newPipeline(cfg *viper.Viper) (*pipeline, error) {
+	var p pipeline
+	var errs []error
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+
+	var err error
+	p.lookups, err = readLookups(cfg)
+	check("enrichment.lookups", err)
+	p.transforms, err = readTransforms(cfg)
+	check("transforms", err)
+	p.muteRules, err = readMuteRules(cfg)
+	check("mute.rules", err)
+	p.profiles, err = readProfiles(cfg)
+	check("profiles", err)
+	p.outboundLimit, err = readOutboundLimit(cfg)
+	check("clients.rate_limit", err)
+	p.signingKeys, err = readSigningKeys(cfg)
+	check("signing.keys", err)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// usePipeline makes p the running pipeline. Mute rules that keep their name
+// keep their counts.
+func usePipeline(p *pipeline) {
+	previous := activePipeline.Swap(p)
+	for _, rule := range p.muteRules {
+		for _, old := range previous.muteRules {
+			if old.Name == rule.Name {
+				rule.muted.Store(old.muted.Load())
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package relay
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// prepareFrame returns frame as a prepared message, built on first use and
+// shared by every client it is written to. The message caches each encoding
+// it is written with, so a broadcast is framed, and with permessage-deflate
+// compressed, once per compression level rather than once per connection.
+// Without compression there is nothing to share, so it returns nil and the
+// frame is written as is, as it is if it can't be prepared.
+func prepareFrame(frame []byte) func() *websocket.PreparedMessage {
+	if !upgrader.EnableCompression {
+		return nil
+	}
+	return sync.OnceValue(func() *websocket.PreparedMessage {
+		pm, err := websocket.NewPreparedMessage(websocket.TextMessage, frame)
+		if err != nil {
+			return nil
+		}
+		return pm
+	})
+}
+
+// writeFrame writes out's text frame to c's WebSocket connection.
+func (c *client) writeFrame(out outbound) error {
+	if out.prepared != nil {
+		if pm := out.prepared(); pm != nil {
+			return c.conn.WritePreparedMessage(pm)
+		}
+	}
+	return c.conn.WriteMessage(websocket.TextMessage, out.frame)
+}
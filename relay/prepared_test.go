@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// loopbackClients connects n WebSocket clients over loopback and returns the
+// relay's side of each; the other side reads and discards every frame.
+func loopbackClients(b *testing.B, n int, compress bool) []*client {
+	b.Helper()
+	server := websocket.Upgrader{EnableCompression: compress}
+	conns := make(chan *websocket.Conn, n)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := server.Upgrade(w, r, nil)
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		conns <- conn
+	}))
+	b.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{EnableCompression: compress}
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	clients := make([]*client, 0, n)
+	for range n {
+		peer, resp, err := dialer.Dial(url, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		resp.Body.Close()
+		b.Cleanup(func() { peer.Close() })
+		go func() {
+			for {
+				if _, _, err := peer.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		conn := <-conns
+		b.Cleanup(func() { conn.Close() })
+		clients = append(clients, &client{conn: conn})
+	}
+	return clients
+}
+
+// BenchmarkBroadcastFrame writes a 1 KB frame to 200 clients, encoded for
+// each connection or prepared once for all of them. Preparing pays off only
+// with permessage-deflate, which is why prepareFrame is skipped without it.
+func BenchmarkBroadcastFrame(b *testing.B) {
+	frame := bytes.Repeat([]byte(`{"topic":"a.b","payload":{"n":1}}`), 32)[:1024]
+	for _, compress := range []bool{true, false} {
+		for _, prepared := range []bool{false, true} {
+			name := map[bool]string{true: "deflate", false: "plain"}[compress] +
+				map[bool]string{true: "/prepared", false: "/per_client"}[prepared]
+			b.Run(name, func(b *testing.B) {
+				clients := loopbackClients(b, 200, compress)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for range b.N {
+					out := outbound{frame: frame}
+					if prepared {
+						// As prepareFrame, which skips it without compression.
+						out.prepared = sync.OnceValue(func() *websocket.PreparedMessage {
+							pm, _ := websocket.NewPreparedMessage(websocket.TextMessage, frame)
+							return pm
+						})
+					}
+					for _, c := range clients {
+						if err := c.writeFrame(out); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+			})
+		}
+	}
+}
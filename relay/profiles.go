@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/spf13/viper"
+)
+
+const profileFormatBinary = "binary"
+
+// subscriptionProfile is a centrally managed subscription set a client selects
+// with ?profile=<name>. Fields, Sample and MaxRate apply to every profile
+// topic. Locked profiles refuse subscribe/unsubscribe.
+type subscriptionProfile struct {
+	Name    string   `mapstructure:"name"`
+	Topics  []string `mapstructure:"topics"`
+	Fields  []string `mapstructure:"fields"`
+	Sample  float64  `mapstructure:"sample"`
+	MaxRate string   `mapstructure:"max_rate"`
+	Format  string   `mapstructure:"format"`
+	Locked  bool     `mapstructure:"locked"`
+
+	options subscriptionOptions
+}
+
+func readProfiles(cfg *viper.Viper) (map[string]subscriptionProfile, error) {
+	var list []subscriptionProfile
+	if err := unmarshalConfigFrom(cfg, "profiles", &list); err != nil {
+		return nil, err
+	}
+	profiles := make(map[string]subscriptionProfile, len(list))
+	for _, p := range list {
+		opts, err := newSubscriptionOptions(p.Fields, p.Sample, p.MaxRate)
+		if err != nil {
+			return nil, fmt.Errorf("profile %q: %w", p.Name, err)
+		}
+		p.options = opts
+		profiles[p.Name] = p
+	}
+	return profiles, nil
+}
+
+// resolveProfile picks the profile for an upgrade: the one named by ?profile,
+// or the identity's first assigned profile. An identity with assigned profiles
+// may only use those. It returns false when the request must be rejected.
+func resolveProfile(r *http.Request, identity Identity) (*subscriptionProfile, bool) {
+	name := r.URL.Query().Get("profile")
+	if name == "" && len(identity.Profiles) > 0 {
+		name = identity.Profiles[0]
+	}
+	if name == "" {
+		return nil, true
+	}
+	p, ok := stages().profiles[name]
+	if !ok || (len(identity.Profiles) > 0 && !slices.Contains(identity.Profiles, name)) {
+		return nil, false
+	}
+	return &p, true
+}
+
+// applyProfile seeds c's subscriptions and format from p.
+func (c *client) applyProfile(p *subscriptionProfile) {
+	c.profile = p.Name
+	c.profileLocked = p.Locked
+	c.subscriptions = append([]string{}, p.Topics...)
+	c.setOptions(p.Topics, p.options)
+	if p.Format != "" {
+		c.binary = p.Format == profileFormatBinary
+	}
+}
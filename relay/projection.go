@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+)
+
+// projectPayload keeps only the given fields of a JSON object payload. Dotted
+// paths such as "device.id" keep the nested value. Payloads that aren't JSON
+// objects pass through unchanged.
+func projectPayload(body []byte, fields []string) []byte {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return body
+	}
+
+	out := make(map[string]any, len(fields))
+	for _, field := range fields {
+		copyField(doc, out, strings.Split(field, "."))
+	}
+	projected, err := json.Marshal(out)
+	if err != nil {
+		return body
+	}
+	return projected
+}
+
+func copyField(src, dst map[string]any, path []string) {
+	value, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+	nested, ok := value.(map[string]any)
+	if !ok {
+		return
+	}
+	child, ok := dst[path[0]].(map[string]any)
+	if !ok {
+		child = make(map[string]any)
+		dst[path[0]] = child
+	}
+	copyField(nested, child, path[1:])
+}
+
+// projection returns the sorted union of fields c wants for messages with the
+// given subscription key, or nil when any matching subscription takes the full
+// payload. Must be called with clientsMu held.
+func (c *client) projection(key string) []string {
+	if len(c.options) == 0 {
+		return nil
+	}
+	var fields []string
+	for _, pattern := range c.subscriptions {
+		if !topicMatches(pattern, key) {
+			continue
+		}
+		projected := c.options[pattern].fields
+		if len(projected) == 0 {
+			return nil
+		}
+		fields = append(fields, projected...)
+	}
+	slices.Sort(fields)
+	return slices.Compact(fields)
+}
+
+// projectFor returns the frames c should get for out, encoding a projected
+// variant at most once per field set through cache (which may be nil).
+// Must be called with clientsMu held.
+func (c *client) projectFor(out outbound, cache map[string]outbound) outbound {
+	fields := c.projection(out.key)
+	if fields == nil || out.project == nil {
+		return out
+	}
+	id := strings.Join(fields, ",")
+	if projected, ok := cache[id]; ok {
+		return projected
+	}
+	projected := out.project(fields)
+	if cache != nil {
+		cache[id] = projected
+	}
+	return projected
+}
@@ -0,0 +1,326 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Headers identifying who published a client message.
+const (
+	publishHeaderClient  = "x-relay-client-id"
+	publishHeaderTenant  = "x-relay-tenant"
+	publishHeaderSubject = "x-relay-subject"
+)
+
+var (
+	// errPublishNacked is returned for a publish the broker refused to confirm.
+	errPublishNacked = errors.New("broker nacked the message")
+	// errPublishReturned is returned for a publish no queue was bound to take.
+	errPublishReturned = errors.New("message was unroutable")
+)
+
+// publisher holds a RabbitMQ channel in confirm mode for publishing to the
+// exchange in its config section, such as client messages to
+// publish.exchange. It is opened on first use and reopened after a failed
+// publish.
+type publisher struct {
+	section string
+
+	mu sync.Mutex
+	ch *publishChannel
+}
+
+// publishChannel is an open publisher channel and the publishes on it still
+// waiting for the broker, by delivery tag. Guarded by the publisher's mu.
+type publishChannel struct {
+	conn    *amqp.Connection
+	ch      *amqp.Channel
+	lastTag uint64
+	pending map[uint64]*pendingPublish
+}
+
+// pendingPublish is a publish waiting for its confirmation. messageID matches
+// a basic.return to it, and returned is set when one arrives.
+type pendingPublish struct {
+	messageID string
+	returned  bool
+	done      chan error
+}
+
+var clientPublisher = publisher{section: "publish"}
+
+// publish publishes msg as mandatory and waits up to <section>.confirm_timeout
+// for the broker to confirm it. p.mu is only held to send, so publishes from
+// different clients are confirmed concurrently.
+func (p *publisher) publish(routingKey string, msg amqp.Publishing) error {
+	pc, tag, done, err := p.send(routingKey, msg)
+	if err != nil {
+		return err
+	}
+	timeout := max(conf().GetDuration(p.section+".confirm_timeout"), time.Second)
+	select {
+	case err = <-done:
+		return err
+	case <-time.After(timeout):
+		p.mu.Lock()
+		delete(pc.pending, tag) // a late confirmation is ignored
+		p.mu.Unlock()
+		return fmt.Errorf("publish wasn't confirmed within %s", timeout)
+	}
+}
+
+// send publishes msg and registers it as pending under its delivery tag.
+func (p *publisher) send(routingKey string, msg amqp.Publishing) (*publishChannel, uint64, chan error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.ch == nil {
+		if err := p.open(); err != nil {
+			return nil, 0, nil, err
+		}
+	}
+	pc := p.ch
+	err := pc.ch.Publish(conf().GetString(p.section+".exchange"), routingKey, true, false, msg)
+	if err != nil {
+		pc.conn.Close()
+		p.ch = nil
+		return nil, 0, nil, err
+	}
+	// The channel numbers publishes from 1 once in confirm mode; the
+	// confirmation can't be settled before this returns, as that takes p.mu.
+	pc.lastTag++
+	pending := &pendingPublish{messageID: msg.MessageId, done: make(chan error, 1)}
+	pc.pending[pc.lastTag] = pending
+	return pc, pc.lastTag, pending.done, nil
+}
+
+// open connects and declares the section's exchange and, if it names one,
+// a durable queue bound to it. Must be called with p.mu held.
+func (p *publisher) open() error {
+	conn, err := amqp.Dial(conf().GetString("rabbitmq.url"))
+	if err != nil {
+		return err
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	exchange := conf().GetString(p.section + ".exchange")
+	if exchange != "" {
+		kind := conf().GetString(p.section + ".exchange_type")
+		err = ch.ExchangeDeclare(exchange, kind, true, false, false, false, nil)
+	}
+	if queue := conf().GetString(p.section + ".queue"); err == nil && queue != "" {
+		_, err = ch.QueueDeclare(queue, true, false, false, false, nil)
+		if err == nil && exchange != "" {
+			err = ch.QueueBind(queue, "#", exchange, false, nil)
+		}
+	}
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	p.ch = &publishChannel{conn: conn, ch: ch, pending: make(map[uint64]*pendingPublish)}
+	returns := ch.NotifyReturn(make(chan amqp.Return, 16))
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+	go p.settle(p.ch, returns, confirms)
+	return nil
+}
+
+// settle resolves pending publishes on pc as the broker confirms them, until
+// the channel closes and fails whatever is left. The broker sends a
+// mandatory message's basic.return before its ack, from the same connection
+// reader, so returns already received are applied before each confirmation.
+func (p *publisher) settle(pc *publishChannel, returns <-chan amqp.Return, confirms <-chan amqp.Confirmation) {
+	for {
+		select {
+		case ret, ok := <-returns:
+			if ok {
+				p.markReturned(pc, ret)
+			} else {
+				returns = nil
+			}
+		case confirm, ok := <-confirms:
+			if !ok {
+				p.fail(pc, errors.New("channel closed before the publish was confirmed"))
+				return
+			}
+			for drained := false; !drained && returns != nil; {
+				select {
+				case ret, ok := <-returns:
+					if ok {
+						p.markReturned(pc, ret)
+					} else {
+						returns = nil
+					}
+				default:
+					drained = true
+				}
+			}
+			p.confirm(pc, confirm)
+		}
+	}
+}
+
+// markReturned flags the oldest pending publish with ret's message ID.
+func (p *publisher) markReturned(pc *publishChannel, ret amqp.Return) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var oldest uint64
+	for tag, pending := range pc.pending {
+		if pending.messageID == ret.MessageId && !pending.returned && (oldest == 0 || tag < oldest) {
+			oldest = tag
+		}
+	}
+	if oldest != 0 {
+		pc.pending[oldest].returned = true
+	}
+}
+
+func (p *publisher) confirm(pc *publishChannel, confirm amqp.Confirmation) {
+	p.mu.Lock()
+	pending, ok := pc.pending[confirm.DeliveryTag]
+	delete(pc.pending, confirm.DeliveryTag)
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	switch {
+	case !confirm.Ack:
+		pending.done <- errPublishNacked
+	case pending.returned:
+		pending.done <- errPublishReturned
+	default:
+		pending.done <- nil
+	}
+}
+
+// fail resolves every publish still pending on pc with err and drops pc.
+func (p *publisher) fail(pc *publishChannel, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for tag, pending := range pc.pending {
+		pending.done <- err
+		delete(pc.pending, tag)
+	}
+	if p.ch == pc {
+		pc.conn.Close()
+		p.ch = nil
+	}
+}
+
+// publishReadLimit is the WebSocket read limit needed to accept control
+// messages and, in bidirectional mode, payloads up to publish.max_size.
+func publishReadLimit() int64 {
+	if !conf().GetBool("publish.enabled") {
+		return controlReadLimit
+	}
+	return max(controlReadLimit, int64(conf().GetInt("publish.max_size"))+controlReadLimit)
+}
+
+// validatePublish checks a publish request from c against publish.max_size,
+// publish.allowed_topics, c's tenant and the per-client publish.rate.
+// Must be called with clientsMu held.
+func (c *client) validatePublish(msg controlMessage) error {
+	if !conf().GetBool("publish.enabled") {
+		return errors.New("publishing is disabled")
+	}
+	if msg.Topic == "" || len(msg.Payload) == 0 {
+		return errors.New("publish needs a topic and a payload")
+	}
+	if limit := conf().GetInt("publish.max_size"); len(msg.Payload) > limit {
+		return fmt.Errorf("payload of %d bytes exceeds the %d byte limit", len(msg.Payload), limit)
+	}
+	allowed := conf().GetStringSlice("publish.allowed_topics")
+	if !tenantAllows(c.tenant, msg.Topic) ||
+		(len(allowed) > 0 && !slices.ContainsFunc(allowed, func(p string) bool { return topicMatches(p, msg.Topic) })) {
+		return fmt.Errorf("publishing to %q is not allowed", msg.Topic)
+	}
+	if c.publishLimiter == nil {
+		rate, err := parseRate(conf().GetString("publish.rate"))
+		if err != nil {
+			return err
+		}
+		c.publishLimiter = newTokenBucket(rate, max(conf().GetInt("publish.burst"), 1))
+	}
+	if !c.publishLimiter.Allow() {
+		return errors.New("publish rate limit exceeded")
+	}
+	return nil
+}
+
+// handlePublish publishes a client message to publish.exchange, with the topic
+// as routing key unless publish.routing_key fixes one, and replies with
+// "published" once the broker confirms it or an error.
+func handlePublish(c *client, msg controlMessage) {
+	clientsMu.Lock()
+	err := c.validatePublish(msg)
+	clientsMu.Unlock()
+	if err == nil {
+		if err = authorize(context.Background(), c.authzFor(authzPublish, msg.Topic)); err != nil {
+			err = fmt.Errorf("publishing to %q is %w", msg.Topic, err)
+		}
+	}
+
+	if err == nil {
+		routingKey := conf().GetString("publish.routing_key")
+		if routingKey == "" {
+			routingKey = msg.Topic
+		}
+		err = clientPublisher.publish(routingKey, amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			MessageId:    newID(),
+			AppId:        "event-relay",
+			Timestamp:    time.Now(),
+			Headers: amqp.Table{
+				publishHeaderClient:  c.id,
+				publishHeaderTenant:  c.tenant,
+				publishHeaderSubject: c.subject,
+			},
+			Body: msg.Payload,
+		})
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "client_publish",
+				"status": "failed",
+				"client": c.remoteAddr,
+				"topic":  msg.Topic,
+				"error":  err.Error(),
+			}).Error("Failed to publish client message to RabbitMQ")
+			switch {
+			case errors.Is(err, errPublishNacked):
+				err = errors.New("publish rejected by the broker")
+			case errors.Is(err, errPublishReturned):
+				err = errors.New("publish not routed to any queue")
+			default:
+				err = errors.New("publish failed")
+			}
+		}
+	}
+
+	reply := controlReply{ID: msg.ID, Type: "published", Topics: []string{msg.Topic}}
+	status := "published"
+	if err != nil {
+		reply = controlReply{ID: msg.ID, Type: "error", Error: err.Error()}
+		status = "rejected"
+	}
+	reply.ServerTime = time.Now().UTC()
+	clientPublishes.WithLabelValues(status).Inc()
+
+	frame, _ := json.Marshal(reply)
+	clientsMu.Lock()
+	c.enqueue(queuedFrame{out: outbound{frame: frame}, control: true}, true)
+	clientsMu.Unlock()
+}
@@ -0,0 +1,53 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestPublisherSettlesByDeliveryTag(t *testing.T) {
+	closed := errors.New("channel closed")
+	tests := []struct {
+		messageID string
+		confirm   *amqp.Confirmation
+		want      error
+	}{
+		{"a", &amqp.Confirmation{DeliveryTag: 1, Ack: true}, nil},
+		{"b", &amqp.Confirmation{DeliveryTag: 2, Ack: true}, errPublishReturned},
+		{"c", &amqp.Confirmation{DeliveryTag: 3}, errPublishNacked},
+		{"d", nil, closed},
+	}
+	// Repeated, since settle may see a confirmation before the return it
+	// follows.
+	for range 20 {
+		p := &publisher{section: "publish"}
+		pc := &publishChannel{pending: make(map[uint64]*pendingPublish)}
+		returns := make(chan amqp.Return, 1)
+		confirms := make(chan amqp.Confirmation, len(tests))
+		dones := make([]chan error, len(tests))
+		for i, tt := range tests {
+			dones[i] = make(chan error, 1)
+			pc.pending[uint64(i+1)] = &pendingPublish{messageID: tt.messageID, done: dones[i]}
+		}
+		// Confirmations arrive out of order; the return precedes its ack.
+		confirms <- *tests[2].confirm
+		returns <- amqp.Return{MessageId: "b"}
+		confirms <- *tests[1].confirm
+		confirms <- *tests[0].confirm
+		close(confirms)
+
+		p.settle(pc, returns, confirms)
+		for i, tt := range tests {
+			got := <-dones[i]
+			if tt.want == closed {
+				if got == nil || errors.Is(got, errPublishNacked) || errors.Is(got, errPublishReturned) {
+					t.Errorf("publish %s = %v, want a closed channel error", tt.messageID, got)
+				}
+			} else if !errors.Is(got, tt.want) {
+				t.Errorf("publish %s = %v, want %v", tt.messageID, got, tt.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package relay
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// rateLimiter decides whether one more event fits in a limit.
+type rateLimiter interface {
+	Allow() bool
+}
+
+// tokenBucket is a minimal in-process token bucket limiter. A zero rate disables it.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) Allow() bool {
+	if b.rate <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// delay is how long until Allow would next succeed.
+func (b *tokenBucket) delay() time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tokens := min(b.burst, b.tokens+time.Since(b.last).Seconds()*b.rate)
+	if tokens >= 1 {
+		return 0
+	}
+	return time.Duration(math.Ceil((1 - tokens) / b.rate * float64(time.Second)))
+}
+
+// retryAfter returns the reconnect delay suggested to clients: the configured
+// base plus random jitter, so rejected clients don't come back in lockstep.
+func retryAfter(base, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return base
+	}
+	return base + rand.N(jitter) //nolint:gosec // jitter doesn't need a secure source
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"context"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const rateLimitBackendRedis = "redis"
+
+// redisTokenBucket refills and takes a token atomically, using the Redis clock
+// so replicas with skewed clocks share one consistent bucket.
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) + tonumber(t[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(state[1]) or burst
+local last = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + (now - last) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tokens, 'last', now)
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return allowed
+`)
+
+var (
+	redisClient     *redis.Client
+	redisClientOnce sync.Once
+
+	// redisFailureLog keeps an outage from logging on every limited call.
+	redisFailureLog = newTokenBucket(1.0/60, 1)
+)
+
+func sharedRedisClient() *redis.Client {
+	redisClientOnce.Do(func() {
+		redisClient = redis.NewClient(&redis.Options{
+			Addr:     conf().GetString("ratelimit.redis.address"),
+			Password: conf().GetString("ratelimit.redis.password"),
+			DB:       conf().GetInt("ratelimit.redis.db"),
+		})
+	})
+	return redisClient
+}
+
+// redisLimiter is a token bucket shared by every replica through Redis.
+type redisLimiter struct {
+	client *redis.Client
+	key    string
+	rate   float64
+	burst  int
+}
+
+// newRateLimiter returns a limiter for the named limit on the configured
+// ratelimit.backend. A zero rate disables the limit on either backend.
+func newRateLimiter(name string, rate float64, burst int) rateLimiter {
+	if rate <= 0 || conf().GetString("ratelimit.backend") != rateLimitBackendRedis {
+		return newTokenBucket(rate, burst)
+	}
+	return &redisLimiter{
+		client: sharedRedisClient(),
+		key:    conf().GetString("ratelimit.redis.prefix") + name,
+		rate:   rate,
+		burst:  burst,
+	}
+}
+
+// Allow fails open: when Redis is unreachable the limit is not enforced rather
+// than rejecting every caller.
+func (l *redisLimiter) Allow() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), conf().GetDuration("ratelimit.redis.timeout"))
+	defer cancel()
+
+	allowed, err := redisTokenBucket.Run(ctx, l.client, []string{l.key}, l.rate, l.burst).Int()
+	if err != nil {
+		if !redisFailureLog.Allow() {
+			return true
+		}
+		log.WithFields(logrus.Fields{
+			"event":  "rate_limit",
+			"status": "backend_failed",
+			"key":    l.key,
+			"error":  err.Error(),
+		}).Warn("Rate limit backend unavailable, allowing request")
+		return true
+	}
+	return allowed == 1
+}
@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+type deliveryReceipt struct {
+	EventID          string    `json:"event_id"`
+	Topic            string    `json:"topic"`
+	ClientsMatched   int       `json:"clients_matched"`
+	ClientsDelivered int       `json:"clients_delivered"`
+	Timestamp        time.Time `json:"timestamp"`
+}
+
+// receiptsCh holds one receipt channel per RabbitMQ source, keyed by source name.
+var (
+	receiptsCh = make(map[string]*amqp.Channel)
+	receiptsMu sync.Mutex
+)
+
+// openReceiptChannel prepares the channel receipts for source are published
+// on. It shares the source's connection and is replaced on every reconnect.
+func openReceiptChannel(source string, conn *amqp.Connection) error {
+	if !conf().GetBool("receipts.enabled") {
+		return nil
+	}
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	exchange := conf().GetString("receipts.exchange")
+	kind := conf().GetString("receipts.exchange_type")
+	if err = ch.ExchangeDeclare(exchange, kind, true, false, false, false, nil); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":    "receipts_exchange",
+			"status":   "failed",
+			"exchange": exchange,
+			"error":    err.Error(),
+		}).Error("Failed to declare receipts exchange")
+		return err
+	}
+
+	receiptsMu.Lock()
+	receiptsCh[source] = ch
+	receiptsMu.Unlock()
+	return nil
+}
+
+func closeReceiptChannel(source string) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	if ch, ok := receiptsCh[source]; ok {
+		ch.Close()
+		delete(receiptsCh, source)
+	}
+}
+
+// publishReceipt reports a delivery back over its source's connection. Sources
+// without one, such as the demo generator, publish no receipts.
+func publishReceipt(source string, msg amqp.Delivery, matched, delivered int) {
+	if !conf().GetBool("receipts.enabled") {
+		return
+	}
+	receipt := deliveryReceipt{
+		EventID:          msg.MessageId,
+		Topic:            msg.RoutingKey,
+		ClientsMatched:   matched,
+		ClientsDelivered: delivered,
+		Timestamp:        time.Now().UTC(),
+	}
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return
+	}
+	routingKey := conf().GetString("receipts.routing_key")
+	if routingKey == "" {
+		routingKey = msg.RoutingKey
+	}
+
+	receiptsMu.Lock()
+	ch := receiptsCh[source]
+	receiptsMu.Unlock()
+	if ch == nil {
+		return
+	}
+	err = ch.Publish(conf().GetString("receipts.exchange"), routingKey, false, false, amqp.Publishing{
+		ContentType:   "application/json",
+		CorrelationId: msg.MessageId,
+		Timestamp:     receipt.Timestamp,
+		Body:          body,
+	})
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "delivery_receipt",
+			"status": "failed",
+			"topic":  msg.RoutingKey,
+			"error":  err.Error(),
+		}).Error("Failed to publish delivery receipt")
+	}
+}
@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Reconnect causes group the reasons SDKs report in their hello.
+const (
+	reconnectCauseServer  = "server"
+	reconnectCauseNetwork = "network"
+	reconnectCauseClient  = "client"
+	reconnectCauseUnknown = "unknown"
+
+	// reconnectReasonNetwork is what SDKs report for a connection that failed
+	// on their side, with no close frame from the server.
+	reconnectReasonNetwork = "network"
+	reconnectReasonOther   = "other"
+)
+
+// previousSession is what an SDK reports in its hello about the connection it
+// is reconnecting after.
+type previousSession struct {
+	DurationSeconds  float64 `json:"duration_s"`
+	MessagesReceived int64   `json:"messages_received"`
+	CloseCode        int     `json:"close_code,omitempty"`
+}
+
+type reconnectStat struct {
+	Cause            string  `json:"cause"`
+	Count            int64   `json:"count"`
+	AvgSessionS      float64 `json:"avg_session_s"`
+	MessagesReceived int64   `json:"messages_received"`
+
+	sessionSeconds float64
+	sessions       int64
+}
+
+var (
+	reconnectStats   = make(map[string]*reconnectStat)
+	reconnectStatsMu sync.Mutex
+)
+
+// reconnectCause normalizes a reported reason to the disconnect taxonomy, so
+// SDKs can't grow metric labels, and says who caused it.
+func reconnectCause(reported string) (reason, cause string) {
+	switch disconnectReason(reported) {
+	case reasonAuthExpired, reasonSlowConsumer, reasonServerDrain, reasonPolicyViolation,
+		reasonIdleTimeout, reasonReplaced, reasonKicked:
+		return reported, reconnectCauseServer
+	case reasonConnectionLost, reconnectReasonNetwork:
+		return reported, reconnectCauseNetwork
+	case reasonClientClosed:
+		return reported, reconnectCauseClient
+	}
+	return reconnectReasonOther, reconnectCauseUnknown
+}
+
+// recordReconnect aggregates the reconnect a hello from c reports. Only a
+// client's first hello counts, and hellos without a reconnect_reason are
+// first connections.
+// Must be called with clientsMu held.
+func (c *client) recordReconnect(msg controlMessage) {
+	if msg.ReconnectReason == "" || c.reconnectReported {
+		return
+	}
+	c.reconnectReported = true
+	reason, cause := reconnectCause(msg.ReconnectReason)
+	clientReconnects.WithLabelValues(reason, cause).Inc()
+
+	reconnectStatsMu.Lock()
+	defer reconnectStatsMu.Unlock()
+	stat, ok := reconnectStats[reason]
+	if !ok {
+		stat = &reconnectStat{Cause: cause}
+		reconnectStats[reason] = stat
+	}
+	stat.Count++
+	if prev := msg.PreviousSession; prev != nil {
+		seconds := max(prev.DurationSeconds, 0)
+		clientPreviousSession.WithLabelValues(cause).Observe(seconds)
+		stat.sessionSeconds += seconds
+		stat.sessions++
+		stat.MessagesReceived += max(prev.MessagesReceived, 0)
+	}
+}
+
+func handleReconnects(w http.ResponseWriter, _ *http.Request) {
+	reconnectStatsMu.Lock()
+	view := make(map[string]reconnectStat, len(reconnectStats))
+	for reason, stat := range reconnectStats {
+		v := *stat
+		if v.sessions > 0 {
+			v.AvgSessionS = v.sessionSeconds / float64(v.sessions)
+		}
+		view[reason] = v
+	}
+	reconnectStatsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
@@ -0,0 +1,123 @@
+package relay
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	deliveryCountHeader = "x-delivery-count"
+	deathHeader         = "x-death"
+
+	// maxTrackedRequeues bounds requeueCounts. Past it the counts start over,
+	// which only delays reaching rabbitmq.ack.max_redeliveries.
+	maxTrackedRequeues = 100_000
+)
+
+var (
+	// requeueCounts counts how often the relay requeued a message, for
+	// queues that don't count deliveries themselves. It is keyed by
+	// requeueKey and forgotten once the message is settled otherwise.
+	requeueCounts   = make(map[uint64]int)
+	requeueCountsMu sync.Mutex
+)
+
+// redeliveries returns how often msg was delivered before: the
+// x-delivery-count header quorum queues set, or else the times the x-death
+// header says it was dead-lettered back to a queue plus the relay's own count
+// of requeueing it.
+func redeliveries(msg amqp.Delivery) int {
+	if n, ok := headerCount(msg.Headers[deliveryCountHeader]); ok {
+		return n
+	}
+	requeueCountsMu.Lock()
+	defer requeueCountsMu.Unlock()
+	return deaths(msg) + requeueCounts[requeueKey(msg)]
+}
+
+// noteRequeue counts requeueing msg when its queue doesn't.
+func noteRequeue(msg amqp.Delivery) {
+	if _, ok := msg.Headers[deliveryCountHeader]; ok {
+		return
+	}
+	requeueCountsMu.Lock()
+	defer requeueCountsMu.Unlock()
+	if len(requeueCounts) >= maxTrackedRequeues {
+		clear(requeueCounts)
+	}
+	requeueCounts[requeueKey(msg)]++
+}
+
+// forgetRequeues drops the count of a message that was settled. Every ack,
+// reject and dead-lettering that ends a delivery calls it.
+func forgetRequeues(msg amqp.Delivery) {
+	if !msg.Redelivered {
+		return
+	}
+	requeueCountsMu.Lock()
+	delete(requeueCounts, requeueKey(msg))
+	requeueCountsMu.Unlock()
+}
+
+// deaths sums the counts in msg's x-death header, which RabbitMQ adds each
+// time a dead-letter exchange routes the message, for example back to its
+// queue after a retry TTL.
+func deaths(msg amqp.Delivery) int {
+	entries, _ := msg.Headers[deathHeader].([]any)
+	n := 0
+	for _, e := range entries {
+		if table, ok := e.(amqp.Table); ok {
+			if count, ok := headerCount(table["count"]); ok {
+				n += count
+			}
+		}
+	}
+	return n
+}
+
+// requeueKey identifies msg across redeliveries by its message ID. Without
+// one it falls back to hashing the properties the publisher set and the body,
+// so identical messages published without IDs share a count.
+func requeueKey(msg amqp.Delivery) uint64 {
+	h := fnv.New64a()
+	if msg.MessageId != "" {
+		_, _ = h.Write([]byte("id:" + msg.MessageId))
+		return h.Sum64()
+	}
+	_, _ = h.Write([]byte("body:" + msg.RoutingKey + "\x00" + msg.CorrelationId + "\x00"))
+	if !msg.Timestamp.IsZero() {
+		_, _ = h.Write(strconv.AppendInt(nil, msg.Timestamp.UnixNano(), 10))
+	}
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(msg.Body)
+	return h.Sum64()
+}
+
+// headerCount reads a count from an AMQP header value of any integer type.
+func headerCount(v any) (int, bool) {
+	switch n := v.(type) {
+	case int:
+		return n, true
+	case int8:
+		return int(n), true
+	case int16:
+		return int(n), true
+	case int32:
+		return int(n), true
+	case int64:
+		return int(n), true
+	case uint8:
+		return int(n), true
+	case uint16:
+		return int(n), true
+	case uint32:
+		return int(n), true
+	case string:
+		i, err := strconv.Atoi(n)
+		return i, err == nil
+	}
+	return 0, false
+}
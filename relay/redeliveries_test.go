@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// recordedAcks is an amqp.Acknowledger that records how deliveries are settled.
+type recordedAcks struct {
+	mu       sync.Mutex
+	acks     int
+	requeued int
+	rejected int
+}
+
+func (r *recordedAcks) Ack(uint64, bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.acks++
+	return nil
+}
+
+func (r *recordedAcks) Nack(_ uint64, _ bool, requeue bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if requeue {
+		r.requeued++
+	} else {
+		r.rejected++
+	}
+	return nil
+}
+
+func (r *recordedAcks) Reject(_ uint64, requeue bool) error {
+	return r.Nack(0, false, requeue)
+}
+
+func (r *recordedAcks) counts() (acks, requeued, rejected int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.acks, r.requeued, r.rejected
+}
+
+func TestHeaderCount(t *testing.T) {
+	tests := []struct {
+		value any
+		n     int
+		ok    bool
+	}{
+		{int64(3), 3, true},
+		{int32(2), 2, true},
+		{uint8(1), 1, true},
+		{"4", 4, true},
+		{"four", 0, false},
+		{nil, 0, false},
+		{1.5, 0, false},
+	}
+	for _, tt := range tests {
+		if n, ok := headerCount(tt.value); n != tt.n || ok != tt.ok {
+			t.Errorf("headerCount(%#v) = %d, %v, want %d, %v", tt.value, n, ok, tt.n, tt.ok)
+		}
+	}
+}
+
+func TestRedeliveries(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      amqp.Delivery
+		requeues int
+		want     int
+	}{
+		{"delivery count header", amqp.Delivery{Headers: amqp.Table{deliveryCountHeader: int64(4)}}, 2, 4},
+		{"counted by message id", amqp.Delivery{MessageId: "m-1", Body: []byte("a")}, 2, 2},
+		{"counted by body", amqp.Delivery{RoutingKey: "a.b", Body: []byte("no id")}, 3, 3},
+		{"dead-lettered back", amqp.Delivery{MessageId: "m-3", Headers: amqp.Table{deathHeader: []any{
+			amqp.Table{"count": int64(2), "reason": "rejected", "queue": "work"},
+			amqp.Table{"count": int64(1), "reason": "expired", "queue": "work.retry"},
+		}}}, 1, 4},
+		{"never requeued", amqp.Delivery{MessageId: "m-2"}, 0, 0},
+	}
+	for _, tt := range tests {
+		for range tt.requeues {
+			noteRequeue(tt.msg)
+		}
+		if got := redeliveries(tt.msg); got != tt.want {
+			t.Errorf("%s: redeliveries() = %d, want %d", tt.name, got, tt.want)
+		}
+		tt.msg.Redelivered = true
+		forgetRequeues(tt.msg)
+	}
+}
+
+func TestRequeueKeyWithoutMessageID(t *testing.T) {
+	first := amqp.Delivery{RoutingKey: "a.b", Timestamp: time.Unix(1, 0), Body: []byte("same")}
+	second := first
+	second.Timestamp = time.Unix(2, 0)
+	if requeueKey(first) == requeueKey(second) {
+		t.Error("identical bodies published at different times share a requeue key")
+	}
+	second = first
+	second.CorrelationId = "c-2"
+	if requeueKey(first) == requeueKey(second) {
+		t.Error("identical bodies with different correlation IDs share a requeue key")
+	}
+}
+
+func TestRejectForgetsRequeues(t *testing.T) {
+	useConfig(t, `rabbitmq:
+  ack:
+    mode: broadcast
+    on_failure: reject
+`)
+	msg := amqp.Delivery{Acknowledger: &recordedAcks{}, MessageId: "rejected", Redelivered: true}
+	noteRequeue(msg)
+	newDeliveryAck("rabbitmq", msg).resolve(false)
+	if n := redeliveries(msg); n != 0 {
+		t.Errorf("still counting %d redeliveries after the delivery was rejected", n)
+	}
+}
+
+func TestNackCapsRedeliveries(t *testing.T) {
+	useConfig(t, `rabbitmq:
+  ack:
+    mode: broadcast
+    on_failure: requeue
+    requeue_delay: 0s
+    max_redeliveries: 2
+`)
+	acks := &recordedAcks{}
+	msg := amqp.Delivery{Acknowledger: acks, MessageId: "poison", RoutingKey: "a.b"}
+	t.Cleanup(func() { forgetRequeues(amqp.Delivery{MessageId: "poison", Redelivered: true}) })
+
+	for i := range 3 {
+		a := newDeliveryAck("rabbitmq", msg)
+		a.resolve(false) // no client got it
+		msg.Redelivered = true
+
+		want := min(i+1, 2)
+		deadline := time.Now().Add(time.Second)
+		for _, requeued, _ := acks.counts(); requeued < want && time.Now().Before(deadline); _, requeued, _ = acks.counts() {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if _, requeued, rejected := acks.counts(); requeued != 2 || rejected != 1 {
+		t.Errorf("requeued %d and rejected %d times, want 2 and 1", requeued, rejected)
+	}
+	if n := redeliveries(msg); n != 0 {
+		t.Errorf("still counting %d redeliveries after the delivery was rejected", n)
+	}
+}
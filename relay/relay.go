@@ -0,0 +1,540 @@
+// Package relay fans events out from RabbitMQ, an upstream relay or an
+// embedding program to WebSocket and SSE clients.
+//
+// The relay keeps its state in package variables rather than in a Relay:
+// its config, clients, pipeline and metrics. So a process can create only
+// one Relay, and Run it only once. Creating the Relay also takes over
+// process-wide facilities. Its metrics register with the default Prometheus
+// registry, and New configures its own logger. Serving installs handlers for
+// SIGHUP, which reloads the config, and for SIGQUIT, which dumps
+// diagnostics. Embedding programs must not use these for anything else.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// client is a connected subscriber: a WebSocket connection, or an SSE
+// stream when sse is set and conn is nil.
+type client struct {
+	conn        *websocket.Conn
+	sse         *sseStream
+	id          string
+	tenant      string
+	subject     string
+	claims      map[string]any
+	binary      bool
+	remoteAddr  string
+	connectedAt time.Time
+	usage       clientUsage
+	stats       clientStats
+	compression clientCompression
+	queues      clientQueues
+
+	// subscriptions are the topic patterns the client asked for; nil until its
+	// first subscribe or unsubscribe or a profile sets them. options holds the
+	// projection and sampling of a pattern. Guarded by clientsMu.
+	subscriptions []string
+	options       map[string]subscriptionOptions
+	profile       string
+	profileLocked bool
+	// capabilities are the negotiated hello capabilities, nil for clients
+	// that never sent a hello. Guarded by clientsMu.
+	capabilities map[string]bool
+	// reconnectReported is set once a hello reported why c reconnected.
+	// Guarded by clientsMu.
+	reconnectReported bool
+	// filter is the ?filter= expression messages must pass, nil for none.
+	filter *messageFilter
+	// degradedAt is when c was limited to priority topics for falling
+	// behind, zero while it isn't. Guarded by clientsMu.
+	degradedAt time.Time
+	// publishLimiter enforces publish.rate, created on the first publish.
+	// Guarded by clientsMu.
+	publishLimiter *tokenBucket
+	// limiter paces messages to clients.rate_limit. Only the writer
+	// goroutine uses it.
+	limiter *outboundLimiter
+	// expiresAt is when the client's credentials expire, zero for never;
+	// expiry then closes it. Guarded by clientsMu.
+	expiresAt time.Time
+	expiry    *time.Timer
+	// closing is set once closeClient has begun closing the connection.
+	// Guarded by clientsMu.
+	closing bool
+}
+
+// wants reports whether out, a message on topic, should be delivered to c:
+// it is addressed to c and c's filter passes it. Must be called with
+// clientsMu held.
+func (c *client) wants(topic string, out outbound) bool {
+	return c.addressed(topic, out) && c.filter.accepts(topic, out)
+}
+
+// addressed reports whether c's tenant allows topic and a subscription of c
+// matches out. Must be called with clientsMu held.
+func (c *client) addressed(topic string, out outbound) bool {
+	return tenantAllows(c.tenant, topic) && c.subscribed(out.key)
+}
+
+var (
+	upgrader  = websocket.Upgrader{CheckOrigin: checkOrigin}
+	clients   = make(map[*client]struct{})
+	clientsMu sync.Mutex
+	log       = logrus.New()
+)
+
+// Config sets up a Relay. Everything else is read from the config file, as
+// the standalone binary does.
+type Config struct {
+	// File is the config file to read; empty looks for config.yaml in the
+	// working directory.
+	File string
+	// Settings override values from the file, keyed like "server.port".
+	Settings map[string]any
+	// Demo generates synthetic events instead of consuming a source.
+	Demo bool
+
+	// The hooks below are optional. They are called on the relay's own
+	// goroutines, outside its locks, and should return quickly.
+
+	// OnStart is called once Run has started serving, before it consumes.
+	OnStart func()
+	// OnClientConnect is called for every client once it is registered.
+	OnClientConnect func(ClientInfo)
+	// OnClientDisconnect is called for every client that connected, once it
+	// has been unregistered, with why it disconnected.
+	OnClientDisconnect func(info ClientInfo, reason string)
+	// OnMessage is called for every message after it was broadcast.
+	OnMessage func(MessageInfo)
+	// OnShutdown is called once shutdown has drained and closed the clients.
+	OnShutdown func()
+}
+
+// Relay is an event relay embedded in another program. Its state is
+// process-wide, as the package documentation describes, so a process can
+// create only one.
+type Relay struct {
+	cfg   Config
+	start sync.Once
+}
+
+var created atomic.Bool
+
+// New reads the configuration, sets up logging and compiles the pipeline:
+// lookup tables, transforms, mute rules, profiles, client rate limit and
+// signing keys. The relay serves nothing until Run or Soak.
+func New(cfg Config) (*Relay, error) {
+	if !created.CompareAndSwap(false, true) {
+		return nil, errors.New("relay: a Relay was already created in this process")
+	}
+	configFile = cfg.File
+	if configFile == "" {
+		configFile = "config.yaml"
+	}
+	configOverrides = cfg.Settings
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("relay: read config: %w", err)
+	}
+	settings, err := newConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("relay: read config: %w", err)
+	}
+	if err := validateConfig(settings); err != nil {
+		return nil, fmt.Errorf("relay: invalid config: %w", err)
+	}
+	runningConfig.Store(settings)
+
+	log.SetFormatter(&logrus.JSONFormatter{})
+	logFile := &lumberjack.Logger{
+		Filename:   conf().GetString("log.file_path"),
+		MaxSize:    conf().GetInt("log.max_size"),
+		MaxBackups: conf().GetInt("log.max_backups"),
+		MaxAge:     conf().GetInt("log.max_age"),
+		Compress:   conf().GetBool("log.compress"),
+	}
+	multiWriter := io.MultiWriter(os.Stdout, logFile)
+	log.SetOutput(multiWriter)
+	applyLogLevel()
+
+	p, err := newPipeline(settings)
+	if err != nil {
+		return nil, fmt.Errorf("relay: %w", err)
+	}
+	usePipeline(p)
+	hooks = lifecycleHooks{
+		onStart:            cfg.OnStart,
+		onClientConnect:    cfg.OnClientConnect,
+		onClientDisconnect: cfg.OnClientDisconnect,
+		onMessage:          cfg.OnMessage,
+		onShutdown:         cfg.OnShutdown,
+	}
+	return &Relay{cfg: cfg}, nil
+}
+
+// serve starts diagnostics, config reload, tracing and the listeners, once.
+func (r *Relay) serve() {
+	r.start.Do(func() {
+		startDiagnostics()
+		startConfigReload()
+		initTracing()
+		log.WithFields(logrus.Fields{
+			"event":  "service_start",
+			"status": "initializing",
+			"demo":   r.cfg.Demo,
+		}).Info("Service started")
+		startWebSocketServer()
+	})
+}
+
+// Run serves clients and relays events from the configured source until ctx
+// is done, then drains and closes every client. It must be called at most
+// once, and not together with Soak.
+func (r *Relay) Run(ctx context.Context) {
+	src := newSource(sourceType(r.cfg.Demo))
+	r.serve()
+	startHA(ctx)
+	stopBackplane := startBackplane(ctx)
+	stopSynthetic := startSynthetic(ctx)
+	stopDeadLetters := startDeadLetters()
+	context.AfterFunc(ctx, func() { resumeBroadcasting() }) // let paused sources see ctx is done
+	hooks.started()
+	src.Run(ctx)
+	stopSynthetic()
+	stopBackplane()
+	shutdown()
+	stopDeadLetters()
+	closeDrainedSources()
+	flushCtx, cancel := context.WithTimeout(context.Background(), conf().GetDuration("shutdown.drain_timeout"))
+	defer cancel()
+	shutdownTracing(flushCtx)
+}
+
+// Soak runs a soak test with demo traffic and clientCount churning clients
+// for duration instead of Run. It exits non-zero on a suspected leak.
+func (r *Relay) Soak(duration time.Duration, clientCount int) {
+	r.serve()
+	startSynthetic(context.Background())
+	runSoak(duration, clientCount)
+}
+
+// Broadcast relays payload to subscribed clients as if consumed from a source
+// named "embedded". It has no routing key, so its topic comes from
+// topics.infer.
+func (r *Relay) Broadcast(payload []byte) {
+	dispatchDelivery("embedded", amqp.Delivery{
+		MessageId:   newID(),
+		ContentType: "application/json",
+		Timestamp:   time.Now(),
+		Body:        payload,
+	})
+}
+
+// Clients describes every connected client.
+func (r *Relay) Clients() []ClientInfo {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	infos := make([]ClientInfo, 0, len(clients))
+	for c := range clients {
+		infos = append(infos, c.view())
+	}
+	return infos
+}
+
+func startWebSocketServer() {
+	initAcceptLimiter()
+	initAuthenticator()
+	initAuthz()
+	initCompression()
+	handle(endpointsWS, "/ws", handleWebSocket)
+	handle(endpointsWS, "GET /events", handleSSE)
+	handle(endpointsWS, "GET /lb-weight", handleLBWeight)
+	handle(endpointsHealth, "GET /healthz", handleHealthz)
+	handle(endpointsHealth, "GET /readyz", handleReadyz)
+	registerTenantRoutes()
+	handle(endpointsAPI, "GET /api/info", handleInfo)
+	handle(endpointsAPI, "GET /api/time", handleTime)
+	handle(endpointsAPI, "GET /api/subscribers", handleSubscribers)
+	handle(endpointsAPI, "GET /api/events/{id}/body", handleEventBody)
+	handle(endpointsAPI, "GET /api/signing-keys", handleSigningKeys)
+	if conf().GetBool("webhooks.enabled") {
+		registerWebhookRoutes()
+	}
+	if conf().GetString("admin.token") != "" {
+		registerAdminRoutes()
+	}
+	registerTenantAdminRoutes()
+	if conf().GetBool("metrics.enabled") {
+		registerMetricsRoutes()
+	}
+	startListeners()
+}
+
+// admitClient runs the checks shared by every client transport: rate limit,
+// tenant, authentication, profile, duplicate ID and authorization of the
+// topics, which are the patterns the client subscribes to on connecting, or
+// nil when it subscribes later. It returns the client
+// with its reader and writer goroutines reserved, or false after responding
+// with the error.
+func admitClient(w http.ResponseWriter, r *http.Request, topics []string) (*client, bool) {
+	if !admitConnection(w, r) {
+		return nil, false
+	}
+
+	tenant, ok := resolveTenant(r)
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"event":  "websocket_tenant",
+			"status": "rejected",
+			"client": r.RemoteAddr,
+			"host":   r.Host,
+		}).Warn("Rejected connection without a known tenant")
+		http.Error(w, "unknown tenant", http.StatusForbidden)
+		return nil, false
+	}
+
+	identity, ok := authenticateUpgrade(w, r, tenant)
+	if !ok {
+		return nil, false
+	}
+	if tenant == "" {
+		tenant = identity.Tenant
+	}
+
+	profile, ok := resolveProfile(r, identity)
+	if !ok {
+		log.WithFields(logrus.Fields{
+			"event":   "websocket_profile",
+			"status":  "rejected",
+			"client":  r.RemoteAddr,
+			"profile": r.URL.Query().Get("profile"),
+		}).Warn("Rejected connection with an unknown or unassigned profile")
+		http.Error(w, "unknown profile", http.StatusForbidden)
+		return nil, false
+	}
+
+	filter, err := compileFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "websocket_filter",
+			"status": "rejected",
+			"client": r.RemoteAddr,
+			"error":  err.Error(),
+		}).Warn("Rejected connection with an invalid filter")
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+
+	id := clientID(r)
+	if rejectDuplicate(tenant, identity.Subject, id) {
+		log.WithFields(logrus.Fields{
+			"event":     "websocket_duplicate",
+			"status":    "rejected",
+			"client_id": id,
+			"client":    r.RemoteAddr,
+		}).Warn("Rejected connection with an already connected client ID")
+		http.Error(w, "client already connected", http.StatusConflict)
+		return nil, false
+	}
+
+	c := &client{
+		id:          id,
+		tenant:      tenant,
+		subject:     identity.Subject,
+		claims:      identity.Claims,
+		expiresAt:   identity.ExpiresAt,
+		binary:      r.URL.Query().Get("binary") == "1",
+		remoteAddr:  r.RemoteAddr,
+		connectedAt: time.Now(),
+		compression: clientCompression{negotiated: negotiatedCompression(r)},
+		queues:      newClientQueues(),
+		limiter:     newOutboundLimiter(),
+		filter:      filter,
+	}
+	if profile != nil {
+		c.applyProfile(profile)
+	}
+	if topics != nil && !c.profileLocked {
+		c.subscriptions = topics
+	}
+	if !authorizeClient(w, r, c) {
+		return nil, false
+	}
+	if !admitGoroutine(w, c) {
+		return nil, false
+	}
+	return c, true
+}
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	c, ok := admitClient(w, r, nil)
+	if !ok {
+		return
+	}
+	defer goroutines.release(c, "reader")
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		goroutines.release(c, "writer")
+		log.WithFields(logrus.Fields{
+			"event":  "websocket_upgrade",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Error("Failed to upgrade connection")
+		return
+	}
+	defer conn.Close()
+	c.conn = conn
+	if c.compression.negotiated {
+		_ = conn.SetCompressionLevel(conf().GetInt("compression.level"))
+	}
+
+	clientsMu.Lock()
+	if !addClient(c) {
+		closeClient(c, reasonPolicyViolation, "client already connected")
+		clientsMu.Unlock()
+		goroutines.release(c, "writer")
+		return
+	}
+	c.expireAuth()
+	backlog := replayFor(c, lastEventID(r))
+	sendRetained(c)
+	sendAnnotations(c)
+	info := c.view()
+	clientsMu.Unlock()
+	go c.runWriter(backlog)
+	hooks.clientConnected(info)
+
+	log.WithFields(logrus.Fields{
+		"event":     "websocket_connection",
+		"status":    "connected",
+		"client":    r.RemoteAddr,
+		"client_id": c.id,
+		"tenant":    c.tenant,
+		"subject":   c.subject,
+		"profile":   c.profile,
+		"replayed":  len(backlog),
+	}).Info("New WebSocket client connected")
+
+	conn.SetReadLimit(publishReadLimit())
+	c.startKeepalive()
+	for {
+		var kind int
+		var data []byte
+		kind, data, err = conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		c.touch()
+		if kind == websocket.TextMessage {
+			handleControl(c, data)
+		}
+	}
+
+	clientsMu.Lock()
+	delete(clients, c)
+	c.stopAuthExpiry()
+	c.queues.close()
+	if c.stats.closeReason == "" && missedPong(err) {
+		c.stats.closeReason = reasonIdleTimeout
+	}
+	fields := c.closeSummary(err)
+	info = c.view()
+	clientsMu.Unlock()
+
+	log.WithFields(fields).Info("WebSocket client disconnected")
+	hooks.clientDisconnected(info, string(fields["reason"].(disconnectReason)))
+}
+
+// write sends the frames c should get for f and returns the bytes written.
+// Binary clients get the link and attachment frames when f has them.
+func (c *client) write(f queuedFrame) (int, error) {
+	if c.sse != nil {
+		return c.sse.write(f)
+	}
+	if d := escalationDeadline(); d > 0 {
+		_ = c.conn.SetWriteDeadline(time.Now().Add(d))
+	}
+	out := f.out
+	if !f.binary || out.attachment == nil {
+		return len(out.frame), c.writeFrame(out)
+	}
+	if err := c.conn.WriteMessage(websocket.TextMessage, out.link); err != nil {
+		return 0, err
+	}
+	return len(out.link) + len(out.attachment), c.conn.WriteMessage(websocket.BinaryMessage, out.attachment)
+}
+
+// closeConn drops c's connection without a goodbye.
+func (c *client) closeConn() {
+	if c.sse != nil {
+		c.sse.close()
+		return
+	}
+	c.conn.Close()
+}
+
+// broadcastMessage queues out for every interested client and reports how
+// many clients wanted it and how many queued it. Clients it is addressed to
+// but that skip it, for their filter, sampling or degradation, are counted as
+// drops. Priority topics go to each client's priority queue, ahead of queued
+// lower-priority traffic.
+// The message joins the replay buffer under the same lock. Every queued frame
+// is tracked by ack until it is written or lost.
+func broadcastMessage(ctx context.Context, topic string, out outbound, ack *deliveryAck) (int, int) {
+	start := time.Now()
+	_, span := startBroadcastSpan(ctx, topic)
+	spanContext := span.SpanContext()
+	priority := isPriorityTopic(topic)
+	matched := 0
+	queued := 0
+	clientsMu.Lock()
+	defer func() {
+		clientsMu.Unlock()
+		broadcastDuration.Observe(time.Since(start).Seconds())
+		endBroadcastSpan(span, matched, queued)
+	}()
+
+	rememberBroadcast(topic, out)
+	projected := make(map[string]outbound)
+	for c := range clients {
+		if !c.addressed(topic, out) {
+			continue
+		}
+		if !c.filter.accepts(topic, out) {
+			recordDrop(dropFiltered, topic, logrus.Fields{"client_id": c.id, "client": c.remoteAddr})
+			continue
+		}
+		matched++
+		if !c.sampled(out.key) {
+			recordDrop(dropSampled, topic, logrus.Fields{"client_id": c.id, "client": c.remoteAddr})
+			continue
+		}
+		if !priority && c.degraded() {
+			recordDrop(dropDegraded, topic, logrus.Fields{"client_id": c.id, "client": c.remoteAddr})
+			continue
+		}
+		ack.track()
+		f := queuedFrame{topic: topic, out: c.projectFor(out, projected), ack: ack, span: spanContext}
+		if c.enqueue(f, priority) {
+			queued++
+		} else {
+			ack.resolve(false)
+		}
+	}
+	return matched, queued
+}
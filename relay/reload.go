@@ -0,0 +1,153 @@
+package relay
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var (
+	reloadMu        sync.Mutex
+	activeRabbitURL string
+
+	// sourcesRestart is closed and replaced to make every RabbitMQ source
+	// reconnect, e.g. after rabbitmq.url changed.
+	sourcesRestart   = make(chan struct{})
+	sourcesRestartMu sync.Mutex
+)
+
+// startConfigReload re-reads config.yaml on SIGHUP and, with config.watch,
+// whenever the file changes. Most settings are read where they are used and
+// apply to the next message or connection; applyConfig refreshes the rest.
+func startConfigReload() {
+	activeRabbitURL = conf().GetString("rabbitmq.url")
+	reloadMu.Lock()
+	configBake.good, _ = os.ReadFile(configFile) // the config started with is known good
+	reloadMu.Unlock()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig("sighup")
+		}
+	}()
+
+	if conf().GetBool("config.watch") {
+		// The watcher reads the file into its own instance, so a change only
+		// reaches the running config through reloadConfig.
+		watcher := viper.New()
+		watcher.SetConfigFile(configFile)
+		watcher.OnConfigChange(func(fsnotify.Event) { reloadConfig("file_changed") })
+		watcher.WatchConfig()
+	}
+}
+
+// reloadConfig applies the config file in phases. It is read into a new
+// instance and its pipeline compiled, and both are rejected when invalid.
+// With config.rollback.enabled the new pipeline first shadows the running one
+// on live messages; see shadowConfig. The config is then swapped in for the
+// running one and baked; see bakeConfig.
+func reloadConfig(reason string) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	data, err := os.ReadFile(configFile)
+	var candidate *viper.Viper
+	var next *pipeline
+	if err == nil {
+		candidate, err = newConfig(data)
+	}
+	if err == nil {
+		err = validateConfig(candidate)
+	}
+	if err == nil {
+		next, err = newPipeline(candidate)
+	}
+	if err != nil {
+		configReloads.WithLabelValues("invalid").Inc()
+		log.WithFields(logrus.Fields{
+			"event":  "config_reload",
+			"status": "failed",
+			"reason": reason,
+			"error":  err.Error(),
+		}).Error("Failed to reload config, keeping the current one")
+		return
+	}
+
+	if candidate.GetBool("config.rollback.enabled") && candidate.GetDuration("config.rollback.shadow_period") > 0 {
+		shadowConfig(reason, data, candidate, next)
+		return
+	}
+	promoteConfig(reason, data, candidate, next)
+}
+
+// promoteConfig swaps in a reloaded config and its pipeline and bakes them.
+// Must be called with reloadMu held.
+func promoteConfig(reason string, data []byte, cfg *viper.Viper, next *pipeline) {
+	baseline := sampleOutcomes().since(configBake.appliedAt)
+	runningConfig.Store(cfg)
+	applyConfig(reason, next)
+	configReloads.WithLabelValues("applied").Inc()
+	bakeConfig(data, baseline)
+}
+
+// applyConfig swaps in the pipeline compiled from the config just swapped in
+// and refreshes the other settings cached after startup. Must be called with
+// reloadMu held.
+func applyConfig(reason string, next *pipeline) {
+	usePipeline(next)
+	applyLogLevel()
+	initAcceptLimiter()
+
+	rabbitURL := conf().GetString("rabbitmq.url")
+	reconnect := rabbitURL != activeRabbitURL
+	if reconnect {
+		activeRabbitURL = rabbitURL
+		restartSources()
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":     "config_reload",
+		"status":    "applied",
+		"reason":    reason,
+		"log_level": log.GetLevel().String(),
+		"reconnect": reconnect,
+	}).Info("Configuration reloaded")
+}
+
+// applyLogLevel sets log.level, keeping the current level when it's invalid.
+func applyLogLevel() {
+	name := conf().GetString("log.level")
+	if name == "" {
+		name = logrus.InfoLevel.String()
+	}
+	level, err := logrus.ParseLevel(name)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":     "config_reload",
+			"status":    "invalid",
+			"log_level": name,
+		}).Warn("Unknown log level, keeping the current one")
+		return
+	}
+	log.SetLevel(level)
+}
+
+func restartSignal() <-chan struct{} {
+	sourcesRestartMu.Lock()
+	defer sourcesRestartMu.Unlock()
+	return sourcesRestart
+}
+
+func restartSources() {
+	sourcesRestartMu.Lock()
+	close(sourcesRestart)
+	sourcesRestart = make(chan struct{})
+	sourcesRestartMu.Unlock()
+}
@@ -0,0 +1,143 @@
+package relay
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useConfig makes yaml the running config, read from a file like at startup.
+func useConfig(t *testing.T, yaml string) {
+	t.Helper()
+	configFile = filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, yaml)
+	cfg, err := newConfig([]byte(yaml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := runningConfig.Swap(cfg)
+	t.Cleanup(func() { runningConfig.Store(previous) })
+}
+
+func writeConfig(t *testing.T, yaml string) {
+	t.Helper()
+	if err := os.WriteFile(configFile, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfigSwapsWhole(t *testing.T) {
+	useConfig(t, "log:\n  level: info\nreplay:\n  max_messages: 1\n")
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if n := conf().GetInt("replay.max_messages"); n != 1 && n != 2 {
+					t.Errorf("read replay.max_messages %d mid-reload", n)
+					return
+				}
+			}
+		}()
+	}
+	for i := range 50 {
+		writeConfig(t, "log:\n  level: info\nreplay:\n  max_messages: "+[]string{"1", "2"}[i%2]+"\n")
+		reloadConfig("test")
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestReloadConfigKeepsInvalid(t *testing.T) {
+	useConfig(t, "log:\n  level: info\n")
+	running := conf()
+
+	for _, yaml := range []string{"", "log:\n  level: loud\n", "log: [unclosed\n"} {
+		writeConfig(t, yaml)
+		reloadConfig("test")
+		if conf() != running {
+			t.Errorf("reload of %q replaced the running config", yaml)
+		}
+	}
+}
+
+func TestNewConfigAppliesOverrides(t *testing.T) {
+	configOverrides = map[string]any{"replay.max_messages": 7}
+	defer func() { configOverrides = nil }()
+
+	cfg, err := newConfig([]byte("replay:\n  max_messages: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.GetInt("replay.max_messages"); got != 7 {
+		t.Errorf("replay.max_messages = %d, want the override 7", got)
+	}
+}
+
+func TestNewConfigAppliesDefaults(t *testing.T) {
+	useConfig(t, "clients:\n  rate_limit:\n    rate: 5/s\nrabbitmq:\n  reconnect:\n    max_delay: 1m\n")
+	if got := conf().GetDuration("subscriptions.demand_interval"); got != time.Second {
+		t.Errorf("subscriptions.demand_interval = %v, want the default 1s", got)
+	}
+	limit, err := readOutboundLimit(conf())
+	if err != nil || limit.Burst != 20 || limit.Policy != outboundCoalesce {
+		t.Errorf("clients.rate_limit = %+v, %v, want burst and policy defaulted", limit, err)
+	}
+	if p := loadRetryPolicy("rabbitmq.reconnect"); p.MaxDelay != time.Minute || p.InitialDelay != time.Second {
+		t.Errorf("rabbitmq.reconnect = %+v, want max_delay from the file and initial_delay defaulted", p)
+	}
+}
+
+func TestValidateConfigTickerIntervals(t *testing.T) {
+	for _, yaml := range []string{
+		"subscriptions:\n  demand_interval: 0s\n",
+		"soak:\n  sample_interval: -1s\n",
+		"ha:\n  election: redis\n  lease_ttl: 0s\n",
+	} {
+		cfg, err := newConfig([]byte(yaml))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := validateConfig(cfg); err == nil {
+			t.Errorf("validateConfig(%q) accepted a non-positive interval", yaml)
+		}
+	}
+}
+
+func TestReloadConfigSwapsPipeline(t *testing.T) {
+	useConfig(t, "log:\n  level: info\n")
+	usePipeline(&pipeline{})
+
+	writeConfig(t, `log:
+  level: info
+transforms:
+  - name: tag
+    set:
+      - field: tagged
+        value: "yes"
+clients:
+  rate_limit:
+    rate: 5/s
+    policy: drop_oldest
+`)
+	reloadConfig("test")
+
+	p := stages()
+	if len(p.transforms) != 1 || p.outboundLimit.perSecond != 5 {
+		t.Fatalf("pipeline after reload = %+v, want the reloaded transforms and rate limit", p)
+	}
+	body, applied, err := transformPayload(p.transforms, "test", "a.b", []byte(`{"x":1}`))
+	if err != nil || len(applied) != 1 || string(body) != `{"tagged":"yes","x":1}` {
+		t.Errorf("transformPayload() = %s, %v, %v", body, applied, err)
+	}
+}
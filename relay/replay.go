@@ -0,0 +1,99 @@
+package relay
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// replayEntry is one broadcast message kept for reconnecting clients.
+type replayEntry struct {
+	topic string
+	out   outbound
+	at    time.Time
+}
+
+// replayBuffer holds the most recent broadcasts in broadcast order. It is
+// guarded by clientsMu so a client registering never misses or duplicates a
+// message that is being broadcast at the same time.
+var replayBuffer []replayEntry
+
+// nextEventID returns the ID clients quote in ?since= or Last-Event-ID to
+// catch up, or "" when the replay buffer is off.
+func nextEventID() string {
+	if !conf().GetBool("replay.enabled") {
+		return ""
+	}
+	return newID()
+}
+
+// rememberBroadcast appends out to the replay buffer and evicts entries beyond
+// replay.max_messages or older than replay.max_age. Must be called with
+// clientsMu held.
+func rememberBroadcast(topic string, out outbound) {
+	if out.id == "" {
+		return
+	}
+	now := time.Now()
+	replayBuffer = append(replayBuffer, replayEntry{topic: topic, out: out, at: now})
+
+	evict := max(len(replayBuffer)-max(conf().GetInt("replay.max_messages"), 1), 0)
+	if maxAge := conf().GetDuration("replay.max_age"); maxAge > 0 {
+		for now.Sub(replayBuffer[evict].at) > maxAge {
+			evict++
+		}
+	}
+	if evict > 0 {
+		clear(replayBuffer[:evict])
+		replayBuffer = replayBuffer[evict:]
+	}
+}
+
+// lastEventID reads the ID a reconnecting client saw last.
+func lastEventID(r *http.Request) string {
+	if since := r.URL.Query().Get("since"); since != "" {
+		return since
+	}
+	return r.Header.Get("Last-Event-ID")
+}
+
+// replayFor returns the buffered messages c wants that were broadcast after
+// since. When since is no longer buffered the client has missed more than
+// the buffer holds, so it gets everything still buffered. Must be called with
+// clientsMu held.
+func replayFor(c *client, since string) []queuedFrame {
+	if since == "" || !conf().GetBool("replay.enabled") {
+		return nil
+	}
+
+	start := 0
+	found := false
+	for i := len(replayBuffer) - 1; i >= 0; i-- {
+		if replayBuffer[i].out.id == since {
+			start, found = i+1, true
+			break
+		}
+	}
+	if !found {
+		log.WithFields(logrus.Fields{
+			"event":    "replay",
+			"status":   "gap",
+			"client":   c.remoteAddr,
+			"since":    since,
+			"buffered": len(replayBuffer),
+		}).Warn("Last event ID is no longer buffered, replaying the whole buffer")
+	}
+
+	maxAge := conf().GetDuration("replay.max_age")
+	var frames []queuedFrame
+	for _, e := range replayBuffer[start:] {
+		if maxAge > 0 && time.Since(e.at) > maxAge {
+			continue
+		}
+		if c.wants(e.topic, e.out) {
+			frames = append(frames, queuedFrame{topic: e.topic, out: c.projectFor(e.out, nil), binary: c.binary})
+		}
+	}
+	return frames
+}
@@ -0,0 +1,43 @@
+package relay
+
+import "sync"
+
+var (
+	retained   = make(map[string]outbound)
+	retainedMu sync.Mutex
+)
+
+// retain keeps the latest frames of topics declared as retained, no matter how
+// old, so they can be handed to clients as soon as they connect or subscribe.
+func retain(topic string, out outbound) {
+	if !matchesAny(conf().GetStringSlice("retained.topics"), topic) {
+		return
+	}
+	retainedMu.Lock()
+	retained[topic] = out
+	retainedMu.Unlock()
+}
+
+// sendRetained queues every retained frame c wants for a newly registered client.
+// Must be called with clientsMu held so live broadcasts can't interleave.
+func sendRetained(c *client) {
+	sendRetainedMatching(c, func(topic string, out outbound) bool { return c.wants(topic, out) })
+}
+
+// sendRetainedFor queues the retained frames matching newly subscribed
+// patterns. Must be called with clientsMu held.
+func sendRetainedFor(c *client, patterns []string) {
+	sendRetainedMatching(c, func(topic string, out outbound) bool {
+		return tenantAllows(c.tenant, topic) && matchesAny(patterns, out.key)
+	})
+}
+
+func sendRetainedMatching(c *client, match func(topic string, out outbound) bool) {
+	retainedMu.Lock()
+	defer retainedMu.Unlock()
+	for topic, out := range retained {
+		if match(topic, out) && !c.enqueue(queuedFrame{topic: topic, out: c.projectFor(out, nil)}, false) {
+			return
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// retryPolicy is the shared exponential backoff configuration for outbound
+// integrations. Budget caps retries per second across every caller of the
+// policy, so a failing dependency can't soak up unbounded retry capacity.
+type retryPolicy struct {
+	InitialDelay time.Duration `mapstructure:"initial_delay"`
+	MaxDelay     time.Duration `mapstructure:"max_delay"`
+	Multiplier   float64       `mapstructure:"multiplier"`
+	Jitter       float64       `mapstructure:"jitter"`
+	MaxAttempts  int           `mapstructure:"max_attempts"`
+	Budget       float64       `mapstructure:"budget"`
+
+	budget rateLimiter
+}
+
+type retryCounters struct {
+	Attempts        int64 `json:"attempts"`
+	Retries         int64 `json:"retries"`
+	Successes       int64 `json:"successes"`
+	Failures        int64 `json:"failures"`
+	BudgetExhausted int64 `json:"budget_exhausted"`
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+var (
+	retryStats   = make(map[string]*retryCounters)
+	retryStatsMu sync.Mutex
+)
+
+func loadRetryPolicy(key string) *retryPolicy {
+	p := &retryPolicy{}
+	if err := unmarshalConfig(key, p); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "retry_config",
+			"status": "failed",
+			"key":    key,
+			"error":  err.Error(),
+		}).Fatal("Failed to read retry policy")
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 1
+	}
+	if p.Budget > 0 {
+		p.budget = newRateLimiter("retry:"+key, p.Budget, max(int(p.Budget), 1))
+	}
+	return p
+}
+
+// delay returns the jittered wait before the given retry (1-based).
+func (p *retryPolicy) delay(retryNum int) time.Duration {
+	d := float64(p.InitialDelay)
+	for range retryNum - 1 {
+		d *= p.Multiplier
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			d = float64(p.MaxDelay)
+			break
+		}
+	}
+	if p.Jitter > 0 {
+		d *= 1 + p.Jitter*(2*rand.Float64()-1) //nolint:gosec // jitter doesn't need a secure source
+	}
+	return time.Duration(d)
+}
+
+// permanent marks an error that must not be retried.
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// retry calls fn until it succeeds, returns a permanent error, runs out of
+// attempts or retry budget, or ctx is done. MaxAttempts of zero retries forever.
+func retry(ctx context.Context, integration string, p *retryPolicy, fn func() error) error {
+	counters := retryCountersFor(integration)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		retryStatsMu.Lock()
+		counters.Attempts++
+		if err == nil {
+			counters.Successes++
+		}
+		retryStatsMu.Unlock()
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanentError
+		exhausted := errors.As(err, &perm) || (p.MaxAttempts > 0 && attempt >= p.MaxAttempts)
+		budgetOut := !exhausted && p.budget != nil && !p.budget.Allow()
+		if exhausted || budgetOut {
+			retryStatsMu.Lock()
+			counters.Failures++
+			if budgetOut {
+				counters.BudgetExhausted++
+			}
+			retryStatsMu.Unlock()
+			return err
+		}
+
+		wait := p.delay(attempt)
+		log.WithFields(logrus.Fields{
+			"event":       "retry",
+			"status":      "scheduled",
+			"integration": integration,
+			"attempt":     attempt,
+			"delay_ms":    wait.Milliseconds(),
+			"error":       err.Error(),
+		}).Warn("Operation failed, retrying")
+
+		retryStatsMu.Lock()
+		counters.Retries++
+		retryStatsMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func retryCountersFor(integration string) *retryCounters {
+	retryStatsMu.Lock()
+	defer retryStatsMu.Unlock()
+	c, ok := retryStats[integration]
+	if !ok {
+		c = &retryCounters{}
+		retryStats[integration] = c
+	}
+	return c
+}
+
+func handleRetries(w http.ResponseWriter, _ *http.Request) {
+	retryStatsMu.Lock()
+	view := make(map[string]retryCounters, len(retryStats))
+	for name, c := range retryStats {
+		view[name] = *c
+	}
+	retryStatsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
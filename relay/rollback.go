@@ -0,0 +1,245 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// deliveryOutcomes counts written messages and unintended drops, split into
+// plain drops and errors, for judging a freshly applied config. Filtering the
+// config asks for, such as mutes and dedup, doesn't count.
+var deliveryOutcomes struct {
+	written atomic.Int64
+	dropped atomic.Int64
+	failed  atomic.Int64
+}
+
+// countDropOutcome classifies a drop for deliveryOutcomes.
+func countDropOutcome(reason dropReason) {
+	switch reason {
+	case dropWriteFailed, dropTransform, dropCircuitOpen:
+		deliveryOutcomes.failed.Add(1)
+		deliveryOutcomes.dropped.Add(1)
+	case dropQueueFull, dropSize, dropRateLimited:
+		deliveryOutcomes.dropped.Add(1)
+	}
+}
+
+// outcomeSample is deliveryOutcomes at one moment.
+type outcomeSample struct {
+	written, dropped, failed int64
+}
+
+func sampleOutcomes() outcomeSample {
+	return outcomeSample{
+		written: deliveryOutcomes.written.Load(),
+		dropped: deliveryOutcomes.dropped.Load(),
+		failed:  deliveryOutcomes.failed.Load(),
+	}
+}
+
+func (s outcomeSample) since(earlier outcomeSample) outcomeSample {
+	return outcomeSample{
+		written: s.written - earlier.written,
+		dropped: s.dropped - earlier.dropped,
+		failed:  s.failed - earlier.failed,
+	}
+}
+
+func (s outcomeSample) total() int64 {
+	return s.written + s.dropped
+}
+
+// ratios are the shares of messages dropped and failed.
+func (s outcomeSample) ratios() (dropped, failed float64) {
+	if s.total() == 0 {
+		return 0, 0
+	}
+	return float64(s.dropped) / float64(s.total()), float64(s.failed) / float64(s.total())
+}
+
+// validateConfig checks the settings of a config that are read where they are
+// used before the relay starts with it or it replaces the running one, with the same parsing that would
+// otherwise reject it at the next start or silently fall back at use. What
+// the pipeline compiles is checked by newPipeline.
+func validateConfig(cfg *viper.Viper) error {
+	var errs []error
+	check := func(key string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+	}
+	positive := func(key string) {
+		if cfg.GetDuration(key) <= 0 {
+			check(key, errors.New("must be positive"))
+		}
+	}
+	oneOf := func(key string, allowed ...string) {
+		if value := cfg.GetString(key); value != "" && !slices.Contains(allowed, value) {
+			check(key, fmt.Errorf("%q is not one of %v", value, allowed))
+		}
+	}
+
+	if !slices.ContainsFunc(cfg.AllKeys(), cfg.InConfig) {
+		return errors.New("config is empty") // e.g. read while an editor was rewriting the file
+	}
+	if level := cfg.GetString("log.level"); level != "" {
+		_, err := logrus.ParseLevel(level)
+		check("log.level", err)
+	}
+	oneOf("rabbitmq.ack.mode", "auto", ackModeBroadcast)
+	oneOf("rabbitmq.ack.on_failure", "requeue", ackFailureReject)
+	oneOf("subscriptions.default", "all", "none")
+	oneOf("subscriptions.match", "routing_key", subscriptionMatchField)
+	oneOf("oversized.policy", "drop", oversizedPolicyTruncate, oversizedPolicyDeadLetter)
+	if cfg.GetString("oversized.policy") == oversizedPolicyDeadLetter && !cfg.GetBool("dead_letter.enabled") {
+		check("oversized.policy", errors.New("dead_letter needs dead_letter.enabled"))
+	}
+	oneOf("clients.overflow", overflowPolicyDrop, overflowPolicyDisconnect)
+	if cfg.GetFloat64("server.accept_rate") < 0 {
+		check("server.accept_rate", errors.New("must not be negative"))
+	}
+	if cfg.GetInt("backpressure.high_watermark") > 0 {
+		positive("backpressure.check_interval")
+	}
+	positive("subscriptions.demand_interval")
+	positive("soak.storm_interval")
+	positive("soak.sample_interval")
+	if cfg.GetString("ha.election") == haElectionRedis {
+		positive("ha.lease_ttl")
+	}
+	if rate := cfg.GetString("publish.rate"); cfg.GetBool("publish.enabled") && rate != "" {
+		_, err := parseRate(rate)
+		check("publish.rate", err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// configBake is the state of watching the config last applied. Guarded by
+// reloadMu.
+var configBake struct {
+	// generation changes with every apply, ending the watch of the one before.
+	generation int
+	// good is the last config file that was baked, restored on a rollback.
+	good []byte
+	// appliedAt is deliveryOutcomes when the current config was applied.
+	appliedAt outcomeSample
+}
+
+// bakeConfig starts watching the config just applied, whose predecessor
+// produced baseline. With config.rollback.enabled, it is rolled back to the
+// last baked config if its drop or error ratio spikes within
+// config.rollback.bake_period; otherwise it becomes the config to roll back
+// to. Must be called with reloadMu held.
+func bakeConfig(data []byte, baseline outcomeSample) {
+	configBake.generation++
+	configBake.appliedAt = sampleOutcomes()
+	if !conf().GetBool("config.rollback.enabled") {
+		configBake.good = data
+		return
+	}
+	go watchBake(configBake.generation, data, baseline, configBake.appliedAt)
+}
+
+func watchBake(generation int, data []byte, baseline, applied outcomeSample) {
+	deadline := time.After(conf().GetDuration("config.rollback.bake_period"))
+	ticker := time.NewTicker(max(conf().GetDuration("config.rollback.check_interval"), time.Second))
+	defer ticker.Stop()
+	for {
+		done := false
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			done = true
+		}
+
+		reloadMu.Lock()
+		if generation != configBake.generation {
+			reloadMu.Unlock()
+			return
+		}
+		bake := sampleOutcomes().since(applied)
+		if reason := spiked(conf(), bake, baseline); reason != "" {
+			rollbackConfig(reason, bake, baseline)
+			reloadMu.Unlock()
+			return
+		}
+		if done {
+			configBake.good = data
+			configReloads.WithLabelValues("baked").Inc()
+			log.WithFields(logrus.Fields{
+				"event":    "config_reload",
+				"status":   "baked",
+				"messages": bake.total(),
+			}).Info("Reloaded configuration passed its bake period")
+			reloadMu.Unlock()
+			return
+		}
+		reloadMu.Unlock()
+	}
+}
+
+// spiked names the ratio of bake that is above both config.rollback.min_ratio
+// and spike_factor times its baseline in cfg, or returns "" with too few
+// messages yet to tell.
+func spiked(cfg *viper.Viper, bake, baseline outcomeSample) string {
+	if bake.total() < cfg.GetInt64("config.rollback.min_messages") {
+		return ""
+	}
+	factor := cfg.GetFloat64("config.rollback.spike_factor")
+	floor := cfg.GetFloat64("config.rollback.min_ratio")
+	dropped, failed := bake.ratios()
+	baseDropped, baseFailed := baseline.ratios()
+	switch {
+	case failed > max(baseFailed*factor, floor):
+		return "error_rate"
+	case dropped > max(baseDropped*factor, floor):
+		return "drop_rate"
+	}
+	return ""
+}
+
+// rollbackConfig restores the last baked config. The file on disk keeps the
+// rejected config until it is fixed. Must be called with reloadMu held.
+func rollbackConfig(reason string, bake, baseline outcomeSample) {
+	dropped, failed := bake.ratios()
+	baseDropped, baseFailed := baseline.ratios()
+	fields := logrus.Fields{
+		"event":                "config_rollback",
+		"reason":               reason,
+		"messages":             bake.total(),
+		"drop_ratio":           dropped,
+		"error_ratio":          failed,
+		"baseline_drop_ratio":  baseDropped,
+		"baseline_error_ratio": baseFailed,
+	}
+	err := errors.New("no previous config file")
+	var good *viper.Viper
+	var goodPipeline *pipeline
+	if configBake.good != nil {
+		good, err = newConfig(configBake.good)
+	}
+	if err == nil {
+		goodPipeline, err = newPipeline(good)
+	}
+	if err != nil {
+		fields["status"] = "failed"
+		fields["error"] = err.Error()
+		log.WithFields(fields).Error("Failed to roll back the reloaded configuration")
+		return
+	}
+	configBake.generation++
+	configBake.appliedAt = sampleOutcomes()
+	runningConfig.Store(good)
+	applyConfig("rollback", goodPipeline)
+	configReloads.WithLabelValues("rolled_back").Inc()
+	fields["status"] = "rolled_back"
+	log.WithFields(fields).Error("Reloaded configuration raised drops or errors, rolled back to the previous one")
+}
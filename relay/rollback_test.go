@@ -0,0 +1,76 @@
+package relay
+
+import "testing"
+
+const rollbackConfigYAML = `log:
+  level: info
+config:
+  rollback:
+    enabled: true
+    min_messages: 100
+    spike_factor: 3
+    min_ratio: 0.05
+`
+
+func TestSpiked(t *testing.T) {
+	cfg, err := newConfig([]byte(rollbackConfigYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean := outcomeSample{written: 1000}
+	lossy := outcomeSample{written: 850, dropped: 150}
+	tests := []struct {
+		name     string
+		bake     outcomeSample
+		baseline outcomeSample
+		want     string
+	}{
+		{"too few messages", outcomeSample{written: 10, dropped: 50, failed: 50}, clean, ""},
+		{"healthy", outcomeSample{written: 990, dropped: 10}, clean, ""},
+		{"errors", outcomeSample{written: 800, dropped: 200, failed: 200}, clean, "error_rate"},
+		{"drops", outcomeSample{written: 800, dropped: 200}, clean, "drop_rate"},
+		{"as bad as before", outcomeSample{written: 800, dropped: 200}, lossy, ""},
+		{"three times worse", outcomeSample{written: 400, dropped: 600}, lossy, "drop_rate"},
+	}
+	for _, tt := range tests {
+		if got := spiked(cfg, tt.bake, tt.baseline); got != tt.want {
+			t.Errorf("%s: spiked() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOutcomeSampleRatios(t *testing.T) {
+	s := outcomeSample{written: 75, dropped: 25, failed: 5}.since(outcomeSample{written: 25, dropped: 15})
+	if dropped, failed := s.ratios(); dropped != 10.0/60 || failed != 5.0/60 {
+		t.Errorf("ratios() = %v, %v, want %v, %v", dropped, failed, 10.0/60, 5.0/60)
+	}
+	if dropped, failed := (outcomeSample{}).ratios(); dropped != 0 || failed != 0 {
+		t.Errorf("ratios() of no messages = %v, %v, want 0, 0", dropped, failed)
+	}
+}
+
+func TestRollbackConfigRestoresBaked(t *testing.T) {
+	useConfig(t, rollbackConfigYAML+"replay:\n  max_messages: 2\n")
+	usePipeline(&pipeline{})
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	previous := configBake
+	t.Cleanup(func() { configBake = previous })
+
+	configBake.good = nil
+	running := conf()
+	rollbackConfig("error_rate", outcomeSample{}, outcomeSample{})
+	if conf() != running {
+		t.Error("rollback without a baked config replaced the running one")
+	}
+
+	configBake.good = []byte(rollbackConfigYAML + "replay:\n  max_messages: 1\n" +
+		"transforms:\n  - name: tag\n    set:\n      - field: tagged\n        value: \"yes\"\n")
+	rollbackConfig("error_rate", outcomeSample{}, outcomeSample{})
+	if got := conf().GetInt("replay.max_messages"); got != 1 {
+		t.Errorf("replay.max_messages after rollback = %d, want the baked 1", got)
+	}
+	if len(stages().transforms) != 1 {
+		t.Error("rollback didn't restore the baked pipeline")
+	}
+}
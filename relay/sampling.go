@@ -0,0 +1,78 @@
+package relay
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subscriptionOptions are per-pattern delivery options: the payload fields
+// to keep, and the sampling applied to high-volume topics.
+type subscriptionOptions struct {
+	fields  []string
+	sample  float64
+	limiter *tokenBucket
+}
+
+func (o subscriptionOptions) empty() bool {
+	return len(o.fields) == 0 && o.sample == 0 && o.limiter == nil
+}
+
+// accepts applies the pattern's sampling to one message: a sample fraction
+// keeps messages at random, a max rate keeps at most that many per period.
+func (o subscriptionOptions) accepts() bool {
+	if o.sample > 0 && rand.Float64() >= o.sample { //nolint:gosec // sampling doesn't need a secure source
+		return false
+	}
+	return o.limiter == nil || o.limiter.Allow()
+}
+
+// newSubscriptionOptions validates the options of a subscribe request.
+func newSubscriptionOptions(fields []string, sample float64, maxRate string) (subscriptionOptions, error) {
+	opts := subscriptionOptions{fields: fields, sample: sample}
+	if sample < 0 || sample > 1 {
+		return opts, fmt.Errorf("sample must be between 0 and 1, got %v", sample)
+	}
+	if maxRate != "" {
+		rate, err := parseRate(maxRate)
+		if err != nil {
+			return opts, err
+		}
+		opts.limiter = newTokenBucket(rate, 1)
+	}
+	return opts, nil
+}
+
+// parseRate turns "5/s", "100/m" or "1/h" into events per second.
+func parseRate(s string) (float64, error) {
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(count, 64)
+	if !ok || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid max_rate %q, want <count>/<s|m|h>", s)
+	}
+	switch unit {
+	case "s":
+		return n, nil
+	case "m":
+		return n / time.Minute.Seconds(), nil
+	case "h":
+		return n / time.Hour.Seconds(), nil
+	}
+	return 0, fmt.Errorf("invalid max_rate unit in %q, want s, m or h", s)
+}
+
+// sampled reports whether c takes this message after sampling: it does when
+// any matching subscription accepts it. Must be called with clientsMu held.
+func (c *client) sampled(key string) bool {
+	if len(c.options) == 0 {
+		return true
+	}
+	for _, pattern := range c.subscriptions {
+		if topicMatches(pattern, key) && c.options[pattern].accepts() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,244 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+const (
+	overflowPolicyDrop       = "drop"
+	overflowPolicyDisconnect = "disconnect"
+
+	// queueDrainInterval is how often shutdown checks whether send queues are empty.
+	queueDrainInterval = 10 * time.Millisecond
+)
+
+// queuedFrame is one write waiting in a client's send queue. Control replies
+// don't count as delivered messages or egress. ack, when set, learns whether
+// the frame was written. binary is the client's format when it was queued,
+// since a hello may change it while frames are waiting. span is the
+// broadcast that queued the frame, if it was traced.
+type queuedFrame struct {
+	topic   string
+	out     outbound
+	control bool
+	binary  bool
+	ack     *deliveryAck
+	span    oteltrace.SpanContext
+}
+
+// clientQueues are the buffered channels a client's writer goroutine drains,
+// priority first. Only the client's reader closes them, after removing the
+// client from clients, so broadcasts never send on a closed channel.
+type clientQueues struct {
+	normal   chan queuedFrame
+	priority chan queuedFrame
+}
+
+func newClientQueues() clientQueues {
+	return clientQueues{
+		normal:   make(chan queuedFrame, max(conf().GetInt("clients.send_queue"), 1)),
+		priority: make(chan queuedFrame, max(conf().GetInt("clients.priority_queue"), 1)),
+	}
+}
+
+func (q clientQueues) depth() int {
+	return len(q.normal) + len(q.priority)
+}
+
+func (q clientQueues) close() {
+	close(q.normal)
+	close(q.priority)
+}
+
+// discard resolves the frames left in closed queues as unwritten.
+func (q clientQueues) discard() {
+	for f := range q.normal {
+		f.ack.resolve(false)
+	}
+	for f := range q.priority {
+		f.ack.resolve(false)
+	}
+}
+
+// enqueue hands f to c's writer without blocking and reports whether it was
+// queued. When the queue is full the frame is dropped, or with the disconnect
+// overflow policy the client is closed as a slow consumer, as it is by
+// escalation when still behind after its grace period.
+// Must be called with clientsMu held.
+func (c *client) enqueue(f queuedFrame, priority bool) bool {
+	queue := c.queues.normal
+	if priority {
+		queue = c.queues.priority
+	}
+	f.binary = c.binary
+	if !f.control && !c.escalate(0) {
+		return false
+	}
+	select {
+	case queue <- f:
+		return true
+	default:
+	}
+
+	c.stats.drops++
+	recordDrop(dropQueueFull, f.topic, logrus.Fields{"client": c.remoteAddr})
+	if conf().GetString("clients.overflow") == overflowPolicyDisconnect {
+		log.WithFields(logrus.Fields{
+			"event":  "send_queue",
+			"status": "overflow",
+			"client": c.remoteAddr,
+			"depth":  c.queues.depth(),
+		}).Warn("Client send queue full, disconnecting slow consumer")
+		closeClient(c, reasonSlowConsumer, "send queue full")
+		delete(clients, c)
+	}
+	return false
+}
+
+// runWriter writes the replay backlog and then queued frames to c until its
+// queues are closed, pinging WebSocket clients while idle. Frames from the
+// normal queue are paced to clients.rate_limit; priority topics and control
+// replies never wait. After a failed
+// write it keeps draining without writing until the reader notices the closed
+// connection and closes the queues.
+func (c *client) runWriter(backlog []queuedFrame) {
+	defer goroutines.release(c, "writer")
+	pings, stopPings := c.pings()
+	defer stopPings()
+
+	failed := false
+	for _, f := range backlog {
+		if failed = !c.deliver(f); failed {
+			break
+		}
+	}
+	for {
+		var f queuedFrame
+		var ok, paced bool
+		select {
+		case f, ok = <-c.queues.priority:
+		default:
+			select {
+			case f, ok = <-c.queues.priority:
+			case f, ok = <-c.queues.normal:
+				paced = !f.control && c.limiter.paces()
+			case <-c.limiter.ready():
+				if failed {
+					c.discardPaced()
+				} else {
+					failed = !c.releasePaced()
+				}
+				continue
+			case <-pings:
+				failed = failed || !c.ping()
+				continue
+			}
+		}
+		if !ok {
+			c.discardPaced()
+			c.queues.discard()
+			return
+		}
+		switch {
+		case failed:
+			f.ack.resolve(false)
+		case paced:
+			failed = !c.pace(f)
+		default:
+			failed = !c.deliver(f)
+		}
+	}
+}
+
+// deliver writes one frame and accounts for it, reporting whether the
+// connection is still usable.
+func (c *client) deliver(f queuedFrame) bool {
+	start := time.Now()
+	span := startWriteSpan(c, f)
+	sent, err := c.write(f)
+	elapsed := time.Since(start)
+	endWriteSpan(span, sent, err)
+	f.ack.resolve(err == nil)
+	if !f.control {
+		recordSinkDelivery(c.transport(), elapsed, 0, sent, err)
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	c.stats.writeTime += elapsed
+	if err != nil {
+		broadcastFailures.Inc()
+		c.stats.drops++
+		if c.stats.closeReason == "" {
+			c.stats.closeReason = reasonConnectionLost // keep why the server closed it, if it did
+		}
+		recordDrop(dropWriteFailed, f.topic, logrus.Fields{"client": c.remoteAddr})
+		log.WithFields(logrus.Fields{
+			"event":  "message_broadcast",
+			"status": "failed",
+			"client": c.remoteAddr,
+			"error":  err.Error(),
+		}).Error("Failed to send message to client")
+		c.closeConn()
+		return false
+	}
+	if f.control {
+		return c.escalate(elapsed)
+	}
+
+	c.stats.messagesSent++
+	messagesBroadcast.Inc()
+	deliveryOutcomes.written.Add(1)
+	if f.binary && f.out.attachment != nil {
+		sampleCompression(c, f.out.attachment)
+	} else {
+		sampleCompression(c, f.out.frame)
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":   "message_broadcast",
+		"status":  "success",
+		"client":  c.remoteAddr,
+		"message": string(f.out.frame),
+	}).Debug("Message sent to WebSocket client")
+
+	if quota := recordEgress(c, f.topic, sent); quota != "" {
+		disconnectOverQuota(c, quota)
+		delete(clients, c)
+		return false
+	}
+	return c.escalate(elapsed)
+}
+
+// drainClientQueues waits until every client's send queue is empty or ctx is done.
+func drainClientQueues(ctx context.Context) {
+	ticker := time.NewTicker(queueDrainInterval)
+	defer ticker.Stop()
+	for {
+		clientsMu.Lock()
+		queued := 0
+		for c := range clients {
+			queued += c.queues.depth()
+		}
+		clientsMu.Unlock()
+		if queued == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			log.WithFields(logrus.Fields{
+				"event":  "shutdown",
+				"status": "drain_timeout",
+				"queued": queued,
+			}).Warn("Drain timeout reached with client send queues not empty")
+			return
+		case <-ticker.C:
+		}
+	}
+}
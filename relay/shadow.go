@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// shadowRun is a reloaded pipeline running beside the active one on the same
+// deliveries before it replaces it. Its output is discarded; only whether it
+// would have failed where the active one didn't is kept.
+type shadowRun struct {
+	pipeline *pipeline
+
+	messages     atomic.Int64
+	failed       atomic.Int64
+	activeFailed atomic.Int64
+}
+
+// shadow is the pipeline being shadowed, nil while there is none.
+var shadow atomic.Pointer[shadowRun]
+
+// shadowDelivery runs the shadowed pipeline's enrichment and transforms over
+// a payload the active pipeline just prepared, activeFailed telling whether
+// the active transforms failed on it.
+func shadowDelivery(source, topic string, body []byte, activeFailed bool) {
+	run := shadow.Load()
+	if run == nil {
+		return
+	}
+	run.messages.Add(1)
+	if activeFailed {
+		run.activeFailed.Add(1)
+	}
+	body, _ = enrichPayload(run.pipeline.lookups, body)
+	if _, _, err := transformPayload(run.pipeline.transforms, source, topic, body); err != nil {
+		run.failed.Add(1)
+	}
+}
+
+// samples returns the shadowed and the active pipeline's outcomes so far.
+func (run *shadowRun) samples() (shadowed, active outcomeSample) {
+	messages, failed, activeFailed := run.messages.Load(), run.failed.Load(), run.activeFailed.Load()
+	return outcomeSample{written: messages - failed, dropped: failed, failed: failed},
+		outcomeSample{written: messages - activeFailed, dropped: activeFailed, failed: activeFailed}
+}
+
+// shadowConfig shadows the pipeline of a reloaded config for
+// config.rollback.shadow_period. It is rejected as soon as its error ratio
+// spikes against the active pipeline's on the same messages, as for a bake,
+// and otherwise promoted when the period ends. A reload meanwhile ends the
+// shadow run. Must be called with reloadMu held.
+func shadowConfig(reason string, data []byte, cfg *viper.Viper, next *pipeline) {
+	configBake.generation++
+	run := &shadowRun{pipeline: next}
+	shadow.Store(run)
+	log.WithFields(logrus.Fields{
+		"event":  "config_reload",
+		"status": "shadowing",
+		"reason": reason,
+		"period": cfg.GetDuration("config.rollback.shadow_period").String(),
+	}).Info("Shadowing the reloaded pipeline before applying it")
+	go watchShadow(configBake.generation, reason, data, cfg, run)
+}
+
+func watchShadow(generation int, reason string, data []byte, cfg *viper.Viper, run *shadowRun) {
+	deadline := time.After(cfg.GetDuration("config.rollback.shadow_period"))
+	ticker := time.NewTicker(max(cfg.GetDuration("config.rollback.check_interval"), time.Second))
+	defer ticker.Stop()
+	for {
+		done := false
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			done = true
+		}
+
+		reloadMu.Lock()
+		if generation != configBake.generation {
+			shadow.CompareAndSwap(run, nil)
+			reloadMu.Unlock()
+			return
+		}
+		shadowed, active := run.samples()
+		if spike := spiked(cfg, shadowed, active); spike != "" || done {
+			shadow.Store(nil)
+			if spike == "" {
+				promoteConfig(reason, data, cfg, run.pipeline)
+			} else {
+				rejectShadow(spike, shadowed, active)
+			}
+			reloadMu.Unlock()
+			return
+		}
+		reloadMu.Unlock()
+	}
+}
+
+// rejectShadow keeps the running config after its replacement failed in
+// the shadow run. Must be called with reloadMu held.
+func rejectShadow(spike string, shadowed, active outcomeSample) {
+	_, failed := shadowed.ratios()
+	_, activeFailed := active.ratios()
+	configReloads.WithLabelValues("shadow_rejected").Inc()
+	log.WithFields(logrus.Fields{
+		"event":              "config_rollback",
+		"status":             "shadow_rejected",
+		"reason":             spike,
+		"messages":           shadowed.total(),
+		"error_ratio":        failed,
+		"active_error_ratio": activeFailed,
+	}).Error("Reloaded pipeline failed more messages than the running one in its shadow run, keeping the running config")
+}
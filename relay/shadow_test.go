@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+const shadowedConfig = `log:
+  level: info
+config:
+  rollback:
+    enabled: true
+    shadow_period: 1s
+    check_interval: 1s
+    bake_period: 1h
+    min_messages: 10
+    spike_factor: 3
+    min_ratio: 0.05
+`
+
+// reloadShadowed reloads extra on top of shadowedConfig and feeds the shadow
+// run messages the active pipeline prepared fine.
+func reloadShadowed(t *testing.T, extra string) {
+	t.Helper()
+	useConfig(t, shadowedConfig)
+	active := &pipeline{}
+	usePipeline(active)
+
+	writeConfig(t, shadowedConfig+extra)
+	reloadConfig("test")
+	if shadow.Load() == nil {
+		t.Fatal("reload didn't start a shadow run")
+	}
+	if stages() != active {
+		t.Fatal("reload applied the pipeline before shadowing it")
+	}
+	for range 50 {
+		shadowDelivery("test", "a.b", []byte(`{"x":1}`), false)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for shadow.Load() != nil && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if shadow.Load() != nil {
+		t.Fatal("shadow run didn't end")
+	}
+}
+
+func TestShadowRejectsFailingPipeline(t *testing.T) {
+	reloadShadowed(t, "transforms:\n  - name: broken\n    template: \"not json\"\n")
+
+	if len(stages().transforms) != 0 {
+		t.Error("pipeline that failed its shadow run was applied")
+	}
+	if conf().IsSet("transforms") {
+		t.Error("config whose pipeline failed its shadow run was applied")
+	}
+}
+
+func TestShadowPromotesHealthyPipeline(t *testing.T) {
+	reloadShadowed(t, "transforms:\n  - name: tag\n    set:\n      - field: tagged\n        value: \"yes\"\n")
+
+	if len(stages().transforms) != 1 || !conf().IsSet("transforms") {
+		t.Error("pipeline that passed its shadow run wasn't applied")
+	}
+}
@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shutdown drains the relay once its source has stopped: deliveries queued in
+// lanes are relayed, listeners stop accepting, client send queues are flushed
+// and every client gets a close frame, all within shutdown.drain_timeout.
+func shutdown() {
+	start := time.Now()
+	draining.Store(true)
+	log.WithFields(logrus.Fields{
+		"event":  "shutdown",
+		"status": "draining",
+	}).Info("Shutting down, draining in-flight messages")
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf().GetDuration("shutdown.drain_timeout"))
+	defer cancel()
+
+	drainLanes(ctx)
+	shutdownListeners(ctx)
+	drainClientQueues(ctx)
+
+	clientsMu.Lock()
+	closed := len(clients)
+	for c := range clients {
+		closeClient(c, reasonServerDrain, conf().GetString("shutdown.close_reason"))
+		delete(clients, c)
+	}
+	clientsMu.Unlock()
+
+	log.WithFields(logrus.Fields{
+		"event":       "shutdown",
+		"status":      "completed",
+		"clients":     closed,
+		"duration_ms": time.Since(start).Milliseconds(),
+	}).Info("Service stopped")
+	hooks.shutDown()
+}
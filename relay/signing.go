@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type signingKey struct {
+	ID          string    `mapstructure:"id"`
+	Secret      string    `mapstructure:"secret"`
+	ActiveFrom  time.Time `mapstructure:"active_from"`
+	ActiveUntil time.Time `mapstructure:"active_until"`
+}
+
+type signingKeyView struct {
+	ID          string     `json:"id"`
+	ActiveFrom  time.Time  `json:"active_from"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+	Current     bool       `json:"current"`
+}
+
+func readSigningKeys(cfg *viper.Viper) ([]signingKey, error) {
+	var keys []signingKey
+	err := unmarshalConfigFrom(cfg, "signing.keys", &keys)
+	return keys, err
+}
+
+// currentSigningKey returns the active key that started most recently, so a
+// key with a future active_from takes over automatically when its time comes.
+func currentSigningKey(now time.Time) *signingKey {
+	return currentKey(stages().signingKeys, now)
+}
+
+func currentKey(keys []signingKey, now time.Time) *signingKey {
+	var current *signingKey
+	for i := range keys {
+		k := &keys[i]
+		if !k.activeAt(now) {
+			continue
+		}
+		if current == nil || k.ActiveFrom.After(current.ActiveFrom) {
+			current = k
+		}
+	}
+	return current
+}
+
+func (k *signingKey) activeAt(now time.Time) bool {
+	return !now.Before(k.ActiveFrom) && (k.ActiveUntil.IsZero() || now.Before(k.ActiveUntil))
+}
+
+// handleSigningKeys publishes the IDs of current and upcoming keys so consumers
+// can provision secrets ahead of a rotation. Secrets are never exposed.
+func handleSigningKeys(w http.ResponseWriter, _ *http.Request) {
+	now := time.Now()
+	keys := stages().signingKeys
+	current := currentKey(keys, now)
+
+	views := make([]signingKeyView, 0, len(keys))
+	for i := range keys {
+		k := &keys[i]
+		if !k.ActiveUntil.IsZero() && !now.Before(k.ActiveUntil) {
+			continue
+		}
+		v := signingKeyView{ID: k.ID, ActiveFrom: k.ActiveFrom, Current: k == current}
+		if !k.ActiveUntil.IsZero() {
+			v.ActiveUntil = &k.ActiveUntil
+		}
+		views = append(views, v)
+	}
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+func signHMAC(secret string, data []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,201 @@
+package relay
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// stormSignal wakes every churning client at once.
+type stormSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+func (s *stormSignal) wait() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ch
+}
+
+func (s *stormSignal) fire() {
+	s.mu.Lock()
+	close(s.ch)
+	s.ch = make(chan struct{})
+	s.mu.Unlock()
+}
+
+type runtimeStats struct {
+	Goroutines int    `json:"goroutines"`
+	HeapAlloc  uint64 `json:"heap_alloc"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	Clients    int    `json:"clients"`
+}
+
+func readRuntimeStats() runtimeStats {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	clientsMu.Lock()
+	n := len(clients)
+	clientsMu.Unlock()
+	return runtimeStats{Goroutines: runtime.NumGoroutine(), HeapAlloc: m.HeapAlloc, HeapInuse: m.HeapInuse, Clients: n}
+}
+
+func handleRuntime(w http.ResponseWriter, _ *http.Request) {
+	writeJSON(w, http.StatusOK, readRuntimeStats())
+}
+
+// runSoak drives the relay with demo traffic and churning WebSocket clients
+// for the given duration, then checks that goroutines and heap return to their
+// baseline once every client is gone. It exits non-zero on a suspected leak.
+func runSoak(duration time.Duration, clientCount int) {
+	promote("startup") // soak runs always consume, whatever ha.mode says
+	go runDemoSource(context.Background())
+
+	url := "ws://" + soakTarget() + "/ws"
+	time.Sleep(conf().GetDuration("soak.warmup"))
+	runtime.GC()
+	baseline := readRuntimeStats()
+	log.WithFields(logrus.Fields{
+		"event":    "soak",
+		"status":   "started",
+		"duration": duration.String(),
+		"clients":  clientCount,
+		"baseline": baseline,
+	}).Info("Soak run started")
+
+	ctx, cancel := context.WithTimeout(context.Background(), duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	storm := &stormSignal{ch: make(chan struct{})}
+	for range clientCount {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			churnClient(ctx, url, storm)
+		}()
+	}
+	go soakStorms(ctx, storm)
+	go soakSampler(ctx)
+
+	wg.Wait()
+	time.Sleep(conf().GetDuration("soak.settle"))
+	runtime.GC()
+	final := readRuntimeStats()
+
+	fields := logrus.Fields{"event": "soak", "baseline": baseline, "final": final}
+	if leaked := soakLeaks(baseline, final); len(leaked) > 0 {
+		fields["leaked"] = leaked
+		log.WithFields(fields).WithField("status", "leak_suspected").Error("Soak run finished with unreleased resources")
+		os.Exit(1)
+	}
+	log.WithFields(fields).WithField("status", "passed").Info("Soak run finished")
+}
+
+// soakLeaks names what final holds on to beyond baseline: clients still
+// registered, or goroutines or heap grown past soak.max_goroutine_growth and
+// soak.max_heap_growth.
+func soakLeaks(baseline, final runtimeStats) []string {
+	var leaked []string
+	if final.Clients > 0 {
+		leaked = append(leaked, "clients")
+	}
+	if final.Goroutines-baseline.Goroutines > conf().GetInt("soak.max_goroutine_growth") {
+		leaked = append(leaked, "goroutines")
+	}
+	if int64(final.HeapInuse)-int64(baseline.HeapInuse) > conf().GetInt64("soak.max_heap_growth") {
+		leaked = append(leaked, "heap")
+	}
+	return leaked
+}
+
+// soakTarget turns the first listener address into a dialable host:port.
+func soakTarget() string {
+	addr := listenerConfigs()[0].Address
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || host == "::" || host == "0.0.0.0" {
+		return net.JoinHostPort("localhost", port)
+	}
+	return addr
+}
+
+// churnClient connects, reads for a random time and disconnects, either with a
+// close frame or by dropping the TCP connection, until ctx is done. A storm
+// signal makes every client drop at once and reconnect together.
+func churnClient(ctx context.Context, url string, storm *stormSignal) {
+	for ctx.Err() == nil {
+		conn, resp, err := websocket.DefaultDialer.DialContext(ctx, url, nil)
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		if err != nil {
+			time.Sleep(time.Duration(rand.IntN(int(time.Second)))) //nolint:gosec // jitter
+			continue
+		}
+
+		go func() {
+			for {
+				if _, _, rerr := conn.NextReader(); rerr != nil {
+					return
+				}
+			}
+		}()
+
+		select {
+		case <-ctx.Done():
+		case <-storm.wait():
+		case <-time.After(time.Duration(rand.IntN(int(2 * time.Second)))): //nolint:gosec // jitter
+		}
+
+		if rand.IntN(2) == 0 { //nolint:gosec // jitter
+			msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+			_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+			conn.Close()
+		} else if tcp, ok := conn.UnderlyingConn().(*net.TCPConn); ok {
+			_ = tcp.SetLinger(0)
+			tcp.Close()
+		} else {
+			conn.Close()
+		}
+	}
+}
+
+func soakStorms(ctx context.Context, storm *stormSignal) {
+	ticker := time.NewTicker(conf().GetDuration("soak.storm_interval"))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.WithFields(logrus.Fields{"event": "soak", "status": "storm"}).Info("Triggering reconnect storm")
+			storm.fire()
+		}
+	}
+}
+
+func soakSampler(ctx context.Context) {
+	ticker := time.NewTicker(conf().GetDuration("soak.sample_interval"))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			log.WithFields(logrus.Fields{
+				"event":   "soak",
+				"status":  "sample",
+				"runtime": readRuntimeStats(),
+			}).Info("Soak sample")
+		}
+	}
+}
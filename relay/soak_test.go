@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSoakLeaks(t *testing.T) {
+	useConfig(t, "soak:\n  max_goroutine_growth: 5\n  max_heap_growth: 1000\n")
+	baseline := runtimeStats{Goroutines: 10, HeapInuse: 5000}
+
+	tests := []struct {
+		name  string
+		final runtimeStats
+		want  []string
+	}{
+		{"back to baseline", runtimeStats{Goroutines: 10, HeapInuse: 5000}, nil},
+		{"within bounds", runtimeStats{Goroutines: 15, HeapInuse: 6000}, nil},
+		{"heap shrank", runtimeStats{Goroutines: 8, HeapInuse: 1000}, nil},
+		{"clients left", runtimeStats{Goroutines: 10, HeapInuse: 5000, Clients: 1}, []string{"clients"}},
+		{"goroutines grew", runtimeStats{Goroutines: 16, HeapInuse: 5000}, []string{"goroutines"}},
+		{"everything grew", runtimeStats{Goroutines: 30, HeapInuse: 9000, Clients: 2},
+			[]string{"clients", "goroutines", "heap"}},
+	}
+	for _, tt := range tests {
+		if got := soakLeaks(baseline, tt.final); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: soakLeaks() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStormSignalWakesWaiters(t *testing.T) {
+	storm := &stormSignal{ch: make(chan struct{})}
+	waiting := storm.wait()
+	storm.fire()
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatal("fire didn't wake a waiter")
+	}
+	select {
+	case <-storm.wait():
+		t.Fatal("a waiter after fire was woken by it")
+	default:
+	}
+}
+
+// TestSoakChurnReleasesClients runs a short soak against a WebSocket handler:
+// churning clients and a reconnect storm must leave no client registered and
+// no goroutines behind once they stop.
+func TestSoakChurnReleasesClients(t *testing.T) {
+	if testing.Short() {
+		t.Skip("soak run")
+	}
+	useConfig(t, "log:\n  level: warn\n")
+	usePipeline(&pipeline{})
+	initAcceptLimiter()
+	initAuthenticator()
+	srv := httptest.NewServer(http.HandlerFunc(handleWebSocket))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	runtime.GC()
+	baseline := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	storm := &stormSignal{ch: make(chan struct{})}
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			churnClient(ctx, url, storm)
+		}()
+	}
+	time.Sleep(500 * time.Millisecond)
+	storm.fire()
+	wg.Wait()
+	srv.CloseClientConnections()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		clientsMu.Lock()
+		n := len(clients)
+		clientsMu.Unlock()
+		if n == 0 && runtime.NumGoroutine() <= baseline+2 {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	t.Errorf("after the soak %d clients are registered and %d goroutines run, %d before",
+		len(clients), runtime.NumGoroutine(), baseline)
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Source feeds the relay with deliveries, handing each to Dispatch, until ctx
+// is done.
+type Source interface {
+	Run(ctx context.Context)
+}
+
+// sourceFunc adapts a run function to Source.
+type sourceFunc func(ctx context.Context)
+
+func (f sourceFunc) Run(ctx context.Context) { f(ctx) }
+
+// SourceFactory builds a source from its config section.
+type SourceFactory func() (Source, error)
+
+var sourceTypes = make(map[string]SourceFactory)
+
+// RegisterSource makes a source selectable through source.type. New brokers
+// register themselves from an init function, in this package or the embedding
+// program, before New. Registering a name twice panics.
+func RegisterSource(name string, factory SourceFactory) {
+	if _, dup := sourceTypes[name]; dup {
+		panic("source registered twice: " + name)
+	}
+	sourceTypes[name] = factory
+}
+
+// Dispatch hands a delivery consumed by source to the relay, as the built-in
+// sources do. With rabbitmq.ack.mode broadcast, msg's Acknowledger, if set, is
+// acked or nacked once the delivery settles.
+func Dispatch(source string, msg amqp.Delivery) {
+	dispatchDelivery(source, msg)
+}
+
+func init() {
+	RegisterSource("rabbitmq", func() (Source, error) { return sourceFunc(runConsumer), nil })
+	RegisterSource("upstream", func() (Source, error) { return sourceFunc(runUpstreamSource), nil })
+	RegisterSource("demo", func() (Source, error) { return sourceFunc(runDemoSource), nil })
+}
+
+// sourceType is source.type, defaulting to "upstream" when upstream.url is
+// set and "rabbitmq" otherwise. The demo flag overrides both.
+func sourceType(demo bool) string {
+	switch {
+	case demo:
+		return "demo"
+	case conf().GetString("source.type") != "":
+		return conf().GetString("source.type")
+	case conf().GetString("upstream.url") != "":
+		return "upstream"
+	}
+	return "rabbitmq"
+}
+
+func newSource(name string) Source {
+	factory, ok := sourceTypes[name]
+	var src Source
+	var err error
+	if !ok {
+		err = fmt.Errorf("unknown source %q, registered: %v", name, registeredSources())
+	} else {
+		src, err = factory()
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "source_config",
+			"status": "failed",
+			"source": name,
+			"error":  err.Error(),
+		}).Fatal("Failed to configure event source")
+	}
+	return src
+}
+
+func registeredSources() []string {
+	names := make([]string, 0, len(sourceTypes))
+	for name := range sourceTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sseWriteTimeout bounds one SSE write so a stalled client can't hold its
+// writer goroutine forever.
+const sseWriteTimeout = 10 * time.Second
+
+// sseStream is the response of a text/event-stream client. Only the client's
+// writer goroutine writes to it; close ends the handler, which waits for the
+// writer before returning.
+type sseStream struct {
+	w         http.ResponseWriter
+	rc        *http.ResponseController
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *sseStream) close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// write sends f as one event. Control frames become comments, which
+// EventSource ignores, so they serve as heartbeats.
+func (s *sseStream) write(f queuedFrame) (int, error) {
+	if f.control {
+		return s.send(append(append([]byte(": "), f.out.frame...), '\n', '\n'))
+	}
+	var b bytes.Buffer
+	if f.out.id != "" {
+		fmt.Fprintf(&b, "id: %s\n", f.out.id)
+	}
+	for _, line := range strings.Split(string(f.out.frame), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", strings.TrimSuffix(line, "\r"))
+	}
+	b.WriteByte('\n')
+	return s.send(b.Bytes())
+}
+
+func (s *sseStream) send(data []byte) (int, error) {
+	_ = s.rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+	n, err := s.w.Write(data)
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	return n, err
+}
+
+// sseTopics reads the patterns an SSE client subscribes to, nil without
+// ?topics=.
+func sseTopics(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("topics")
+	if raw == "" {
+		return nil, nil
+	}
+	topics := strings.Split(raw, ",")
+	if limit := conf().GetInt("subscriptions.max_topics"); limit > 0 && len(topics) > limit {
+		return nil, fmt.Errorf("at most %d subscriptions allowed", limit)
+	}
+	return topics, checkPatterns(topics)
+}
+
+// handleSSE streams the same broadcasts as /ws as Server-Sent Events, for
+// clients behind proxies that break WebSockets. Subscriptions come from
+// ?topics=a,b or the profile since the stream is one-way, and EventSource's
+// Last-Event-ID resumes from the replay buffer.
+func handleSSE(w http.ResponseWriter, r *http.Request) {
+	if !checkOrigin(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Add("Vary", "Origin")
+	}
+	topics, err := sseTopics(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, ok := admitClient(w, r, topics)
+	if !ok {
+		return
+	}
+	defer goroutines.release(c, "reader")
+
+	c.binary = false
+	c.compression = clientCompression{}
+	c.sse = &sseStream{w: w, rc: http.NewResponseController(w), done: make(chan struct{})}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	retryMs := suggestedRetryAfter().Milliseconds()
+	if _, err := c.sse.send([]byte(fmt.Sprintf("retry: %d\n\n", retryMs))); err != nil {
+		goroutines.release(c, "writer")
+		return
+	}
+
+	clientsMu.Lock()
+	if !addClient(c) {
+		clientsMu.Unlock()
+		goroutines.release(c, "writer")
+		return
+	}
+	c.expireAuth()
+	backlog := replayFor(c, lastEventID(r))
+	sendRetained(c)
+	sendAnnotations(c)
+	info := c.view()
+	clientsMu.Unlock()
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		c.runWriter(backlog)
+	}()
+	hooks.clientConnected(info)
+
+	log.WithFields(logrus.Fields{
+		"event":     "sse_connection",
+		"status":    "connected",
+		"client":    r.RemoteAddr,
+		"client_id": c.id,
+		"tenant":    c.tenant,
+		"subject":   c.subject,
+		"profile":   c.profile,
+		"topics":    c.subscriptions,
+		"replayed":  len(backlog),
+	}).Info("New SSE client connected")
+
+	heartbeat := time.NewTicker(max(conf().GetDuration("sse.heartbeat"), time.Second))
+	defer heartbeat.Stop()
+	clientGone := false
+	for !clientGone {
+		select {
+		case <-r.Context().Done():
+			clientGone = true
+		case <-c.sse.done:
+			clientGone = true
+		case <-heartbeat.C:
+			clientsMu.Lock()
+			c.enqueue(queuedFrame{out: outbound{frame: []byte("ping")}, control: true}, true)
+			clientsMu.Unlock()
+		}
+	}
+
+	clientsMu.Lock()
+	delete(clients, c)
+	c.stopAuthExpiry()
+	c.queues.close()
+	if c.stats.closeReason == "" && r.Context().Err() != nil {
+		c.stats.closeReason = reasonClientClosed
+	}
+	fields := c.closeSummary(nil)
+	info = c.view()
+	clientsMu.Unlock()
+	c.sse.close()
+	<-writerDone
+
+	fields["event"] = "sse_disconnection"
+	log.WithFields(fields).Info("SSE client disconnected")
+	hooks.clientDisconnected(info, string(fields["reason"].(disconnectReason)))
+}
@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	haModeStandby   = "standby"
+	haElectionRedis = "redis"
+)
+
+// renewLease extends the leadership lease only while this instance holds it.
+var renewLease = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+var (
+	// active is closed once the instance is promoted and starts consuming.
+	active     = make(chan struct{})
+	promoteMu  sync.Mutex
+	promotedAt time.Time
+	// leaseAt is when this instance last took or renewed the election lease.
+	leaseAt time.Time
+)
+
+// startHA decides whether the instance starts active. A standby keeps its
+// broker connections open and serves clients and health endpoints, but
+// consumes nothing until promoted through POST /admin/promote or by winning
+// the ha.election lease.
+func startHA(ctx context.Context) {
+	standby := conf().GetString("ha.mode") == haModeStandby
+	election := conf().GetString("ha.election") == haElectionRedis
+	if !standby && !election {
+		promote("startup")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":    "ha",
+		"status":   "standby",
+		"election": conf().GetString("ha.election"),
+	}).Info("Starting in standby, waiting for promotion")
+	if election {
+		go runElection(ctx)
+	}
+}
+
+// promote makes the instance active. Promoting an active instance is a no-op.
+func promote(reason string) bool {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+	if !promotedAt.IsZero() {
+		return false
+	}
+	promotedAt = time.Now()
+	close(active)
+	if reason != "startup" {
+		log.WithFields(logrus.Fields{
+			"event":  "ha",
+			"status": "promoted",
+			"reason": reason,
+		}).Warn("Standby promoted to active")
+	}
+	return true
+}
+
+func haRole() string {
+	select {
+	case <-active:
+		return "active"
+	default:
+		return haModeStandby
+	}
+}
+
+// awaitActive blocks until the instance is promoted and reports false if ctx
+// is done first.
+func awaitActive(ctx context.Context) bool {
+	select {
+	case <-active:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// runElection competes for a Redis lease and promotes the instance when it
+// wins. Losing the lease while active, or failing to renew it for a whole
+// lease_ttl, exits the process rather than risking two instances consuming at
+// once; it restarts as a standby.
+func runElection(ctx context.Context) {
+	client := sharedRedisClient()
+	key := conf().GetString("ha.lease_key")
+	ttl := conf().GetDuration("ha.lease_ttl")
+	id := relayInstanceID()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		if haRole() == haModeStandby {
+			won, err := client.SetNX(ctx, key, id, ttl).Result()
+			if err == nil && won {
+				setLeaseAt(time.Now())
+				promote("election")
+			}
+		} else {
+			renewed, err := renewLease.Run(ctx, client, []string{key}, id, ttl.Milliseconds()).Int()
+			switch {
+			case err == nil && renewed == 1:
+				setLeaseAt(time.Now())
+			case err == nil:
+				err = errors.New("lease taken by another instance")
+			case time.Since(lastLeaseAt()) < ttl:
+				err = nil // still within the lease, retry on the next tick
+			}
+			if err != nil && ctx.Err() == nil {
+				log.WithFields(logrus.Fields{
+					"event":  "ha",
+					"status": "lease_lost",
+					"key":    key,
+					"error":  err.Error(),
+				}).Fatal("Lost leadership lease, exiting to rejoin as standby")
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func setLeaseAt(t time.Time) {
+	promoteMu.Lock()
+	leaseAt = t
+	promoteMu.Unlock()
+}
+
+func lastLeaseAt() time.Time {
+	promoteMu.Lock()
+	defer promoteMu.Unlock()
+	return leaseAt
+}
+
+// handlePromote promotes the instance on demand. With an election it first
+// takes the lease from the current leader, which then steps down on its next
+// renewal.
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	if haRole() == haModeStandby && conf().GetString("ha.election") == haElectionRedis {
+		err := sharedRedisClient().Set(r.Context(), conf().GetString("ha.lease_key"), relayInstanceID(),
+			conf().GetDuration("ha.lease_ttl")).Err()
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, "failed to take leadership lease: "+err.Error())
+			return
+		}
+		setLeaseAt(time.Now())
+	}
+	promoted := promote("admin")
+	promoteMu.Lock()
+	since := promotedAt
+	promoteMu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"role": haRole(), "promoted": promoted, "active_since": since})
+}
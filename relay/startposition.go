@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Start positions shared by every replayable source. A position can also be
+// an RFC 3339 timestamp, the first record at or after it.
+const (
+	startEarliest = "earliest"
+	startLatest   = "latest"
+	// startStored resumes from the cursor the source committed last.
+	startStored = "stored"
+
+	// streamOffsetHeader carries a RabbitMQ stream delivery's offset.
+	streamOffsetHeader = "x-stream-offset"
+)
+
+var errStoredCursor = errors.New("stored cursors need a source that commits them; " +
+	"use earliest, latest or a timestamp")
+
+// startPosition is where a replayable source begins reading when it starts.
+type startPosition struct {
+	kind string
+	at   time.Time
+}
+
+// parseStartPosition reads a start_position value, def when it is empty.
+func parseStartPosition(value, def string) (startPosition, error) {
+	if value == "" {
+		value = def
+	}
+	switch value {
+	case startEarliest, startLatest, startStored:
+		return startPosition{kind: value}, nil
+	}
+	at, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return startPosition{}, fmt.Errorf(
+			"unknown start_position %q: want earliest, latest, stored or an RFC 3339 time", value)
+	}
+	return startPosition{at: at}, nil
+}
+
+func (p startPosition) String() string {
+	if p.kind == "" {
+		return p.at.Format(time.RFC3339)
+	}
+	return p.kind
+}
+
+var (
+	// streamCursors is the offset after the last delivery of each RabbitMQ
+	// stream source, so a reconnect resumes rather than starting over. They
+	// live in memory only: a restart begins at start_position again.
+	streamCursors   = make(map[string]int64)
+	streamCursorsMu sync.Mutex
+)
+
+// streamOffset is the x-stream-offset consumer argument for src: its cursor
+// after a reconnect, else its start_position.
+func (src sourceConfig) streamOffset() (any, error) {
+	streamCursorsMu.Lock()
+	next, ok := streamCursors[src.Name]
+	streamCursorsMu.Unlock()
+	if ok {
+		return next, nil
+	}
+
+	pos, err := parseStartPosition(src.StartPosition, startLatest)
+	switch {
+	case err != nil:
+		return nil, err
+	case pos.kind == startEarliest:
+		return "first", nil
+	case pos.kind == startLatest:
+		return "next", nil
+	case pos.kind == startStored:
+		return nil, errStoredCursor
+	}
+	return pos.at, nil
+}
+
+// advanceStreamCursor records the offset of a delivery from a stream source.
+func advanceStreamCursor(source string, msg amqp.Delivery) {
+	offset, ok := msg.Headers[streamOffsetHeader].(int64)
+	if !ok {
+		return
+	}
+	streamCursorsMu.Lock()
+	streamCursors[source] = offset + 1
+	streamCursorsMu.Unlock()
+}
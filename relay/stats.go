@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// clientStats is guarded by clientsMu.
+type clientStats struct {
+	messagesSent int64
+	drops        int64
+	writeTime    time.Duration
+	closeReason  disconnectReason
+}
+
+// ClientInfo describes a connected client for admin listings and Relay.Clients.
+type ClientInfo struct {
+	Client        string    `json:"client"`
+	ClientID      string    `json:"client_id,omitempty"`
+	Tenant        string    `json:"tenant,omitempty"`
+	Subject       string    `json:"subject,omitempty"`
+	Transport     string    `json:"transport"`
+	Profile       string    `json:"profile,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	Subscriptions []string  `json:"subscriptions"`
+	Filter        string    `json:"filter,omitempty"`
+	QueueDepth    int       `json:"queue_depth"`
+	MessagesSent  int64     `json:"messages_sent"`
+	Drops         int64     `json:"drops"`
+	BytesSent     int64     `json:"bytes_sent"`
+}
+
+// transport is the sink c is delivered through: sinkWebSocket or sinkSSE.
+func (c *client) transport() string {
+	if c.sse != nil {
+		return sinkSSE
+	}
+	return sinkWebSocket
+}
+
+// view describes c. Must be called with clientsMu held.
+func (c *client) view() ClientInfo {
+	var filter string
+	if c.filter != nil {
+		filter = c.filter.source
+	}
+	return ClientInfo{
+		Client:        c.remoteAddr,
+		ClientID:      c.id,
+		Tenant:        c.tenant,
+		Subject:       c.subject,
+		Transport:     c.transport(),
+		Profile:       c.profile,
+		ConnectedAt:   c.connectedAt,
+		Subscriptions: c.subscriptions,
+		Filter:        filter,
+		QueueDepth:    c.queues.depth(),
+		MessagesSent:  c.stats.messagesSent,
+		Drops:         c.stats.drops,
+		BytesSent:     c.usage.bytesSent,
+	}
+}
+
+// closeSummary builds the disconnect record for c from the error that ended
+// its read loop. Must be called with clientsMu held.
+func (c *client) closeSummary(readErr error) logrus.Fields {
+	reason := c.stats.closeReason
+	closeCode := 0
+	var closeErr *websocket.CloseError
+	if errors.As(readErr, &closeErr) {
+		closeCode = closeErr.Code
+		if reason == "" {
+			reason = reasonClientClosed
+		}
+	} else if reason == "" {
+		reason = reasonConnectionLost
+	}
+	recordDisconnect(reason)
+
+	var avgLatency float64
+	if c.stats.messagesSent > 0 {
+		avgLatency = float64(c.stats.writeTime.Microseconds()) / float64(c.stats.messagesSent) / 1000
+	}
+
+	return logrus.Fields{
+		"event":                "websocket_disconnection",
+		"status":               "disconnected",
+		"client":               c.remoteAddr,
+		"client_id":            c.id,
+		"tenant":               c.tenant,
+		"duration_sec":         time.Since(c.connectedAt).Seconds(),
+		"messages_sent":        c.stats.messagesSent,
+		"bytes_sent":           c.usage.bytesSent,
+		"drops":                c.stats.drops,
+		"avg_write_latency_ms": avgLatency,
+		"close_code":           closeCode,
+		"reason":               reason,
+	}
+}
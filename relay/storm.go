@@ -0,0 +1,43 @@
+package relay
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// acceptLimiter is swapped on config reload while upgrades are admitted.
+var acceptLimiter atomic.Pointer[rateLimiter]
+
+func initAcceptLimiter() {
+	limiter := newRateLimiter("accept", conf().GetFloat64("server.accept_rate"), conf().GetInt("server.accept_burst"))
+	acceptLimiter.Store(&limiter)
+}
+
+func suggestedRetryAfter() time.Duration {
+	return retryAfter(conf().GetDuration("server.retry_after"), conf().GetDuration("server.retry_jitter"))
+}
+
+// admitConnection applies staggered acceptance to upgrades. When the accept
+// rate is exhausted it responds 503 with a jittered Retry-After and returns false.
+func admitConnection(w http.ResponseWriter, r *http.Request) bool {
+	if (*acceptLimiter.Load()).Allow() {
+		return true
+	}
+	delay := suggestedRetryAfter()
+	seconds := int(delay.Round(time.Second) / time.Second)
+
+	log.WithFields(logrus.Fields{
+		"event":       "websocket_admission",
+		"status":      "throttled",
+		"client":      r.RemoteAddr,
+		"retry_after": seconds,
+	}).Warn("Connection rate exceeded, asking client to retry later")
+
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "server busy, retry later", http.StatusServiceUnavailable)
+	return false
+}
@@ -0,0 +1,215 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	subscriptionMatchRoutingKey = "routing_key"
+	subscriptionMatchField      = "field"
+
+	// controlReadLimit bounds a control message read from a client.
+	controlReadLimit = 64 << 10
+)
+
+// controlMessage is a client request on the WebSocket, e.g.
+// {"action":"subscribe","topics":["flights.arrivals"],"fields":["id","status"]}.
+// Fields, when given, project payloads delivered for those topics; Sample and
+// MaxRate ("5/s") downsample them. A "hello" carries Capabilities instead,
+// and from a reconnecting SDK its ReconnectReason and PreviousSession; a
+// "publish" carries a Topic and Payload to publish to RabbitMQ.
+type controlMessage struct {
+	ID           string          `json:"id,omitempty"`
+	Action       string          `json:"action"`
+	Topics       []string        `json:"topics"`
+	Fields       []string        `json:"fields,omitempty"`
+	Sample       float64         `json:"sample,omitempty"`
+	MaxRate      string          `json:"max_rate,omitempty"`
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+	Topic        string          `json:"topic,omitempty"`
+	Payload      json.RawMessage `json:"payload,omitempty"`
+
+	ReconnectReason string           `json:"reconnect_reason,omitempty"`
+	PreviousSession *previousSession `json:"previous_session,omitempty"`
+}
+
+type controlReply struct {
+	ID           string          `json:"id,omitempty"`
+	Type         string          `json:"type"`
+	Topics       []string        `json:"topics,omitempty"`
+	Capabilities map[string]bool `json:"capabilities,omitempty"`
+	Error        string          `json:"error,omitempty"`
+	Reason       string          `json:"reason,omitempty"`
+	ServerTime   time.Time       `json:"server_time"`
+}
+
+// subscriptionKey is what client subscriptions are matched against: the
+// routing key, or the string value of subscriptions.field in a JSON payload.
+func subscriptionKey(topic string, body []byte) string {
+	if conf().GetString("subscriptions.match") != subscriptionMatchField {
+		return topic
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return ""
+	}
+	key, _ := lookupField(doc, conf().GetString("subscriptions.field"))
+	return key
+}
+
+// subscribed reports whether key matches c's subscriptions. A client that never
+// subscribed gets everything unless subscriptions.default is "none".
+// Must be called with clientsMu held.
+func (c *client) subscribed(key string) bool {
+	if c.subscriptions == nil {
+		return conf().GetString("subscriptions.default") != "none"
+	}
+	return key != "" && matchesAny(c.subscriptions, key)
+}
+
+// handleControl applies a control message from c and writes the reply.
+func handleControl(c *client, data []byte) {
+	var msg controlMessage
+	err := json.Unmarshal(data, &msg)
+	if err == nil && msg.Action == "publish" {
+		handlePublish(c, msg)
+		return
+	}
+	if err == nil && msg.Action == "subscribe" {
+		err = c.authorizeTopics(context.Background(), msg.Topics)
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	var added []string
+	reply := controlReply{ID: msg.ID, Type: "subscribed"}
+	switch {
+	case err != nil:
+	case msg.Action == "hello":
+		c.negotiate(msg.Capabilities)
+		c.recordReconnect(msg)
+		reply.Type = "hello"
+		reply.Capabilities = c.capabilities
+	default:
+		added, err = c.applyControl(msg)
+		reply.Topics = c.subscriptions
+	}
+	if err != nil {
+		reply = controlReply{ID: msg.ID, Type: "error", Error: err.Error()}
+	}
+	reply.ServerTime = time.Now().UTC()
+
+	log.WithFields(logrus.Fields{
+		"event":         "websocket_control",
+		"status":        reply.Type,
+		"client":        c.remoteAddr,
+		"action":        msg.Action,
+		"subscriptions": c.subscriptions,
+	}).Debug("Handled client control message")
+
+	frame, _ := json.Marshal(reply)
+	if !c.enqueue(queuedFrame{out: outbound{frame: frame}, control: true}, true) {
+		return
+	}
+	if len(added) > 0 {
+		sendRetainedFor(c, added)
+		sendAnnotationsFor(c, added)
+	}
+}
+
+// applyControl updates c's subscriptions and returns newly added patterns.
+func (c *client) applyControl(msg controlMessage) ([]string, error) {
+	if c.profileLocked {
+		return nil, fmt.Errorf("subscriptions are managed by profile %q", c.profile)
+	}
+	if err := checkPatterns(msg.Topics); err != nil {
+		return nil, err
+	}
+
+	switch msg.Action {
+	case "subscribe":
+		opts, err := newSubscriptionOptions(msg.Fields, msg.Sample, msg.MaxRate)
+		if err != nil {
+			return nil, err
+		}
+		var added []string
+		subs := slices.Clone(c.subscriptions)
+		for _, topic := range msg.Topics {
+			if !slices.Contains(subs, topic) {
+				subs = append(subs, topic)
+				added = append(added, topic)
+			}
+		}
+		if limit := conf().GetInt("subscriptions.max_topics"); limit > 0 && len(subs) > limit {
+			return nil, fmt.Errorf("at most %d subscriptions allowed", limit)
+		}
+		if subs == nil {
+			subs = []string{}
+		}
+		c.subscriptions = subs
+		c.setOptions(msg.Topics, opts)
+		return added, nil
+	case "unsubscribe":
+		c.subscriptions = slices.DeleteFunc(slices.Clone(c.subscriptions), func(topic string) bool {
+			return slices.Contains(msg.Topics, topic)
+		})
+		if c.subscriptions == nil {
+			c.subscriptions = []string{}
+		}
+		c.setOptions(msg.Topics, subscriptionOptions{})
+		return nil, nil
+	}
+	return nil, errors.New("unknown action")
+}
+
+// checkPatterns rejects topic patterns a client may not subscribe with,
+// including ones longer than subscriptions.max_pattern_length or with more
+// words than subscriptions.max_pattern_words.
+func checkPatterns(topics []string) error {
+	maxLength := conf().GetInt("subscriptions.max_pattern_length")
+	maxWords := conf().GetInt("subscriptions.max_pattern_words")
+	for _, topic := range topics {
+		if topic == "" || strings.Contains(topic, "..") {
+			return fmt.Errorf("invalid topic pattern %q", topic)
+		}
+		if maxLength > 0 && len(topic) > maxLength {
+			return fmt.Errorf("topic pattern is longer than %d bytes", maxLength)
+		}
+		if maxWords > 0 && strings.Count(topic, ".")+1 > maxWords {
+			return fmt.Errorf("topic pattern %q has more than %d words", topic, maxWords)
+		}
+	}
+	return nil
+}
+
+// setOptions records opts for each topic pattern, or clears them when opts is
+// empty. Must be called with clientsMu held.
+func (c *client) setOptions(topics []string, opts subscriptionOptions) {
+	for _, topic := range topics {
+		if opts.empty() {
+			delete(c.options, topic)
+			continue
+		}
+		if c.options == nil {
+			c.options = make(map[string]subscriptionOptions)
+		}
+		topicOpts := opts
+		topicOpts.fields = slices.Clone(opts.fields)
+		if opts.limiter != nil {
+			topicOpts.limiter = newTokenBucket(opts.limiter.rate, 1)
+		}
+		c.options[topic] = topicOpts
+	}
+}
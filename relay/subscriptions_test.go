@@ -0,0 +1,29 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPatterns(t *testing.T) {
+	useConfig(t, "subscriptions:\n  max_pattern_length: 20\n  max_pattern_words: 3\n")
+
+	tests := []struct {
+		pattern string
+		ok      bool
+	}{
+		{"a.b.c", true},
+		{"#", true},
+		{"a.*.#", true},
+		{"", false},
+		{"a..b", false},
+		{"a.b.c.d", false},
+		{strings.Repeat("x", 21), false},
+		{strings.Repeat("x", 20), true},
+	}
+	for _, tt := range tests {
+		if err := checkPatterns([]string{tt.pattern}); (err == nil) != tt.ok {
+			t.Errorf("checkPatterns(%q) = %v, want ok %v", tt.pattern, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	syntheticClock = "clock"
+	syntheticStats = "stats"
+)
+
+// syntheticTopic is a topic the relay publishes itself on a fixed interval:
+// the current time for "clock", or live runtime and broadcast stats for
+// "stats". Dashboards use them to show liveness and soak runs as a stream of
+// known rate.
+type syntheticTopic struct {
+	Topic    string        `mapstructure:"topic"`
+	Kind     string        `mapstructure:"kind"`
+	Interval time.Duration `mapstructure:"interval"`
+}
+
+// syntheticStatsEvent is the payload of a "stats" topic.
+type syntheticStatsEvent struct {
+	Time     time.Time `json:"ts"`
+	Instance string    `json:"instance"`
+	UptimeS  float64   `json:"uptime_s"`
+	Role     string    `json:"role"`
+	Queued   int       `json:"queued_deliveries"`
+	runtimeStats
+}
+
+var relayStartedAt = time.Now()
+
+// startSynthetic runs a generator for each of the synthetic list until ctx is
+// done. The returned function waits for them to stop, so none dispatches
+// while the relay drains.
+func startSynthetic(ctx context.Context) (wait func()) {
+	var topics []syntheticTopic
+	if err := unmarshalConfig("synthetic", &topics); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "synthetic_config",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Fatal("Failed to read synthetic topics config")
+	}
+	var wg sync.WaitGroup
+	for _, t := range topics {
+		if t.Topic == "" || t.Interval <= 0 || (t.Kind != syntheticClock && t.Kind != syntheticStats) {
+			log.WithFields(logrus.Fields{
+				"event":  "synthetic_config",
+				"status": "skipped",
+				"topic":  t.Topic,
+				"kind":   t.Kind,
+			}).Warn("Skipping synthetic topic without a topic, interval or known kind")
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runSynthetic(ctx, t)
+		}()
+	}
+	return wg.Wait
+}
+
+func runSynthetic(ctx context.Context, t syntheticTopic) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			body, err := json.Marshal(syntheticEvent(t.Kind, now))
+			if err != nil {
+				continue
+			}
+			dispatchDelivery("synthetic", amqp.Delivery{
+				RoutingKey:  t.Topic,
+				MessageId:   newID(),
+				AppId:       "event-relay",
+				ContentType: "application/json",
+				Timestamp:   now,
+				Body:        body,
+			})
+		}
+	}
+}
+
+func syntheticEvent(kind string, now time.Time) any {
+	if kind == syntheticClock {
+		return map[string]any{"ts": now.UTC(), "unix_ms": now.UnixMilli(), "instance": relayInstanceID()}
+	}
+	return syntheticStatsEvent{
+		Time:         now.UTC(),
+		Instance:     relayInstanceID(),
+		UptimeS:      now.Sub(relayStartedAt).Seconds(),
+		Role:         haRole(),
+		Queued:       queuedDeliveries(),
+		runtimeStats: readRuntimeStats(),
+	}
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tenantAdminToken grants the /admin/tenant/* API for one tenant's clients,
+// usage and webhook subscriptions, and nothing else.
+type tenantAdminToken struct {
+	Token  string `mapstructure:"token"`
+	Tenant string `mapstructure:"tenant"`
+}
+
+var tenantAdminTokens []tenantAdminToken
+
+type tenantUsageView struct {
+	Tenant    string `json:"tenant"`
+	Window    string `json:"window"`
+	Bytes     int64  `json:"bytes"`
+	Clients   int    `json:"clients"`
+	Delivered int64  `json:"messages_sent"`
+	Drops     int64  `json:"drops"`
+}
+
+func registerTenantAdminRoutes() {
+	if err := unmarshalConfig("admin.tenant_tokens", &tenantAdminTokens); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "admin_config",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Fatal("Failed to read tenant admin tokens")
+	}
+	if len(tenantAdminTokens) == 0 {
+		return
+	}
+
+	handle(endpointsAdmin, "GET /admin/tenant/clients", requireTenantAdmin(handleTenantClients))
+	handle(endpointsAdmin, "DELETE /admin/tenant/clients/{client}", requireTenantAdmin(handleTenantKick))
+	handle(endpointsAdmin, "GET /admin/tenant/usage", requireTenantAdmin(handleTenantUsage))
+	if conf().GetBool("webhooks.enabled") {
+		handle(endpointsAdmin, "POST /admin/tenant/webhooks", requireTenantWebhooks(createSubscription))
+		handle(endpointsAdmin, "GET /admin/tenant/webhooks", requireTenantWebhooks(listSubscriptions))
+		handle(endpointsAdmin, "GET /admin/tenant/webhooks/{id}", requireTenantWebhooks(getSubscription))
+		handle(endpointsAdmin, "DELETE /admin/tenant/webhooks/{id}", requireTenantWebhooks(deleteSubscription))
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":   "admin_api",
+		"status":  "enabled",
+		"tenants": len(tenantAdminTokens),
+	}).Info("Tenant admin API enabled")
+}
+
+func requireTenantAdmin(next func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok {
+			for _, t := range tenantAdminTokens {
+				if t.Tenant != "" && t.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(t.Token)) == 1 {
+					if authorizeAdmin(w, r, "tenant-admin", t.Tenant) {
+						next(w, r, t.Tenant)
+					}
+					return
+				}
+			}
+		}
+		writeError(w, http.StatusUnauthorized, "invalid tenant admin token")
+	}
+}
+
+// requireTenantWebhooks scopes the webhook subscription handlers to the
+// tenant; its subscriptions are owned apart from any partner's.
+func requireTenantWebhooks(next func(http.ResponseWriter, *http.Request, webhookOwner)) http.HandlerFunc {
+	return requireTenantAdmin(func(w http.ResponseWriter, r *http.Request, tenant string) {
+		next(w, r, webhookOwner{name: "tenant:" + tenant, tenant: tenant})
+	})
+}
+
+func handleTenantClients(w http.ResponseWriter, _ *http.Request, tenant string) {
+	clientsMu.Lock()
+	views := []ClientInfo{}
+	for c := range clients {
+		if c.tenant == tenant {
+			views = append(views, c.view())
+		}
+	}
+	clientsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, views)
+}
+
+// handleTenantKick disconnects the tenant's clients whose client ID or remote
+// address is {client}.
+func handleTenantKick(w http.ResponseWriter, r *http.Request, tenant string) {
+	target := r.PathValue("client")
+	clientsMu.Lock()
+	kicked := 0
+	for c := range clients {
+		if c.tenant == tenant && (c.id == target || c.remoteAddr == target) {
+			closeClient(c, reasonKicked, "disconnected by tenant admin")
+			delete(clients, c)
+			kicked++
+		}
+	}
+	clientsMu.Unlock()
+
+	if kicked == 0 {
+		writeError(w, http.StatusNotFound, "client not found")
+		return
+	}
+	log.WithFields(logrus.Fields{
+		"event":   "admin_kick",
+		"status":  "kicked",
+		"tenant":  tenant,
+		"client":  target,
+		"clients": kicked,
+	}).Info("Tenant admin disconnected clients")
+	writeJSON(w, http.StatusOK, map[string]int{"kicked": kicked})
+}
+
+func handleTenantUsage(w http.ResponseWriter, _ *http.Request, tenant string) {
+	clientsMu.Lock()
+	view := tenantUsageView{
+		Tenant: tenant,
+		Window: conf().GetDuration("quotas.window").String(),
+	}
+	if u, ok := tenantBytes[tenant]; ok {
+		view.Bytes = u.bytesSent
+	}
+	for c := range clients {
+		if c.tenant != tenant {
+			continue
+		}
+		view.Clients++
+		view.Delivered += c.stats.messagesSent
+		view.Drops += c.stats.drops
+	}
+	clientsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
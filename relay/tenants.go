@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const (
+	tenantSourceHeader    = "header"
+	tenantSourceSubdomain = "subdomain"
+	tenantSourcePath      = "path"
+)
+
+// resolveTenant maps an upgrade request to a tenant using tenants.source.
+// It returns false when tenancy is enabled and no allowed tenant is found.
+func resolveTenant(r *http.Request) (string, bool) {
+	if !conf().GetBool("tenants.enabled") {
+		return "", true
+	}
+
+	var tenant string
+	switch conf().GetString("tenants.source") {
+	case tenantSourceHeader:
+		tenant = r.Header.Get(conf().GetString("tenants.header"))
+	case tenantSourceSubdomain:
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if label, _, found := strings.Cut(host, "."); found {
+			tenant = label
+		}
+	case tenantSourcePath:
+		tenant = r.PathValue("tenant")
+	}
+
+	if tenant == "" {
+		return "", false
+	}
+	if allowed := conf().GetStringSlice("tenants.allowed"); len(allowed) > 0 && !slices.Contains(allowed, tenant) {
+		return "", false
+	}
+	return tenant, true
+}
+
+// tenantAllows reports whether topic lies in tenant's namespace ("<tenant>.#").
+func tenantAllows(tenant, topic string) bool {
+	if tenant == "" || !conf().GetBool("tenants.namespace") {
+		return true
+	}
+	return strings.HasPrefix(topic, tenant+".")
+}
+
+func registerTenantRoutes() {
+	if conf().GetBool("tenants.enabled") && conf().GetString("tenants.source") == tenantSourcePath {
+		handle(endpointsWS, "/{tenant}/ws", handleWebSocket)
+		handle(endpointsWS, "GET /{tenant}/events", handleSSE)
+	}
+}
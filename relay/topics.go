@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// topicMatches reports whether topic matches pattern using RabbitMQ topic
+// exchange semantics: "*" matches exactly one word, "#" matches zero or more.
+func topicMatches(pattern, topic string) bool {
+	return matchWords(strings.Split(pattern, "."), strings.Split(topic, "."))
+}
+
+// matchWords matches word by word in time proportional to the product of the
+// word counts, however many "#" the pattern has, by tracking after each
+// pattern word which prefixes of topic it can have matched.
+func matchWords(pattern, topic []string) bool {
+	// matched[j] reports whether the pattern words so far match topic[:j].
+	matched := make([]bool, len(topic)+1)
+	next := make([]bool, len(topic)+1)
+	matched[0] = true
+	for _, word := range pattern {
+		next[0] = word == "#" && matched[0]
+		for j := 1; j <= len(topic); j++ {
+			switch word {
+			case "#":
+				next[j] = next[j-1] || matched[j]
+			case "*":
+				next[j] = matched[j-1]
+			default:
+				next[j] = matched[j-1] && topic[j-1] == word
+			}
+		}
+		matched, next = next, matched
+	}
+	return matched[len(topic)]
+}
+
+func matchesAny(patterns []string, topic string) bool {
+	for _, pattern := range patterns {
+		if topicMatches(pattern, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPriorityTopic reports whether topic is configured as high-priority and
+// must be delivered ahead of queued lower-priority traffic.
+func isPriorityTopic(topic string) bool {
+	return matchesAny(conf().GetStringSlice("topics.priority"), topic)
+}
+
+// inferTopic returns msg's routing key, or when it is empty the string value
+// of topics.infer.field in a JSON payload. Payloads that aren't JSON objects
+// or lack the field get topics.infer.fallback. The field may be dotted and
+// written with a leading "$.", as in "$.meta.channel".
+func inferTopic(msg amqp.Delivery) string {
+	field := strings.TrimPrefix(conf().GetString("topics.infer.field"), "$.")
+	if msg.RoutingKey != "" || field == "" {
+		return msg.RoutingKey
+	}
+	dec := json.NewDecoder(bytes.NewReader(msg.Body))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err == nil {
+		if topic, ok := lookupField(doc, field); ok && topic != "" {
+			return topic
+		}
+	}
+	return conf().GetString("topics.infer.fallback")
+}
@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTopicMatches(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"a.b.c", "a.b.c", true},
+		{"a.b.c", "a.b", false},
+		{"a.b", "a.b.c", false},
+		{"a.*.c", "a.b.c", true},
+		{"a.*.c", "a.c", false},
+		{"a.*", "a.b.c", false},
+		{"*", "a", true},
+		{"*", "a.b", false},
+		{"#", "", true},
+		{"#", "a.b.c", true},
+		{"a.#", "a", true},
+		{"a.#", "a.b.c", true},
+		{"a.#", "b.a", false},
+		{"#.c", "a.b.c", true},
+		{"#.c", "c", true},
+		{"#.c", "a.b", false},
+		{"a.#.c", "a.c", true},
+		{"a.#.c", "a.b.b.c", true},
+		{"a.#.c", "a.b.c.d", false},
+		{"#.b.#", "a.b.c", true},
+		{"#.b.#", "a.c", false},
+		{"*.#.*", "a", false},
+		{"*.#.*", "a.b", true},
+		{"#.#", "a.b", true},
+	}
+	for _, tt := range tests {
+		if got := topicMatches(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("topicMatches(%q, %q) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesAny(t *testing.T) {
+	patterns := []string{"weather.*", "billing.#"}
+	for topic, want := range map[string]bool{
+		"weather.today":   true,
+		"weather.today.x": false,
+		"billing":         true,
+		"billing.a.b":     true,
+		"orders.new":      false,
+	} {
+		if got := matchesAny(patterns, topic); got != want {
+			t.Errorf("matchesAny(%q, %q) = %v, want %v", patterns, topic, got, want)
+		}
+	}
+}
+
+func TestTopicMatchesManyHashes(t *testing.T) {
+	pattern := strings.Repeat("#.", 30) + "z"
+	topic := strings.Repeat("a.", 60) + "b"
+	done := make(chan bool)
+	go func() { done <- topicMatches(pattern, topic) }()
+	select {
+	case matched := <-done:
+		if matched {
+			t.Error("pattern ending in z matched a topic ending in b")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("matching a pattern with many \"#\" took over a second")
+	}
+}
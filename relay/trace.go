@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// traceHeader carries the hops recorded by upstream relays.
+const traceHeader = "x-relay-trace"
+
+// traceHop is one relay's entry in an envelope's _trace.
+type traceHop struct {
+	Instance    string    `json:"instance"`
+	ReceivedAt  time.Time `json:"received_at"`
+	BroadcastAt time.Time `json:"broadcast_at"`
+	Transforms  []string  `json:"transforms,omitempty"`
+}
+
+// inbound is a delivery together with the source it came from and the time
+// this relay received it, so the hop measures time queued in a lane as well.
+// ack settles it with RabbitMQ when manual acknowledgements are on.
+type inbound struct {
+	msg        amqp.Delivery
+	source     string
+	receivedAt time.Time
+	ack        *deliveryAck
+}
+
+var (
+	instanceID     string
+	instanceIDOnce sync.Once
+)
+
+// relayInstanceID returns envelope.instance_id, defaulting to the hostname.
+func relayInstanceID() string {
+	instanceIDOnce.Do(func() {
+		instanceID = conf().GetString("envelope.instance_id")
+		if instanceID == "" {
+			instanceID, _ = os.Hostname()
+		}
+	})
+	return instanceID
+}
+
+// lineage returns the upstream hops from the trace header followed by this
+// relay's hop, or nil when tracing is off.
+func lineage(in inbound, transforms []string) []traceHop {
+	if !conf().GetBool("envelope.trace") {
+		return nil
+	}
+
+	var hops []traceHop
+	switch v := in.msg.Headers[traceHeader].(type) {
+	case string:
+		_ = json.Unmarshal([]byte(v), &hops)
+	case []byte:
+		_ = json.Unmarshal(v, &hops)
+	}
+	return append(hops, traceHop{
+		Instance:    relayInstanceID(),
+		ReceivedAt:  in.receivedAt.UTC(),
+		BroadcastAt: time.Now().UTC(),
+		Transforms:  transforms,
+	})
+}
@@ -0,0 +1,177 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+const tracerName = "github.com/reaport/event-relay/relay"
+
+var (
+	// tracer is a no-op unless tracing.enabled. The relay keeps its own
+	// provider rather than the global one, which belongs to an embedding
+	// program.
+	tracer         oteltrace.Tracer = noop.NewTracerProvider().Tracer(tracerName)
+	tracerProvider *sdktrace.TracerProvider
+
+	// tracePropagator reads W3C traceparent and tracestate headers.
+	tracePropagator = propagation.TraceContext{}
+)
+
+// initTracing sets up span export over OTLP/gRPC to tracing.endpoint, or to
+// the OTEL_EXPORTER_OTLP_* endpoint when that is empty. The exporter connects
+// in the background, so an unreachable collector only loses spans.
+func initTracing() {
+	if !conf().GetBool("tracing.enabled") {
+		return
+	}
+	var opts []otlptracegrpc.Option
+	if endpoint := conf().GetString("tracing.endpoint"); endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+	}
+	if conf().GetBool("tracing.insecure") {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(context.Background(), opts...)
+	var res *resource.Resource
+	if err == nil {
+		res, err = resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(conf().GetString("tracing.service_name")),
+			semconv.ServiceInstanceID(relayInstanceID()),
+		))
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "tracing_config",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Fatal("Failed to set up tracing")
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf().GetFloat64("tracing.sample_ratio")))),
+	)
+	tracer = tracerProvider.Tracer(tracerName)
+	log.WithFields(logrus.Fields{
+		"event":    "tracing_config",
+		"status":   "enabled",
+		"endpoint": conf().GetString("tracing.endpoint"),
+	}).Info("Exporting traces over OTLP")
+}
+
+// shutdownTracing flushes the spans still batched.
+func shutdownTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "tracing",
+			"status": "flush_failed",
+			"error":  err.Error(),
+		}).Warn("Failed to flush traces")
+	}
+}
+
+// headerCarrier reads and writes trace context in AMQP headers.
+type headerCarrier amqp.Table
+
+func (h headerCarrier) Get(key string) string {
+	switch v := h[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h[key] = value
+}
+
+func (h headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// startDeliverySpan starts the span of relaying in, continuing the trace in
+// its headers if there is one. It begins when in was received, so time
+// waiting in a bulkhead lane is part of it.
+func startDeliverySpan(in inbound) (context.Context, oteltrace.Span) {
+	ctx := tracePropagator.Extract(context.Background(), headerCarrier(in.msg.Headers))
+	return tracer.Start(ctx, "relay.deliver",
+		oteltrace.WithSpanKind(oteltrace.SpanKindConsumer),
+		oteltrace.WithTimestamp(in.receivedAt),
+		oteltrace.WithAttributes(
+			semconv.MessagingDestinationName(in.msg.RoutingKey),
+			semconv.MessagingMessageID(in.msg.MessageId),
+			semconv.MessagingMessageBodySize(len(in.msg.Body)),
+			attribute.String("relay.source", in.source),
+		))
+}
+
+// skipSpan marks a delivery span whose message the relay chose not to
+// broadcast, or failed to prepare when err is set.
+func skipSpan(span oteltrace.Span, reason string, err error) {
+	span.SetAttributes(attribute.String("relay.skipped", reason))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, reason)
+	}
+}
+
+// startBroadcastSpan starts the span of fanning a message out to clients.
+func startBroadcastSpan(ctx context.Context, topic string) (context.Context, oteltrace.Span) {
+	return tracer.Start(ctx, "relay.broadcast", oteltrace.WithAttributes(semconv.MessagingDestinationName(topic)))
+}
+
+func endBroadcastSpan(span oteltrace.Span, matched, queued int) {
+	span.SetAttributes(attribute.Int("relay.clients.matched", matched), attribute.Int("relay.clients.queued", queued))
+	span.End()
+}
+
+// startWriteSpan starts the span of writing f to c, a child of the broadcast
+// that queued it. Frames queued outside a traced broadcast, and every frame
+// without tracing.client_spans, get a no-op span: with many clients a span
+// per write can outnumber everything else.
+func startWriteSpan(c *client, f queuedFrame) oteltrace.Span {
+	if !f.span.IsValid() || !conf().GetBool("tracing.client_spans") {
+		return oteltrace.SpanFromContext(context.Background())
+	}
+	ctx := oteltrace.ContextWithSpanContext(context.Background(), f.span)
+	_, span := tracer.Start(ctx, "relay.write",
+		oteltrace.WithSpanKind(oteltrace.SpanKindProducer),
+		oteltrace.WithAttributes(
+			semconv.MessagingDestinationName(f.topic),
+			attribute.String("relay.client.id", c.id),
+			attribute.String("relay.client.transport", c.transport()),
+		))
+	return span
+}
+
+func endWriteSpan(span oteltrace.Span, sent int, err error) {
+	span.SetAttributes(attribute.Int("relay.write.bytes", sent))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, fmt.Sprintf("write failed: %v", err))
+	}
+	span.End()
+}
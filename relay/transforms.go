@@ -0,0 +1,197 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// transformConfig is one step of the transforms chain. Within a step, fields
+// are dropped, then renamed, then set, and the result is finally reshaped by
+// Template. Paths are dotted, as for enrichment lookups. Rename and Set are
+// lists rather than maps because config keys lose their case.
+type transformConfig struct {
+	Name     string            `mapstructure:"name"`
+	Topics   []string          `mapstructure:"topics"`
+	Drop     []string          `mapstructure:"drop"`
+	Rename   []transformRename `mapstructure:"rename"`
+	Set      []transformSet    `mapstructure:"set"`
+	Template string            `mapstructure:"template"`
+}
+
+type transformRename struct {
+	From string `mapstructure:"from"`
+	To   string `mapstructure:"to"`
+}
+
+type transformSet struct {
+	Field string `mapstructure:"field"`
+	Value string `mapstructure:"value"`
+}
+
+// transformStep is a transformConfig with its templates parsed, set values
+// in the order of Set. Those values are templates too, so metadata can carry
+// the topic or source.
+type transformStep struct {
+	transformConfig
+	set      []*template.Template
+	template *template.Template
+}
+
+// transformData is what set values and templates are executed against.
+type transformData struct {
+	Topic   string
+	Source  string
+	Payload map[string]any
+}
+
+var transformFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+}
+
+func readTransforms(cfg *viper.Viper) ([]transformStep, error) {
+	var configs []transformConfig
+	if err := unmarshalConfigFrom(cfg, "transforms", &configs); err != nil {
+		return nil, err
+	}
+	steps := make([]transformStep, 0, len(configs))
+	for _, c := range configs {
+		step, err := newTransformStep(c)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+func newTransformStep(cfg transformConfig) (transformStep, error) {
+	step := transformStep{transformConfig: cfg}
+	if cfg.Name == "" {
+		return step, fmt.Errorf("transform without a name")
+	}
+	for _, set := range cfg.Set {
+		t, err := template.New(cfg.Name + ":" + set.Field).Funcs(transformFuncs).Parse(set.Value)
+		if err != nil {
+			return step, fmt.Errorf("transform %q: set %s: %w", cfg.Name, set.Field, err)
+		}
+		step.set = append(step.set, t)
+	}
+	if cfg.Template != "" {
+		t, err := template.New(cfg.Name).Funcs(transformFuncs).Option("missingkey=zero").Parse(cfg.Template)
+		if err != nil {
+			return step, fmt.Errorf("transform %q: template: %w", cfg.Name, err)
+		}
+		step.template = t
+	}
+	return step, nil
+}
+
+// transformPayload runs a transforms chain over a JSON object payload and
+// returns the names of the steps that applied. Payloads that aren't JSON
+// objects pass through. When a step fails, for example a template that
+// doesn't produce a JSON object, the message must be dropped rather than
+// relayed untransformed.
+func transformPayload(steps []transformStep, source, topic string, body []byte) ([]byte, []string, error) {
+	if len(steps) == 0 {
+		return body, nil, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return body, nil, nil
+	}
+
+	var applied []string
+	for _, step := range steps {
+		if len(step.Topics) > 0 && !matchesAny(step.Topics, topic) {
+			continue
+		}
+		var err error
+		if doc, err = step.apply(transformData{Topic: topic, Source: source, Payload: doc}); err != nil {
+			return body, applied, fmt.Errorf("transform %q: %w", step.Name, err)
+		}
+		applied = append(applied, step.Name)
+	}
+	if applied == nil {
+		return body, nil, nil
+	}
+
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return body, applied, err
+	}
+	return out, applied, nil
+}
+
+func (s transformStep) apply(data transformData) (map[string]any, error) {
+	doc := data.Payload
+	for _, path := range s.Drop {
+		deleteField(doc, path)
+	}
+	for _, r := range s.Rename {
+		if v, ok := deleteField(doc, r.From); ok {
+			setField(doc, r.To, v)
+		}
+	}
+	for i, t := range s.set {
+		var value strings.Builder
+		if err := t.Execute(&value, data); err != nil {
+			return nil, err
+		}
+		setField(doc, s.Set[i].Field, value.String())
+	}
+	if s.template == nil {
+		return doc, nil
+	}
+
+	var out bytes.Buffer
+	if err := s.template.Execute(&out, data); err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(&out)
+	dec.UseNumber()
+	var reshaped map[string]any
+	if err := dec.Decode(&reshaped); err != nil {
+		return nil, fmt.Errorf("template output is not a JSON object: %w", err)
+	}
+	return reshaped, nil
+}
+
+// deleteField removes the value at a dotted path and returns it.
+func deleteField(doc map[string]any, path string) (any, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		doc = next
+	}
+	last := parts[len(parts)-1]
+	v, ok := doc[last]
+	delete(doc, last)
+	return v, ok
+}
+
+// setField stores v at a dotted path, creating or replacing objects on the way.
+func setField(doc map[string]any, path string, v any) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		next, ok := doc[part].(map[string]any)
+		if !ok {
+			next = make(map[string]any)
+			doc[part] = next
+		}
+		doc = next
+	}
+	doc[parts[len(parts)-1]] = v
+}
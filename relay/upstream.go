@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// runUpstreamSource relays envelopes received from another relay instance in
+// place of RabbitMQ, so an edge relay can fan out from a central one. The
+// upstream must have envelope.enabled so each frame carries its topic, and
+// with replay.enabled a reconnect resumes after the last envelope received.
+// It returns when ctx is done.
+func runUpstreamSource(ctx context.Context) {
+	if !awaitActive(ctx) {
+		return
+	}
+	target := conf().GetString("upstream.url")
+	policy := loadRetryPolicy("upstream.reconnect")
+	ExpectSource("upstream")
+
+	var cursor string
+	for ctx.Err() == nil {
+		var conn *websocket.Conn
+		err := retry(ctx, "upstream", policy, func() error {
+			var err error
+			conn, err = dialUpstream(target, cursor)
+			return err
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "upstream_connection",
+				"status": "failed",
+				"url":    target,
+				"error":  err.Error(),
+			}).Fatal("Giving up connecting to upstream relay")
+		}
+
+		MarkSourceReady("upstream")
+		stopRead := context.AfterFunc(ctx, func() { conn.Close() })
+		err = readUpstream(conn, &cursor)
+		stopRead()
+		conn.Close()
+		MarkSourceDown("upstream", "connection lost")
+		if ctx.Err() != nil {
+			return
+		}
+		log.WithFields(logrus.Fields{
+			"event":  "upstream_connection",
+			"status": "lost",
+			"url":    target,
+			"error":  err.Error(),
+		}).Warn("Upstream relay connection lost, reconnecting")
+	}
+}
+
+// dialUpstream connects with upstream.headers (for example an API key) and
+// this instance's ID as client_id, so the upstream's duplicate policy applies.
+// A non-empty since asks the upstream to replay what followed that event.
+func dialUpstream(target, since string) (*websocket.Conn, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, permanent(err)
+	}
+	q := u.Query()
+	if q.Get("client_id") == "" {
+		q.Set("client_id", relayInstanceID())
+	}
+	if since != "" {
+		q.Set("since", since)
+	}
+	u.RawQuery = q.Encode()
+
+	header := http.Header{}
+	for name, value := range conf().GetStringMapString("upstream.headers") {
+		header.Set(name, value)
+	}
+
+	conn, resp, err := websocket.DefaultDialer.Dial(u.String(), header)
+	if resp != nil && resp.Body != nil {
+		resp.Body.Close()
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "upstream_connection",
+			"status": "failed",
+			"url":    target,
+			"error":  err.Error(),
+		}).Error("Failed to connect to upstream relay")
+		return nil, err
+	}
+
+	log.WithFields(logrus.Fields{
+		"event":  "upstream_connection",
+		"status": "connected",
+		"url":    target,
+		"since":  since,
+	}).Info("Connected to upstream relay")
+	return conn, nil
+}
+
+// readUpstream dispatches every envelope read from conn until it fails,
+// keeping the ID of the last one in cursor.
+func readUpstream(conn *websocket.Conn, cursor *string) error {
+	for {
+		kind, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if kind != websocket.TextMessage {
+			continue
+		}
+		source, msg, id, err := upstreamDelivery(data)
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"event":  "upstream_message",
+				"status": "invalid",
+				"error":  err.Error(),
+			}).Warn("Skipping upstream frame that isn't an envelope")
+			continue
+		}
+		awaitCapacity()
+		dispatchDelivery(source, msg)
+		if id != "" {
+			*cursor = id
+		}
+	}
+}
+
+// upstreamDelivery turns an upstream envelope back into a delivery, carrying
+// its hops in the trace header so this relay appends to the lineage. The
+// upstream's source tag is kept, defaulting to "upstream", and its event ID
+// is returned as the resume cursor.
+func upstreamDelivery(data []byte) (string, amqp.Delivery, string, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return "", amqp.Delivery{}, "", err
+	}
+	if env.Topic == "" {
+		return "", amqp.Delivery{}, "", errors.New("envelope has no topic")
+	}
+	payload, err := decompressPayload(env.Payload, env.PayloadEncoding)
+	if err != nil {
+		return "", amqp.Delivery{}, "", err
+	}
+
+	msg := amqp.Delivery{
+		RoutingKey:  env.Topic,
+		ContentType: "application/json",
+		Body:        payload,
+		Headers:     amqp.Table{},
+	}
+	source := "upstream"
+	if md := env.Metadata; md != nil {
+		if md.Source != "" {
+			source = md.Source
+		}
+		msg.MessageId = md.MessageID
+		msg.AppId = md.AppID
+		msg.CorrelationId = md.CorrelationID
+		if md.Timestamp != nil {
+			msg.Timestamp = *md.Timestamp
+		}
+		for name, value := range md.Headers {
+			msg.Headers[name] = value
+		}
+	}
+	if len(env.Trace) > 0 {
+		if trace, err := json.Marshal(env.Trace); err == nil {
+			msg.Headers[traceHeader] = string(trace)
+		}
+	}
+	return source, msg, env.ID, nil
+}
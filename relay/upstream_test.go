@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestUpstreamResumesAfterLastEnvelope(t *testing.T) {
+	usePipeline(&pipeline{})
+	sinces := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sinces <- r.URL.Query().Get("since")
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		for _, frame := range []string{
+			`{"id":"e-1","topic":"a.b","payload":{}}`,
+			`{"topic":"a.b","payload":{}}`,
+			`{"id":"e-2","topic":"a.b","payload":{}}`,
+			`not an envelope`,
+		} {
+			_ = conn.WriteMessage(websocket.TextMessage, []byte(frame))
+		}
+	}))
+	defer srv.Close()
+	target := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	var cursor string
+	for _, want := range []string{"", "e-2"} {
+		conn, err := dialUpstream(target, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = readUpstream(conn, &cursor)
+		conn.Close()
+		if got := <-sinces; got != want {
+			t.Errorf("connected with since=%q, want %q", got, want)
+		}
+		if cursor != "e-2" {
+			t.Errorf("cursor = %q after reading, want e-2", cursor)
+		}
+	}
+}
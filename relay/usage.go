@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+type clientUsage struct {
+	bytesSent   int64
+	windowStart time.Time
+	windowBytes int64
+	warned      bool
+}
+
+type clientUsageView struct {
+	Client      string    `json:"client"`
+	Tenant      string    `json:"tenant,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	BytesSent   int64     `json:"bytes_sent"`
+	WindowBytes int64     `json:"window_bytes"`
+}
+
+type usageView struct {
+	Window  string            `json:"window"`
+	Clients []clientUsageView `json:"clients"`
+	Topics  map[string]int64  `json:"topics"`
+	Tenants map[string]int64  `json:"tenants,omitempty"`
+}
+
+// Quotas a client can go over, naming which limit disconnected it.
+const (
+	quotaClient = "client"
+	quotaTenant = "tenant"
+)
+
+// topicBytes and tenantBytes are guarded by clientsMu. topicBytes keys topics
+// as metricTopic labels them, so topics past metrics.max_topics add up under
+// _overflow. tenantBytes sums the usage of each tenant's clients for at most
+// quotas.max_tenants tenants; the traffic of the rest adds up under _overflow,
+// which tenant quotas don't apply to.
+var (
+	topicBytes  = make(map[string]int64)
+	tenantBytes = make(map[string]*clientUsage)
+)
+
+// recordEgress accounts n bytes sent to c on topic and returns the quota, if
+// any, that c or its tenant went over the hard limit of. Must be called with
+// clientsMu held.
+func recordEgress(c *client, topic string, n int) string {
+	now := time.Now()
+	window := conf().GetDuration("quotas.window")
+	c.usage.bytesSent += int64(n)
+	topicBytes[metricTopic(topic)] += int64(n)
+	over := ""
+	if c.tenant != "" {
+		t, tracked := tenantEgress(c.tenant)
+		t.bytesSent += int64(n)
+		if tracked {
+			hard := conf().GetInt64("quotas.tenant_hard_bytes")
+			if addEgress(t, now, window, n) > hard && hard > 0 {
+				over = quotaTenant
+			} else {
+				warnOverSoftQuota(t, quotaTenant, c.tenant, conf().GetInt64("quotas.tenant_soft_bytes"))
+			}
+		}
+	}
+
+	if hard := conf().GetInt64("quotas.client_hard_bytes"); addEgress(&c.usage, now, window, n) > hard && hard > 0 {
+		return quotaClient
+	}
+	warnOverSoftQuota(&c.usage, quotaClient, c.remoteAddr, conf().GetInt64("quotas.client_soft_bytes"))
+	return over
+}
+
+// tenantEgress returns tenant's usage, or the usage shared by tenants past
+// quotas.max_tenants and false. Must be called with clientsMu held.
+func tenantEgress(tenant string) (*clientUsage, bool) {
+	if t, ok := tenantBytes[tenant]; ok {
+		return t, tenant != overflowTopicLabel
+	}
+	if len(tenantBytes) >= conf().GetInt("quotas.max_tenants") {
+		tenant = overflowTopicLabel
+		if t, ok := tenantBytes[tenant]; ok {
+			return t, false
+		}
+	}
+	t := &clientUsage{}
+	tenantBytes[tenant] = t
+	return t, tenant != overflowTopicLabel
+}
+
+// addEgress adds n bytes to u's current quota window, starting a new one once
+// window passed, and returns the bytes in the window.
+func addEgress(u *clientUsage, now time.Time, window time.Duration, n int) int64 {
+	if now.Sub(u.windowStart) >= window {
+		u.windowStart = now
+		u.windowBytes = 0
+		u.warned = false
+	}
+	u.windowBytes += int64(n)
+	return u.windowBytes
+}
+
+// warnOverSoftQuota logs once per window that who went over its soft limit.
+func warnOverSoftQuota(u *clientUsage, quota, who string, soft int64) {
+	if soft <= 0 || u.windowBytes <= soft || u.warned {
+		return
+	}
+	u.warned = true
+	log.WithFields(logrus.Fields{
+		"event":        "egress_quota",
+		"status":       "soft_limit",
+		quota:          who,
+		"window_bytes": u.windowBytes,
+		"limit":        soft,
+	}).Warn("Exceeded soft egress quota")
+}
+
+// disconnectOverQuota disconnects c for going over the hard limit of quota.
+// Must be called with clientsMu held.
+func disconnectOverQuota(c *client, quota string) {
+	fields := logrus.Fields{
+		"event":        "egress_quota",
+		"status":       "hard_limit",
+		"quota":        quota,
+		"client":       c.remoteAddr,
+		"window_bytes": c.usage.windowBytes,
+		"limit":        conf().GetInt64("quotas.client_hard_bytes"),
+	}
+	if quota == quotaTenant {
+		fields["tenant"] = c.tenant
+		fields["window_bytes"] = tenantBytes[c.tenant].windowBytes
+		fields["limit"] = conf().GetInt64("quotas.tenant_hard_bytes")
+	}
+	log.WithFields(fields).Warn("Exceeded hard egress quota, disconnecting")
+
+	closeClient(c, reasonPolicyViolation, quota+" egress quota exceeded")
+}
+
+func handleUsage(w http.ResponseWriter, _ *http.Request) {
+	clientsMu.Lock()
+	view := usageView{
+		Window:  conf().GetDuration("quotas.window").String(),
+		Clients: make([]clientUsageView, 0, len(clients)),
+		Topics:  make(map[string]int64, len(topicBytes)),
+		Tenants: make(map[string]int64, len(tenantBytes)),
+	}
+	for c := range clients {
+		view.Clients = append(view.Clients, clientUsageView{
+			Client:      c.remoteAddr,
+			Tenant:      c.tenant,
+			ConnectedAt: c.connectedAt,
+			BytesSent:   c.usage.bytesSent,
+			WindowBytes: c.usage.windowBytes,
+		})
+	}
+	for topic, n := range topicBytes {
+		view.Topics[topic] = n
+	}
+	for tenant, u := range tenantBytes {
+		view.Tenants[tenant] = u.bytesSent
+	}
+	clientsMu.Unlock()
+
+	writeJSON(w, http.StatusOK, view)
+}
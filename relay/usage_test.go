@@ -0,0 +1,78 @@
+package relay
+
+import "testing"
+
+// useEgressCounters gives the test empty topic, tenant and metric topic counts.
+func useEgressCounters(t *testing.T) {
+	t.Helper()
+	clientsMu.Lock()
+	previousTopics, previousTenants := topicBytes, tenantBytes
+	topicBytes, tenantBytes = make(map[string]int64), make(map[string]*clientUsage)
+	clientsMu.Unlock()
+	metricTopicsMu.Lock()
+	previousLabels := metricTopics
+	metricTopics = make(map[string]struct{})
+	metricTopicsMu.Unlock()
+	t.Cleanup(func() {
+		clientsMu.Lock()
+		topicBytes, tenantBytes = previousTopics, previousTenants
+		clientsMu.Unlock()
+		metricTopicsMu.Lock()
+		metricTopics = previousLabels
+		metricTopicsMu.Unlock()
+	})
+}
+
+func TestRecordEgressCapsTopicsAndTenants(t *testing.T) {
+	useConfig(t, `metrics:
+  max_topics: 1
+quotas:
+  window: 1m
+  max_tenants: 1
+  tenant_hard_bytes: 10
+`)
+	useEgressCounters(t)
+	acme, globex := &client{tenant: "acme"}, &client{tenant: "globex"}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	recordEgress(acme, "a.b", 4)
+	recordEgress(acme, "c.d", 4)
+	for range 3 {
+		if quota := recordEgress(globex, "a.b", 10); quota != "" {
+			t.Fatalf("tenant past quotas.max_tenants went over the %s quota", quota)
+		}
+	}
+
+	if len(topicBytes) != 2 || topicBytes["a.b"] != 34 || topicBytes[overflowTopicLabel] != 4 {
+		t.Errorf("topic bytes = %v, want a.b and %s", topicBytes, overflowTopicLabel)
+	}
+	if len(tenantBytes) != 2 || tenantBytes["acme"].bytesSent != 8 || tenantBytes[overflowTopicLabel].bytesSent != 30 {
+		t.Errorf("tenant bytes tracked %d tenants, want acme and %s", len(tenantBytes), overflowTopicLabel)
+	}
+}
+
+func TestRecordEgressTenantQuota(t *testing.T) {
+	useConfig(t, `metrics:
+  max_topics: 10
+quotas:
+  window: 1m
+  max_tenants: 10
+  client_hard_bytes: 100
+  tenant_hard_bytes: 10
+`)
+	useEgressCounters(t)
+	first, second := &client{tenant: "acme"}, &client{tenant: "acme"}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if quota := recordEgress(first, "a.b", 6); quota != "" {
+		t.Fatalf("first client went over the %s quota", quota)
+	}
+	if quota := recordEgress(second, "a.b", 6); quota != quotaTenant {
+		t.Errorf("recordEgress past tenant_hard_bytes = %q, want %q", quota, quotaTenant)
+	}
+	if quota := recordEgress(first, "a.b", 95); quota != quotaClient {
+		t.Errorf("recordEgress past client_hard_bytes = %q, want %q", quota, quotaClient)
+	}
+}
@@ -0,0 +1,79 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var errWebhookRedirect = errors.New("webhook redirects are not followed")
+
+// newWebhookClient returns the client for webhook deliveries. Partners pick
+// the URLs, so it connects only to public addresses, checked on the address
+// actually dialed so a DNS answer changed after validation can't point it
+// inward, and it doesn't follow redirects, which could do the same. It
+// doesn't use a proxy, whose address is all the dial check would see.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return checkWebhookAddr(addr.Addr())
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return errWebhookRedirect
+		},
+	}
+}
+
+// checkWebhookAddr rejects loopback, private, link-local (including the cloud
+// metadata address 169.254.169.254), unspecified and multicast addresses,
+// unless webhooks.allow_private_networks.
+func checkWebhookAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	if conf().GetBool("webhooks.allow_private_networks") {
+		return nil
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return fmt.Errorf("webhook address %s is not public", addr)
+	}
+	return nil
+}
+
+func validateWebhookURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return errors.New("invalid webhook url")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("webhook url must use http or https")
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("webhook host %q does not resolve", u.Hostname())
+	}
+	for _, addr := range addrs {
+		if err := checkWebhookAddr(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestCheckWebhookAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		err := checkWebhookAddr(netip.MustParseAddr(tt.addr))
+		if (err == nil) != tt.public {
+			t.Errorf("checkWebhookAddr(%s) = %v, want public %v", tt.addr, err, tt.public)
+		}
+	}
+}
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"https://93.184.216.34/hook", true},
+		{"ftp://93.184.216.34/hook", false},
+		{"not a url", false},
+		{"http://localhost:8080/hook", false},
+		{"http://127.0.0.1/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://[::1]/hook", false},
+	}
+	for _, tt := range tests {
+		err := validateWebhookURL(context.Background(), tt.url)
+		if (err == nil) != tt.ok {
+			t.Errorf("validateWebhookURL(%q) = %v, want ok %v", tt.url, err, tt.ok)
+		}
+	}
+}
+
+func TestWebhookClientRefusesPrivateDial(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, http.NoBody)
+	resp, err := newWebhookClient().Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("delivered to a loopback address")
+	}
+}
+
+func TestWebhookClientRefusesRedirects(t *testing.T) {
+	conf().Set("webhooks.allow_private_networks", true)
+	defer conf().Set("webhooks.allow_private_networks", false)
+
+	target := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		t.Error("redirect was followed")
+	}))
+	defer target.Close()
+	srv := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusFound))
+	defer srv.Close()
+
+	req, _ := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL, http.NoBody)
+	resp, err := newWebhookClient().Do(req)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if !errors.Is(err, errWebhookRedirect) {
+		t.Fatalf("Do() = %v, want %v", err, errWebhookRedirect)
+	}
+}
@@ -0,0 +1,455 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	apiKeyHeader        = "X-API-Key"
+	maxSubscriptionBody = 64 << 10
+)
+
+type partnerAPIKey struct {
+	Key     string `mapstructure:"key"`
+	Partner string `mapstructure:"partner"`
+}
+
+type webhookStats struct {
+	Delivered      int64      `json:"delivered"`
+	Failed         int64      `json:"failed"`
+	Dropped        int64      `json:"dropped"`
+	ShortCircuited int64      `json:"short_circuited"`
+	LastStatus     int        `json:"last_status,omitempty"`
+	LastError      string     `json:"last_error,omitempty"`
+	LastDeliveryAt *time.Time `json:"last_delivery_at,omitempty"`
+}
+
+type webhookSubscriptionView struct {
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	Topics    []string     `json:"topics"`
+	CreatedAt time.Time    `json:"created_at"`
+	Circuit   string       `json:"circuit"`
+	Stats     webhookStats `json:"stats"`
+}
+
+type webhookSubscription struct {
+	ID        string
+	URL       string
+	Topics    []string
+	CreatedAt time.Time
+	Stats     webhookStats
+
+	partner  string
+	secret   string
+	queue    chan webhookDelivery
+	priority chan webhookDelivery
+	breaker  *circuitBreaker
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+}
+
+type webhookDelivery struct {
+	id     string
+	source string
+	topic  string
+	body   []byte
+}
+
+type createSubscriptionRequest struct {
+	URL    string   `json:"url"`
+	Topics []string `json:"topics"`
+	Secret string   `json:"secret"`
+}
+
+var (
+	webhookSubs   = make(map[string]*webhookSubscription)
+	webhookSubsMu sync.RWMutex
+	partnerKeys   []partnerAPIKey
+	webhookClient = newWebhookClient()
+	webhookRetry  *retryPolicy
+
+	errCircuitOpen = errors.New("webhook circuit is open")
+)
+
+func registerWebhookRoutes() {
+	if err := conf().UnmarshalKey("webhooks.api_keys", &partnerKeys); err != nil {
+		log.WithFields(logrus.Fields{
+			"event":  "webhooks_config",
+			"status": "failed",
+			"error":  err.Error(),
+		}).Fatal("Failed to read webhook API keys")
+	}
+	webhookClient.Timeout = conf().GetDuration("webhooks.timeout")
+	webhookRetry = loadRetryPolicy("webhooks.retry")
+
+	handle(endpointsAPI, "POST /api/subscriptions", requirePartner(createSubscription))
+	handle(endpointsAPI, "GET /api/subscriptions", requirePartner(listSubscriptions))
+	handle(endpointsAPI, "GET /api/subscriptions/{id}", requirePartner(getSubscription))
+	handle(endpointsAPI, "DELETE /api/subscriptions/{id}", requirePartner(deleteSubscription))
+
+	log.WithFields(logrus.Fields{
+		"event":    "webhooks_api",
+		"status":   "enabled",
+		"partners": len(partnerKeys),
+	}).Info("Webhook subscriptions API enabled")
+}
+
+// webhookOwner is who manages a webhook subscription: a partner API key, or
+// a tenant admin token whose subscriptions stay within the tenant's topics.
+type webhookOwner struct {
+	name   string
+	tenant string
+}
+
+// allows reports whether the owner may subscribe to a topic pattern.
+func (o webhookOwner) allows(pattern string) bool {
+	return o.tenant == "" || strings.HasPrefix(pattern, o.tenant+".")
+}
+
+func requirePartner(next func(http.ResponseWriter, *http.Request, webhookOwner)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		partner, ok := authenticatePartner(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "invalid API key")
+			return
+		}
+		next(w, r, webhookOwner{name: partner})
+	}
+}
+
+func authenticatePartner(r *http.Request) (string, bool) {
+	key := r.Header.Get(apiKeyHeader)
+	if key == "" {
+		return "", false
+	}
+	for _, k := range partnerKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return k.Partner, true
+		}
+	}
+	return "", false
+}
+
+func createSubscription(w http.ResponseWriter, r *http.Request, owner webhookOwner) {
+	partner := owner.name
+
+	var req createSubscriptionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSubscriptionBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := validateWebhookURL(r.Context(), req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Topics) == 0 {
+		req.Topics = []string{"#"}
+		if owner.tenant != "" {
+			req.Topics = []string{owner.tenant + ".#"}
+		}
+	}
+	for _, topic := range req.Topics {
+		if !owner.allows(topic) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("topic %q is outside the tenant namespace", topic))
+			return
+		}
+	}
+
+	webhookSubsMu.Lock()
+	if limit := conf().GetInt("webhooks.max_subscriptions_per_owner"); limit > 0 && ownedSubscriptions(partner) >= limit {
+		webhookSubsMu.Unlock()
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("at most %d webhook subscriptions allowed", limit))
+		return
+	}
+	sub := &webhookSubscription{
+		ID:        newID(),
+		URL:       req.URL,
+		Topics:    req.Topics,
+		CreatedAt: time.Now().UTC(),
+		partner:   partner,
+		secret:    req.Secret,
+		queue:     make(chan webhookDelivery, conf().GetInt("webhooks.queue_size")),
+		priority:  make(chan webhookDelivery, conf().GetInt("webhooks.queue_size")),
+		breaker: newCircuitBreaker(
+			conf().GetInt("webhooks.breaker_threshold"),
+			conf().GetDuration("webhooks.breaker_cooldown"),
+		),
+	}
+	sub.ctx, sub.cancel = context.WithCancel(context.Background())
+	webhookSubs[sub.ID] = sub
+	webhookSubsMu.Unlock()
+	go runWebhookWorker(sub)
+
+	log.WithFields(logrus.Fields{
+		"event":        "webhook_subscription",
+		"status":       "created",
+		"partner":      partner,
+		"subscription": sub.ID,
+		"url":          sub.URL,
+		"topics":       sub.Topics,
+	}).Info("Webhook subscription created")
+
+	writeJSON(w, http.StatusCreated, sub.snapshot())
+}
+
+// ownedSubscriptions counts the subscriptions partner manages. Must be called
+// with webhookSubsMu held.
+func ownedSubscriptions(partner string) int {
+	n := 0
+	for _, sub := range webhookSubs {
+		if sub.partner == partner {
+			n++
+		}
+	}
+	return n
+}
+
+func listSubscriptions(w http.ResponseWriter, r *http.Request, owner webhookOwner) {
+	partner := owner.name
+
+	webhookSubsMu.RLock()
+	subs := make([]webhookSubscriptionView, 0, len(webhookSubs))
+	for _, sub := range webhookSubs {
+		if sub.partner == partner {
+			subs = append(subs, sub.snapshot())
+		}
+	}
+	webhookSubsMu.RUnlock()
+
+	writeJSON(w, http.StatusOK, subs)
+}
+
+func getSubscription(w http.ResponseWriter, r *http.Request, owner webhookOwner) {
+	partner := owner.name
+
+	webhookSubsMu.RLock()
+	sub, found := webhookSubs[r.PathValue("id")]
+	webhookSubsMu.RUnlock()
+	if !found || sub.partner != partner {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sub.snapshot())
+}
+
+func deleteSubscription(w http.ResponseWriter, r *http.Request, owner webhookOwner) {
+	partner := owner.name
+
+	id := r.PathValue("id")
+	webhookSubsMu.Lock()
+	sub, found := webhookSubs[id]
+	if found && sub.partner == partner {
+		delete(webhookSubs, id)
+	}
+	webhookSubsMu.Unlock()
+	if !found || sub.partner != partner {
+		writeError(w, http.StatusNotFound, "subscription not found")
+		return
+	}
+	sub.cancel()
+
+	log.WithFields(logrus.Fields{
+		"event":        "webhook_subscription",
+		"status":       "deleted",
+		"partner":      partner,
+		"subscription": id,
+	}).Info("Webhook subscription deleted")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func dispatchWebhooks(source, topic string, body []byte) {
+	webhookSubsMu.RLock()
+	defer webhookSubsMu.RUnlock()
+
+	for _, sub := range webhookSubs {
+		if !matchesAny(sub.Topics, topic) {
+			continue
+		}
+		queue := sub.queue
+		if isPriorityTopic(topic) {
+			queue = sub.priority
+		}
+		select {
+		case queue <- webhookDelivery{id: newID(), source: source, topic: topic, body: body}:
+		default:
+			sub.mu.Lock()
+			sub.Stats.Dropped++
+			sub.mu.Unlock()
+			recordDrop(dropQueueFull, topic, logrus.Fields{"subscription": sub.ID})
+		}
+	}
+}
+
+func runWebhookWorker(sub *webhookSubscription) {
+	for {
+		var d webhookDelivery
+		select {
+		case <-sub.ctx.Done():
+			return
+		case d = <-sub.priority:
+		default:
+			select {
+			case <-sub.ctx.Done():
+				return
+			case d = <-sub.priority:
+			case d = <-sub.queue:
+			}
+		}
+		if !sub.deliverWithRetry(d) {
+			return
+		}
+	}
+}
+
+func (s *webhookSubscription) deliverWithRetry(d webhookDelivery) bool {
+	var status int
+	start := time.Now()
+	attempts := 0
+	err := retry(s.ctx, "webhook", webhookRetry, func() error {
+		if !s.breaker.Allow() {
+			return permanent(errCircuitOpen)
+		}
+		attempts++
+		var err error
+		status, err = deliverWebhook(s, d)
+		if err == nil {
+			s.breaker.Success()
+			return nil
+		}
+		if s.breaker.Failure() {
+			log.WithFields(logrus.Fields{
+				"event":        "webhook_circuit",
+				"status":       "open",
+				"subscription": s.ID,
+				"url":          s.URL,
+			}).Warn("Webhook circuit opened after repeated failures")
+		}
+		return err
+	})
+
+	switch {
+	case s.ctx.Err() != nil:
+		return false
+	case errors.Is(err, errCircuitOpen):
+		s.recordShortCircuit(d)
+		queueWebhookDeadLetter(s, d, string(dropCircuitOpen), err)
+	default:
+		recordSinkDelivery(sinkWebhook, time.Since(start), max(attempts-1, 0), len(d.body), err)
+		s.recordDelivery(d, status, err)
+		if err != nil {
+			queueWebhookDeadLetter(s, d, "webhook_failed", err)
+		}
+	}
+	return true
+}
+
+func deliverWebhook(sub *webhookSubscription, d webhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(sub.ctx, http.MethodPost, sub.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return 0, err
+	}
+	contentType := "application/octet-stream"
+	if json.Valid(d.body) {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Relay-Delivery", d.id)
+	req.Header.Set("X-Relay-Subscription", sub.ID)
+	req.Header.Set("X-Relay-Topic", d.topic)
+	if sub.secret != "" {
+		req.Header.Set("X-Relay-Signature", "sha256="+signHMAC(sub.secret, d.body))
+	} else if key := currentSigningKey(time.Now()); key != nil {
+		req.Header.Set("X-Relay-Signature", "sha256="+signHMAC(key.Secret, d.body))
+		req.Header.Set("X-Relay-Key-Id", key.ID)
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *webhookSubscription) recordDelivery(d webhookDelivery, status int, err error) {
+	now := time.Now().UTC()
+	s.mu.Lock()
+	s.Stats.LastStatus = status
+	s.Stats.LastDeliveryAt = &now
+	if err != nil {
+		s.Stats.Failed++
+		s.Stats.LastError = err.Error()
+	} else {
+		s.Stats.Delivered++
+		s.Stats.LastError = ""
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"event":        "webhook_delivery",
+			"status":       "failed",
+			"subscription": s.ID,
+			"delivery":     d.id,
+			"topic":        d.topic,
+			"error":        err.Error(),
+		}).Error("Failed to deliver webhook")
+	}
+}
+
+func (s *webhookSubscription) recordShortCircuit(d webhookDelivery) {
+	s.mu.Lock()
+	s.Stats.ShortCircuited++
+	s.mu.Unlock()
+
+	recordDrop(dropCircuitOpen, d.topic, logrus.Fields{"subscription": s.ID, "delivery": d.id})
+}
+
+func (s *webhookSubscription) snapshot() webhookSubscriptionView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return webhookSubscriptionView{
+		ID:        s.ID,
+		URL:       s.URL,
+		Topics:    s.Topics,
+		CreatedAt: s.CreatedAt,
+		Circuit:   s.breaker.State().String(),
+		Stats:     s.Stats,
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookFailuresAreDeadLettered(t *testing.T) {
+	useConfig(t, `webhooks:
+  allow_private_networks: true
+  retry:
+    max_attempts: 2
+`)
+	previousRetry, previousClient := webhookRetry, webhookClient
+	webhookRetry, webhookClient = loadRetryPolicy("webhooks.retry"), newWebhookClient()
+	t.Cleanup(func() { webhookRetry, webhookClient = previousRetry, previousClient })
+	deadLetters = make(chan deadLetter, 2)
+	t.Cleanup(func() { deadLetters = nil })
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sub := &webhookSubscription{ID: "sub-1", URL: srv.URL, breaker: newCircuitBreaker(2, time.Hour), ctx: ctx}
+
+	tests := []struct {
+		name   string
+		reason string
+	}{
+		{"retries exhausted", "webhook_failed"},
+		{"circuit open", string(dropCircuitOpen)},
+	}
+	for _, tt := range tests {
+		sub.deliverWithRetry(webhookDelivery{id: "d-1", source: "rabbitmq", topic: "a.b", body: []byte(`{"x":1}`)})
+		select {
+		case d := <-deadLetters:
+			if d.reason != tt.reason || d.headers[deadLetterHeaderSubscription] != "sub-1" ||
+				d.ack.msg.RoutingKey != "a.b" || d.ack.manual {
+				t.Errorf("%s: dead letter = %+v", tt.name, d)
+			}
+		default:
+			t.Errorf("%s: webhook delivery wasn't dead-lettered", tt.name)
+		}
+	}
+}
+
+func TestCreateSubscriptionCapsPerOwner(t *testing.T) {
+	useConfig(t, "webhooks:\n  allow_private_networks: true\n  queue_size: 1\n  max_subscriptions_per_owner: 1\n")
+	t.Cleanup(func() {
+		webhookSubsMu.Lock()
+		for id, sub := range webhookSubs {
+			sub.cancel()
+			delete(webhookSubs, id)
+		}
+		webhookSubsMu.Unlock()
+	})
+
+	tests := []struct {
+		owner  webhookOwner
+		status int
+	}{
+		{webhookOwner{name: "partner-a"}, http.StatusCreated},
+		{webhookOwner{name: "partner-a"}, http.StatusTooManyRequests},
+		{webhookOwner{name: "partner-b"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		body := strings.NewReader(`{"url":"http://127.0.0.1:9/hook","topics":["a.#"]}`)
+		w := httptest.NewRecorder()
+		createSubscription(w, httptest.NewRequest(http.MethodPost, "/api/subscriptions", body), tt.owner)
+		if w.Code != tt.status {
+			t.Errorf("creating a subscription for %s = %d, want %d", tt.owner.name, w.Code, tt.status)
+		}
+	}
+}